@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// breakerThreshold is how many calls in a row must fail to reach a torrent
+// client before it is considered down.
+const breakerThreshold = 5
+
+// breakerCooldown is how long a torrent client considered down is not
+// called at all.
+const breakerCooldown = 30 * time.Second
+
+// circuitBreaker stops calling a torrent client that cannot be reached, so
+// that users get an error right away instead of waiting for every call to
+// time out. Once the cooldown is over, calls are let through again, and the
+// first one failing opens the circuit anew.
+type circuitBreaker struct {
+	name string
+	now  func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, now: time.Now}
+}
+
+// allow returns an unreachable client error while the circuit is open.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.now().Before(b.openUntil) {
+		return withKind(errClientUnreachable, fmt.Errorf("instance %s is down, not retrying until %s", b.name, b.openUntil.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// record accounts the result of a call and reports whether the client
+// could not be reached.
+func (b *circuitBreaker) record(err error) bool {
+	if !errors.Is(clientError(err), errClientUnreachable) {
+		b.mu.Lock()
+		b.failures = 0
+		b.mu.Unlock()
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = b.now().Add(breakerCooldown)
+		log.Printf("Instance %s failed %d times in a row, pausing calls for %v: %v", b.name, b.failures, breakerCooldown, err)
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker("home")
+	b.now = func() time.Time { return now }
+	unreachable := errors.New("request error: connection refused")
+
+	for i := 0; i < breakerThreshold-1; i++ {
+		if !b.record(unreachable) {
+			t.Fatal("connection refused not recorded as unreachable")
+		}
+	}
+	if b.record(errTorrentNotFound) {
+		t.Error("torrent not found recorded as unreachable")
+	}
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.record(unreachable)
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("circuit open after a success and %d failures: %v", breakerThreshold-1, err)
+	}
+	b.record(unreachable)
+	err := b.allow()
+	if !errors.Is(err, errClientUnreachable) {
+		t.Fatalf("allow() = %v, want an unreachable client error", err)
+	}
+
+	now = now.Add(breakerCooldown)
+	if err := b.allow(); err != nil {
+		t.Fatalf("circuit still open after the cooldown: %v", err)
+	}
+	b.record(unreachable)
+	if err := b.allow(); err == nil {
+		t.Error("circuit not opened again by a failure after the cooldown")
+	}
+	now = now.Add(breakerCooldown)
+	b.record(nil)
+	b.record(unreachable)
+	if err := b.allow(); err != nil {
+		t.Errorf("circuit open after a success: %v", err)
+	}
+}
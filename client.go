@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+)
+
+// Client is the set of operations the bot needs from a torrent client.
+// Torrents are identified by their lowercase hex info hash.
+type Client interface {
+	// Add adds a .torrent file and starts downloading it into downloadDir,
+	// or into the client's default directory if downloadDir is empty.
+	Add(fileName string, downloadDir string) (*TorrentInfo, error)
+	Start(hashes ...string) error
+	Stop(hashes ...string) error
+	Remove(hash string, deleteData bool) error
+	// Status returns the torrents with the given hashes, or all torrents if
+	// no hash is given. Unknown hashes are silently skipped.
+	Status(hashes ...string) ([]*TorrentInfo, error)
+	Files(hash string) ([]*TorrentFileInfo, error)
+	Settings() (*ClientSettings, error)
+}
+
+// seedLimiter is implemented by clients able to stop seeding by themselves
+// once a torrent reaches a ratio or has been idle for some time. A zero
+// limit disables it.
+type seedLimiter interface {
+	SetSeedLimits(hash string, ratio float64, idle time.Duration) error
+}
+
+// torrentDetailer is implemented by clients able to report the trackers
+// and peers of a torrent.
+type torrentDetailer interface {
+	Details(hash string) (*TorrentDetails, error)
+}
+
+// torrentRepairer is implemented by clients able to ask the trackers for
+// more peers and to check the downloaded data of a torrent again.
+type torrentRepairer interface {
+	Reannounce(hash string) error
+	Verify(hash string) error
+}
+
+// TorrentInfo is the client-agnostic state of a torrent. Sizes are in
+// bytes and rates in bytes per second. Times are zero when unknown, like the
+// last activity of a torrent never active.
+type TorrentInfo struct {
+	Hash         string
+	Name         string
+	Status       string
+	PercentDone  float64
+	DownloadDir  string
+	TotalSize    int64
+	Ratio        float64
+	SeedingTime  time.Duration
+	LastActivity time.Time
+	// DoneSize out of SizeWhenDone, the size of the wanted files.
+	DoneSize     int64
+	SizeWhenDone int64
+	DownloadRate int64
+	UploadRate   int64
+	// ETA is negative when unknown.
+	ETA            time.Duration
+	PeersConnected int
+	// SeedsConnected are the connected peers sending to us.
+	SeedsConnected int
+	Uploaded       int64
+	AddedAt        time.Time
+	// Error is the error reported by the client for the torrent, and
+	// TrackerError the last failed announce.
+	Error        string
+	TrackerError string
+	// TrackersFailing is set when every tracker failed its last announce.
+	TrackersFailing bool
+}
+
+// TorrentDetails are the trackers and connected peers of a torrent.
+type TorrentDetails struct {
+	Trackers []*TrackerInfo
+	Peers    []*PeerInfo
+}
+
+type TrackerInfo struct {
+	Host         string
+	Tier         int
+	Seeders      int
+	Leechers     int
+	Downloads    int
+	LastAnnounce time.Time
+	// LastResult is the announce error when Succeeded is false.
+	LastResult string
+	Succeeded  bool
+}
+
+type PeerInfo struct {
+	Address      string
+	Client       string
+	Progress     float64
+	DownloadRate int64
+	UploadRate   int64
+	Encrypted    bool
+}
+
+type TorrentFileInfo struct {
+	Name           string
+	Length         int64
+	BytesCompleted int64
+}
+
+type ClientSettings struct {
+	DownloadDir      string
+	SeedRatioLimit   float64
+	SeedRatioLimited bool
+	// Speed limits in bytes per second, 0 meaning unlimited.
+	DownloadLimit int64
+	UploadLimit   int64
+}
+
+// errTorrentNotFound is returned by operations on a single torrent the
+// client does not know about.
+var errTorrentNotFound = errors.New("torrent not found")
+
+// clients are the clients of the instances, made once and shared, so that
+// they keep their sessions and circuit breakers.
+var clients = struct {
+	sync.Mutex
+	m map[*InstanceConfig]Client
+}{m: make(map[*InstanceConfig]Client)}
+
+// client returns the torrent client of the instance.
+func (instance *InstanceConfig) client() (Client, error) {
+	clients.Lock()
+	defer clients.Unlock()
+	if c, ok := clients.m[instance]; ok {
+		return c, nil
+	}
+	c, err := instance.newClient()
+	if err != nil {
+		return nil, err
+	}
+	clients.m[instance] = c
+	return c, nil
+}
+
+// newClient makes a torrent client for the instance according to its type.
+func (instance *InstanceConfig) newClient() (Client, error) {
+	switch instance.Type {
+	case "", "transmission":
+		return newTransmissionClient(instance)
+	case "qbittorrent":
+		return newQBittorrentClient(instance)
+	case "deluge":
+		return newDelugeClient(instance)
+	default:
+		return nil, fmt.Errorf("unknown client type %q of instance %q", instance.Type, instance.Name)
+	}
+}
+
+// baseURL returns the web UI root of the instance for HTTP-based clients.
+func (instance *InstanceConfig) baseURL(defaultPort uint16) string {
+	if instance.URL != "" {
+		return strings.TrimRight(instance.URL, "/")
+	}
+	scheme := "http"
+	if instance.HTTPS {
+		scheme = "https"
+	}
+	port := instance.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, instance.Host, port)
+}
+
+// readTorrentFile returns the content of a .torrent file along with its
+// parsed metadata, for clients that do not report what they have added.
+func readTorrentFile(fileName string) ([]byte, *gtp.Torrent, error) {
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	torrentFile, err := gtp.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, torrentFile, nil
+}
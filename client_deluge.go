@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var delugeTorrentFields = []string{
+	"hash", "name", "state", "progress", "save_path", "total_size",
+	"ratio", "seeding_time", "time_since_transfer", "total_done", "total_wanted",
+	"download_payload_rate", "upload_payload_rate", "eta", "num_peers", "num_seeds",
+	"total_uploaded", "time_added", "message", "tracker_status",
+}
+
+// delugeClient talks to the JSON-RPC endpoint of the Deluge web UI, which
+// proxies calls to the daemon it is connected to.
+type delugeClient struct {
+	url      string
+	password string
+	http     *http.Client
+	breaker  *circuitBreaker
+	id       int64
+
+	loginMu  sync.Mutex
+	loggedIn bool
+}
+
+type delugeRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     int64         `json:"id"`
+}
+
+type delugeError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *delugeError) Error() string {
+	return fmt.Sprintf("deluge: %s (%d)", e.Message, e.Code)
+}
+
+type delugeResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *delugeError    `json:"error"`
+}
+
+type delugeTorrent struct {
+	Hash              string  `json:"hash"`
+	Name              string  `json:"name"`
+	State             string  `json:"state"`
+	Progress          float64 `json:"progress"`
+	SavePath          string  `json:"save_path"`
+	TotalSize         int64   `json:"total_size"`
+	Ratio             float64 `json:"ratio"`
+	SeedingTime       int64   `json:"seeding_time"`
+	TimeSinceTransfer int64   `json:"time_since_transfer"`
+	TotalDone         int64   `json:"total_done"`
+	TotalWanted       int64   `json:"total_wanted"`
+	DownloadRate      float64 `json:"download_payload_rate"`
+	UploadRate        float64 `json:"upload_payload_rate"`
+	ETA               float64 `json:"eta"`
+	NumPeers          int     `json:"num_peers"`
+	NumSeeds          int     `json:"num_seeds"`
+	TotalUploaded     int64   `json:"total_uploaded"`
+	TimeAdded         float64 `json:"time_added"`
+	Message           string  `json:"message"`
+	TrackerStatus     string  `json:"tracker_status"`
+}
+
+var delugeStates = map[string]string{
+	"Allocating":  "downloading",
+	"Checking":    "checking files",
+	"Downloading": "downloading",
+	"Seeding":     "seeding",
+	"Paused":      "stopped",
+	"Error":       "error",
+	"Queued":      "queued",
+	"Moving":      "moving",
+}
+
+// Deluge reports authentication failures with this error code.
+const delugeErrorNotAuthenticated = 1
+
+func newDelugeClient(instance *InstanceConfig) (*delugeClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &delugeClient{
+		url:      instance.baseURL(8112) + "/json",
+		password: instance.Password,
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: TRANSMISSION_TIMEOUT,
+		},
+		breaker: newCircuitBreaker(instance.Name),
+	}, nil
+}
+
+func (c *delugeClient) rawCall(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	payload, err := json.Marshal(&delugeRequest{
+		Method: method,
+		Params: params,
+		ID:     atomic.AddInt64(&c.id, 1),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Post(c.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deluge %s: unexpected status %d", method, resp.StatusCode)
+	}
+	var response delugeResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+// login authenticates against the web UI and makes sure it is connected
+// to a daemon, connecting it to the first known host otherwise.
+func (c *delugeClient) login() error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+	if c.loggedIn {
+		return nil
+	}
+	var ok bool
+	err := c.rawCall("auth.login", &ok, c.password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("deluge login failed")
+	}
+	var connected bool
+	err = c.rawCall("web.connected", &connected)
+	if err != nil {
+		return err
+	}
+	if !connected {
+		var hosts [][]interface{}
+		err = c.rawCall("web.get_hosts", &hosts)
+		if err != nil {
+			return err
+		}
+		if len(hosts) == 0 || len(hosts[0]) == 0 {
+			return errors.New("deluge web UI has no daemon configured")
+		}
+		err = c.rawCall("web.connect", nil, hosts[0][0])
+		if err != nil {
+			return err
+		}
+	}
+	c.loggedIn = true
+	return nil
+}
+
+// call performs an authenticated call, logging in again once if the session
+// has expired. Calls fail right away while the client is considered down.
+func (c *delugeClient) call(method string, result interface{}, params ...interface{}) (err error) {
+	err = c.breaker.allow()
+	if err != nil {
+		return err
+	}
+	defer func() { c.breaker.record(err) }()
+	for attempt := 0; ; attempt++ {
+		err := c.login()
+		if err != nil {
+			return err
+		}
+		err = c.rawCall(method, result, params...)
+		var delugeErr *delugeError
+		if attempt == 0 && errors.As(err, &delugeErr) && delugeErr.Code == delugeErrorNotAuthenticated {
+			c.loginMu.Lock()
+			c.loggedIn = false
+			c.loginMu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+func (c *delugeClient) Add(fileName string, downloadDir string) (*TorrentInfo, error) {
+	content, torrentFile, err := readTorrentFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	options := map[string]interface{}{
+		"add_paused": false,
+	}
+	if downloadDir != "" {
+		options["download_location"] = downloadDir
+	}
+	var hash *string
+	err = c.call(
+		"core.add_torrent_file",
+		&hash,
+		filepath.Base(fileName),
+		base64.StdEncoding.EncodeToString(content),
+		options,
+	)
+	var delugeErr *delugeError
+	if errors.As(err, &delugeErr) {
+		// Deluge 2 fails to add the torrents it already has.
+		found, statusErr := c.has(torrentFile.InfoHash)
+		if statusErr == nil && found {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Deluge 1 returns null for torrents it already has.
+	info := &TorrentInfo{
+		Hash: torrentFile.InfoHash,
+		Name: torrentFile.Info.Name,
+	}
+	if hash != nil {
+		info.Hash = *hash
+	}
+	return info, c.Start(info.Hash)
+}
+
+func (c *delugeClient) Start(hashes ...string) error {
+	return c.call("core.resume_torrent", nil, hashes)
+}
+
+func (c *delugeClient) Stop(hashes ...string) error {
+	return c.call("core.pause_torrent", nil, hashes)
+}
+
+func (c *delugeClient) Reannounce(hash string) error {
+	return c.call("core.force_reannounce", nil, []string{hash})
+}
+
+func (c *delugeClient) Verify(hash string) error {
+	return c.call("core.force_recheck", nil, []string{hash})
+}
+
+func (c *delugeClient) Remove(hash string, deleteData bool) error {
+	var removed bool
+	err := c.call("core.remove_torrent", &removed, hash, deleteData)
+	var delugeErr *delugeError
+	if errors.As(err, &delugeErr) {
+		// Deluge 2 fails to remove unknown torrents, where Deluge 1
+		// returns false.
+		found, statusErr := c.has(hash)
+		if statusErr == nil && !found {
+			return errTorrentNotFound
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errTorrentNotFound
+	}
+	return nil
+}
+
+// has reports whether Deluge has a torrent.
+func (c *delugeClient) has(hash string) (bool, error) {
+	torrents, err := c.Status(hash)
+	return len(torrents) > 0, err
+}
+
+func (c *delugeClient) Status(hashes ...string) ([]*TorrentInfo, error) {
+	filter := map[string]interface{}{}
+	if len(hashes) > 0 {
+		filter["id"] = hashes
+	}
+	var torrents map[string]*delugeTorrent
+	err := c.call("core.get_torrents_status", &torrents, filter, delugeTorrentFields)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*TorrentInfo
+	for hash, torrent := range torrents {
+		status, ok := delugeStates[torrent.State]
+		if !ok {
+			status = torrent.State
+		}
+		info := &TorrentInfo{
+			Hash:         hash,
+			Name:         torrent.Name,
+			Status:       status,
+			PercentDone:  torrent.Progress / 100,
+			DownloadDir:  torrent.SavePath,
+			TotalSize:    torrent.TotalSize,
+			Ratio:        torrent.Ratio,
+			SeedingTime:  time.Duration(torrent.SeedingTime) * time.Second,
+			DoneSize:     torrent.TotalDone,
+			SizeWhenDone: torrent.TotalWanted,
+			DownloadRate: int64(torrent.DownloadRate),
+			UploadRate:   int64(torrent.UploadRate),
+			// Deluge reports 0 when the ETA is unknown.
+			ETA:            -1,
+			PeersConnected: torrent.NumPeers + torrent.NumSeeds,
+			SeedsConnected: torrent.NumSeeds,
+			Uploaded:       torrent.TotalUploaded,
+		}
+		// Deluge reports -1 for torrents never active.
+		if torrent.TimeSinceTransfer >= 0 {
+			info.LastActivity = time.Now().Add(-time.Duration(torrent.TimeSinceTransfer) * time.Second)
+		}
+		if torrent.ETA > 0 {
+			info.ETA = time.Duration(torrent.ETA) * time.Second
+		}
+		if torrent.TimeAdded > 0 {
+			info.AddedAt = time.Unix(int64(torrent.TimeAdded), 0)
+		}
+		if torrent.Message != "" && torrent.Message != "OK" {
+			info.Error = torrent.Message
+		}
+		// Deluge only reports the status of the current tracker.
+		if strings.HasPrefix(torrent.TrackerStatus, "Error") {
+			info.TrackerError = torrent.TrackerStatus
+			info.TrackersFailing = true
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func (c *delugeClient) Files(hash string) ([]*TorrentFileInfo, error) {
+	var status struct {
+		Files []struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+		} `json:"files"`
+		FileProgress []float64 `json:"file_progress"`
+	}
+	err := c.call("core.get_torrent_status", &status, hash, []string{"files", "file_progress"})
+	if err != nil {
+		return nil, err
+	}
+	if status.Files == nil {
+		return nil, errTorrentNotFound
+	}
+	var files []*TorrentFileInfo
+	for i, file := range status.Files {
+		var progress float64
+		if i < len(status.FileProgress) {
+			progress = status.FileProgress[i]
+		}
+		files = append(files, &TorrentFileInfo{
+			Name:           file.Path,
+			Length:         file.Size,
+			BytesCompleted: int64(float64(file.Size) * progress),
+		})
+	}
+	return files, nil
+}
+
+func (c *delugeClient) Settings() (*ClientSettings, error) {
+	var values struct {
+		DownloadLocation string  `json:"download_location"`
+		StopSeedAtRatio  bool    `json:"stop_seed_at_ratio"`
+		StopSeedRatio    float64 `json:"stop_seed_ratio"`
+		MaxDownloadSpeed float64 `json:"max_download_speed"`
+		MaxUploadSpeed   float64 `json:"max_upload_speed"`
+	}
+	err := c.call("core.get_config_values", &values, []string{
+		"download_location", "stop_seed_at_ratio", "stop_seed_ratio", "max_download_speed", "max_upload_speed",
+	})
+	if err != nil {
+		return nil, err
+	}
+	settings := &ClientSettings{
+		DownloadDir:      values.DownloadLocation,
+		SeedRatioLimit:   values.StopSeedRatio,
+		SeedRatioLimited: values.StopSeedAtRatio,
+	}
+	// Deluge speeds are in KiB/s, negative meaning unlimited.
+	if values.MaxDownloadSpeed > 0 {
+		settings.DownloadLimit = int64(values.MaxDownloadSpeed * 1024)
+	}
+	if values.MaxUploadSpeed > 0 {
+		settings.UploadLimit = int64(values.MaxUploadSpeed * 1024)
+	}
+	return settings, nil
+}
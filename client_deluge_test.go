@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+)
+
+// fakeDeluge is an in-memory stand-in for the Deluge web UI JSON-RPC API.
+type fakeDeluge struct {
+	mu        sync.Mutex
+	torrents  map[string]*delugeTorrent
+	connected bool
+	sessions  int
+	// version2 raises errors like Deluge 2 instead of returning null or
+	// false for existing and unknown torrents.
+	version2 bool
+}
+
+func newFakeDeluge(t *testing.T) (*fakeDeluge, *httptest.Server) {
+	fake := &fakeDeluge{torrents: make(map[string]*delugeTorrent)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeDeluge) call(r *http.Request, req *delugeRequest) (interface{}, *delugeError) {
+	if req.Method == "auth.login" {
+		if req.Params[0] != "secret" {
+			return false, nil
+		}
+		f.sessions++
+		return true, nil
+	}
+	if cookie, err := r.Cookie("_session_id"); err != nil || cookie.Value != "session" {
+		return nil, &delugeError{Message: "Not authenticated", Code: delugeErrorNotAuthenticated}
+	}
+	switch req.Method {
+	case "web.connected":
+		return f.connected, nil
+	case "web.get_hosts":
+		return [][]interface{}{{"host-id", "127.0.0.1", 58846, "localclient"}}, nil
+	case "web.connect":
+		f.connected = req.Params[0] == "host-id"
+		return nil, nil
+	}
+	if !f.connected {
+		return nil, &delugeError{Message: "Not connected", Code: 2}
+	}
+	switch req.Method {
+	case "core.add_torrent_file":
+		content, err := base64.StdEncoding.DecodeString(req.Params[1].(string))
+		if err != nil {
+			return nil, &delugeError{Message: err.Error(), Code: 4}
+		}
+		torrentFile, err := gtp.Parse(bytes.NewReader(content))
+		if err != nil {
+			return nil, &delugeError{Message: err.Error(), Code: 4}
+		}
+		hash := torrentFile.InfoHash
+		if _, ok := f.torrents[hash]; ok {
+			if f.version2 {
+				return nil, &delugeError{Message: "AddTorrentError: Torrent already in session (" + hash + ").", Code: 4}
+			}
+			return nil, nil
+		}
+		options := req.Params[2].(map[string]interface{})
+		location, _ := options["download_location"].(string)
+		f.torrents[hash] = &delugeTorrent{Name: req.Params[0].(string), State: "Paused", SavePath: location, TotalSize: 1 << 20}
+		return hash, nil
+	case "core.resume_torrent", "core.pause_torrent":
+		state := map[string]string{"core.resume_torrent": "Downloading", "core.pause_torrent": "Paused"}[req.Method]
+		for _, hash := range req.Params[0].([]interface{}) {
+			if torrent, ok := f.torrents[hash.(string)]; ok {
+				torrent.State = state
+			}
+		}
+		return nil, nil
+	case "core.remove_torrent":
+		hash := req.Params[0].(string)
+		_, ok := f.torrents[hash]
+		if !ok && f.version2 {
+			return nil, &delugeError{Message: "InvalidTorrentError: torrent_id " + hash + " not in session.", Code: 4}
+		}
+		delete(f.torrents, hash)
+		return ok, nil
+	case "core.get_torrents_status":
+		filter := req.Params[0].(map[string]interface{})
+		result := make(map[string]*delugeTorrent)
+		for hash, torrent := range f.torrents {
+			ids, ok := filter["id"].([]interface{})
+			if !ok {
+				result[hash] = torrent
+				continue
+			}
+			for _, id := range ids {
+				if id == hash {
+					result[hash] = torrent
+				}
+			}
+		}
+		return result, nil
+	case "core.get_torrent_status":
+		torrent, ok := f.torrents[req.Params[0].(string)]
+		if !ok {
+			return map[string]interface{}{}, nil
+		}
+		return map[string]interface{}{
+			"files":         []map[string]interface{}{{"path": torrent.Name, "size": torrent.TotalSize}},
+			"file_progress": []float64{0.25},
+		}, nil
+	case "core.get_config_values":
+		return map[string]interface{}{"download_location": "/downloads", "max_download_speed": -1, "max_upload_speed": 100}, nil
+	}
+	return nil, &delugeError{Message: "Unknown method", Code: 3}
+}
+
+func (f *fakeDeluge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var req delugeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result, rpcErr := f.call(r, &req)
+	if req.Method == "auth.login" && result == true {
+		http.SetCookie(w, &http.Cookie{Name: "_session_id", Value: "session", Path: "/"})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "result": result, "error": rpcErr})
+}
+
+func TestDelugeClient(t *testing.T) {
+	fake, server := newFakeDeluge(t)
+	c, err := (&InstanceConfig{Name: "deluge", Type: "deluge", URL: server.URL, Password: "secret"}).client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName, _ := writeTestTorrent(t, "abc")
+	info, err := c.Add(fileName, "/downloads/music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fake.connected {
+		t.Error("client did not connect the web UI to a daemon")
+	}
+	hash := info.Hash
+	torrents, err := c.Status(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 || torrents[0].Status != "downloading" || torrents[0].DownloadDir != "/downloads/music" {
+		t.Fatalf("Status() = %+v", torrents)
+	}
+
+	// Adding the same torrent again is not an error.
+	_, err = c.Add(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Stop(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrents, _ = c.Status()
+	if len(torrents) != 1 || torrents[0].Status != "stopped" {
+		t.Errorf("Status() after Stop() = %+v", torrents)
+	}
+
+	files, err := c.Files(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].BytesCompleted != 1<<18 {
+		t.Errorf("Files() = %+v", files)
+	}
+
+	settings, err := c.Settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.DownloadDir != "/downloads" || settings.DownloadLimit != 0 || settings.UploadLimit != 100*1024 {
+		t.Errorf("Settings() = %+v", settings)
+	}
+
+	err = c.Remove(hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove(hash, false)
+	if err != errTorrentNotFound {
+		t.Errorf("second Remove() error = %v, want %v", err, errTorrentNotFound)
+	}
+	_, err = c.Files(hash)
+	if err != errTorrentNotFound {
+		t.Errorf("Files() of removed torrent error = %v, want %v", err, errTorrentNotFound)
+	}
+}
+
+func TestDelugeClientVersion2(t *testing.T) {
+	fake, server := newFakeDeluge(t)
+	fake.version2 = true
+	c, err := newDelugeClient(&InstanceConfig{URL: server.URL, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName, _ := writeTestTorrent(t, "abc")
+	info, err := c.Add(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Stop(info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Adding a torrent Deluge already has starts it.
+	_, err = c.Add(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrents, err := c.Status(info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 || torrents[0].Status != "downloading" {
+		t.Errorf("Status() after adding again = %+v, want it started", torrents)
+	}
+
+	err = c.Remove(info.Hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove(info.Hash, false)
+	if err != errTorrentNotFound {
+		t.Errorf("second Remove() error = %v, want %v", err, errTorrentNotFound)
+	}
+}
+
+func TestDelugeClientRelogin(t *testing.T) {
+	fake, server := newFakeDeluge(t)
+	c, err := newDelugeClient(&InstanceConfig{URL: server.URL, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an expired session.
+	c.http.Jar, _ = cookiejar.New(nil)
+	_, err = c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.sessions != 2 {
+		t.Errorf("logged in %d times, want 2", fake.sessions)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qBittorrentClient talks to the qBittorrent Web API (v2).
+type qBittorrentClient struct {
+	baseURL  string
+	user     string
+	password string
+	http     *http.Client
+	breaker  *circuitBreaker
+
+	loginMu  sync.Mutex
+	loggedIn bool
+}
+
+type qBittorrentTorrent struct {
+	Hash         string  `json:"hash"`
+	Name         string  `json:"name"`
+	State        string  `json:"state"`
+	Progress     float64 `json:"progress"`
+	SavePath     string  `json:"save_path"`
+	Size         int64   `json:"size"`
+	Ratio        float64 `json:"ratio"`
+	SeedingTime  int64   `json:"seeding_time"`
+	LastActivity int64   `json:"last_activity"`
+	Completed    int64   `json:"completed"`
+	DLSpeed      int64   `json:"dlspeed"`
+	UPSpeed      int64   `json:"upspeed"`
+	ETA          int64   `json:"eta"`
+	NumSeeds     int     `json:"num_seeds"`
+	NumLeechs    int     `json:"num_leechs"`
+	Uploaded     int64   `json:"uploaded"`
+	AddedOn      int64   `json:"added_on"`
+}
+
+// qBittorrentInfiniteETA is the ETA qBittorrent reports when it is unknown.
+const qBittorrentInfiniteETA = 8640000
+
+type qBittorrentFile struct {
+	Name     string  `json:"name"`
+	Size     int64   `json:"size"`
+	Progress float64 `json:"progress"`
+}
+
+type qBittorrentPreferences struct {
+	SavePath       string  `json:"save_path"`
+	MaxRatio       float64 `json:"max_ratio"`
+	MaxRatioEnable bool    `json:"max_ratio_enabled"`
+	DlLimit        int64   `json:"dl_limit"`
+	UpLimit        int64   `json:"up_limit"`
+}
+
+var qBittorrentStates = map[string]string{
+	"error":              "error",
+	"missingFiles":       "missing files",
+	"uploading":          "seeding",
+	"stalledUP":          "seeding",
+	"forcedUP":           "seeding",
+	"queuedUP":           "waiting to seed",
+	"pausedUP":           "stopped",
+	"stoppedUP":          "stopped",
+	"checkingUP":         "checking files",
+	"allocating":         "downloading",
+	"downloading":        "downloading",
+	"metaDL":             "downloading",
+	"forcedDL":           "downloading",
+	"stalledDL":          "can't find peers",
+	"queuedDL":           "waiting to download",
+	"pausedDL":           "stopped",
+	"stoppedDL":          "stopped",
+	"checkingDL":         "checking files",
+	"checkingResumeData": "checking files",
+	"moving":             "moving",
+}
+
+func newQBittorrentClient(instance *InstanceConfig) (*qBittorrentClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &qBittorrentClient{
+		baseURL:  instance.baseURL(8080),
+		user:     instance.User,
+		password: instance.Password,
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: TRANSMISSION_TIMEOUT,
+		},
+		breaker: newCircuitBreaker(instance.Name),
+	}, nil
+}
+
+func (c *qBittorrentClient) login() error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+	if c.loggedIn {
+		return nil
+	}
+	resp, err := c.http.PostForm(c.baseURL+"/api/v2/auth/login", url.Values{
+		"username": {c.user},
+		"password": {c.password},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "Ok." {
+		return fmt.Errorf("qbittorrent login failed: %s", strings.TrimSpace(string(body)))
+	}
+	c.loggedIn = true
+	return nil
+}
+
+// do performs an authenticated API call, logging in again once if the
+// session has expired. Calls fail right away while the client is considered
+// down.
+func (c *qBittorrentClient) do(newRequest func() (*http.Request, error)) (_ []byte, _ int, err error) {
+	err = c.breaker.allow()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { c.breaker.record(err) }()
+	for attempt := 0; attempt < 2; attempt++ {
+		err := c.login()
+		if err != nil {
+			return nil, 0, err
+		}
+		req, err := newRequest()
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, resp.StatusCode, err
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			c.loginMu.Lock()
+			c.loggedIn = false
+			c.loginMu.Unlock()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return body, resp.StatusCode, fmt.Errorf("qbittorrent %s: unexpected status %d", req.URL.Path, resp.StatusCode)
+		}
+		return body, resp.StatusCode, nil
+	}
+	return nil, http.StatusForbidden, fmt.Errorf("qbittorrent: forbidden")
+}
+
+func (c *qBittorrentClient) get(path string, query url.Values) ([]byte, error) {
+	body, _, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil)
+	})
+	return body, err
+}
+
+func (c *qBittorrentClient) post(path string, form url.Values) ([]byte, int, error) {
+	return c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.baseURL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
+
+// postAction calls one of the endpoints renamed in qBittorrent 5
+// (pause/resume became stop/start), falling back to the old name.
+func (c *qBittorrentClient) postAction(path string, legacyPath string, form url.Values) error {
+	_, status, err := c.post(path, form)
+	if status == http.StatusNotFound {
+		_, _, err = c.post(legacyPath, form)
+	}
+	return err
+}
+
+func (c *qBittorrentClient) Add(fileName string, downloadDir string) (*TorrentInfo, error) {
+	content, torrentFile, err := readTorrentFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var payload bytes.Buffer
+	w := multipart.NewWriter(&payload)
+	part, err := w.CreateFormFile("torrents", filepath.Base(fileName))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(part, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if downloadDir != "" {
+		w.WriteField("savepath", downloadDir)
+	}
+	w.WriteField("paused", "false")
+	w.WriteField("stopped", "false")
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/v2/torrents/add", bytes.NewReader(payload.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(body)) == "Fails." {
+		return c.startExisting(torrentFile.InfoHash, fileName)
+	}
+	return &TorrentInfo{
+		Hash: torrentFile.InfoHash,
+		Name: torrentFile.Info.Name,
+	}, nil
+}
+
+// startExisting starts a torrent qBittorrent refused to add because it
+// already has it, as adding it to Transmission would.
+func (c *qBittorrentClient) startExisting(hash string, fileName string) (*TorrentInfo, error) {
+	torrents, err := c.Status(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) == 0 {
+		return nil, fmt.Errorf("qbittorrent refused torrent %s", fileName)
+	}
+	err = c.Start(hash)
+	if err != nil {
+		return nil, err
+	}
+	return torrents[0], nil
+}
+
+func (c *qBittorrentClient) Start(hashes ...string) error {
+	return c.postAction("/api/v2/torrents/start", "/api/v2/torrents/resume", url.Values{
+		"hashes": {strings.Join(hashes, "|")},
+	})
+}
+
+func (c *qBittorrentClient) Stop(hashes ...string) error {
+	return c.postAction("/api/v2/torrents/stop", "/api/v2/torrents/pause", url.Values{
+		"hashes": {strings.Join(hashes, "|")},
+	})
+}
+
+func (c *qBittorrentClient) Reannounce(hash string) error {
+	_, _, err := c.post("/api/v2/torrents/reannounce", url.Values{"hashes": {hash}})
+	return err
+}
+
+func (c *qBittorrentClient) Verify(hash string) error {
+	_, _, err := c.post("/api/v2/torrents/recheck", url.Values{"hashes": {hash}})
+	return err
+}
+
+func (c *qBittorrentClient) Remove(hash string, deleteData bool) error {
+	torrents, err := c.Status(hash)
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return errTorrentNotFound
+	}
+	_, _, err = c.post("/api/v2/torrents/delete", url.Values{
+		"hashes":      {hash},
+		"deleteFiles": {fmt.Sprint(deleteData)},
+	})
+	return err
+}
+
+func (c *qBittorrentClient) Status(hashes ...string) ([]*TorrentInfo, error) {
+	query := url.Values{}
+	if len(hashes) > 0 {
+		query.Set("hashes", strings.Join(hashes, "|"))
+	}
+	body, err := c.get("/api/v2/torrents/info", query)
+	if err != nil {
+		return nil, err
+	}
+	var torrents []*qBittorrentTorrent
+	err = json.Unmarshal(body, &torrents)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*TorrentInfo
+	for _, torrent := range torrents {
+		status, ok := qBittorrentStates[torrent.State]
+		if !ok {
+			status = torrent.State
+		}
+		eta := time.Duration(-1)
+		if torrent.ETA >= 0 && torrent.ETA < qBittorrentInfiniteETA {
+			eta = time.Duration(torrent.ETA) * time.Second
+		}
+		infos = append(infos, &TorrentInfo{
+			Hash:           torrent.Hash,
+			Name:           torrent.Name,
+			Status:         status,
+			PercentDone:    torrent.Progress,
+			DownloadDir:    torrent.SavePath,
+			TotalSize:      torrent.Size,
+			Ratio:          torrent.Ratio,
+			SeedingTime:    time.Duration(torrent.SeedingTime) * time.Second,
+			DoneSize:       torrent.Completed,
+			SizeWhenDone:   torrent.Size,
+			DownloadRate:   torrent.DLSpeed,
+			UploadRate:     torrent.UPSpeed,
+			ETA:            eta,
+			PeersConnected: torrent.NumSeeds + torrent.NumLeechs,
+			SeedsConnected: torrent.NumSeeds,
+			Uploaded:       torrent.Uploaded,
+		})
+		if torrent.AddedOn > 0 {
+			infos[len(infos)-1].AddedAt = time.Unix(torrent.AddedOn, 0)
+		}
+		if torrent.LastActivity > 0 {
+			infos[len(infos)-1].LastActivity = time.Unix(torrent.LastActivity, 0)
+		}
+	}
+	return infos, nil
+}
+
+func (c *qBittorrentClient) Files(hash string) ([]*TorrentFileInfo, error) {
+	body, status, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.baseURL+"/api/v2/torrents/files?hash="+url.QueryEscape(hash), nil)
+	})
+	if status == http.StatusNotFound {
+		return nil, errTorrentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var qFiles []*qBittorrentFile
+	err = json.Unmarshal(body, &qFiles)
+	if err != nil {
+		return nil, err
+	}
+	var files []*TorrentFileInfo
+	for _, file := range qFiles {
+		files = append(files, &TorrentFileInfo{
+			Name:           file.Name,
+			Length:         file.Size,
+			BytesCompleted: int64(float64(file.Size) * file.Progress),
+		})
+	}
+	return files, nil
+}
+
+func (c *qBittorrentClient) Settings() (*ClientSettings, error) {
+	body, err := c.get("/api/v2/app/preferences", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var prefs qBittorrentPreferences
+	err = json.Unmarshal(body, &prefs)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientSettings{
+		DownloadDir:      prefs.SavePath,
+		SeedRatioLimit:   prefs.MaxRatio,
+		SeedRatioLimited: prefs.MaxRatioEnable,
+		DownloadLimit:    prefs.DlLimit,
+		UploadLimit:      prefs.UpLimit,
+	}, nil
+}
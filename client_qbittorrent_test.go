@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+)
+
+// fakeQBittorrent is an in-memory stand-in for the qBittorrent Web API.
+type fakeQBittorrent struct {
+	mu       sync.Mutex
+	torrents map[string]*qBittorrentTorrent
+	deleted  map[string]bool
+	logins   int
+	// legacy serves only the pre-5.0 pause/resume endpoints.
+	legacy bool
+}
+
+func newFakeQBittorrent(t *testing.T) (*fakeQBittorrent, *httptest.Server) {
+	fake := &fakeQBittorrent{
+		torrents: make(map[string]*qBittorrentTorrent),
+		deleted:  make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeQBittorrent) setState(hashes string, state string) {
+	for _, hash := range strings.Split(hashes, "|") {
+		if torrent, ok := f.torrents[hash]; ok {
+			torrent.State = state
+		}
+	}
+}
+
+func (f *fakeQBittorrent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/api/v2/auth/login" {
+		r.ParseForm()
+		if r.Form.Get("username") != "admin" || r.Form.Get("password") != "secret" {
+			w.Write([]byte("Fails."))
+			return
+		}
+		f.logins++
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: "session", Path: "/"})
+		w.Write([]byte("Ok."))
+		return
+	}
+	if cookie, err := r.Cookie("SID"); err != nil || cookie.Value != "session" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/v2/torrents/add":
+		file, _, err := r.FormFile("torrents")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		torrentFile, err := gtp.Parse(file)
+		file.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hash := torrentFile.InfoHash
+		if _, ok := f.torrents[hash]; ok {
+			w.Write([]byte("Fails."))
+			return
+		}
+		f.torrents[hash] = &qBittorrentTorrent{
+			Hash:     hash,
+			Name:     torrentFile.Info.Name,
+			State:    "downloading",
+			SavePath: r.FormValue("savepath"),
+			Size:     1 << 20,
+		}
+		w.Write([]byte("Ok."))
+	case "/api/v2/torrents/start", "/api/v2/torrents/stop":
+		if f.legacy {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		state := map[string]string{"/api/v2/torrents/start": "downloading", "/api/v2/torrents/stop": "stoppedDL"}[r.URL.Path]
+		f.setState(r.FormValue("hashes"), state)
+	case "/api/v2/torrents/resume", "/api/v2/torrents/pause":
+		state := map[string]string{"/api/v2/torrents/resume": "downloading", "/api/v2/torrents/pause": "pausedDL"}[r.URL.Path]
+		f.setState(r.FormValue("hashes"), state)
+	case "/api/v2/torrents/delete":
+		hash := r.FormValue("hashes")
+		delete(f.torrents, hash)
+		f.deleted[hash] = r.FormValue("deleteFiles") == "true"
+	case "/api/v2/torrents/info":
+		var torrents []*qBittorrentTorrent
+		hashes := r.URL.Query().Get("hashes")
+		for hash, torrent := range f.torrents {
+			if hashes == "" || strings.Contains(hashes, hash) {
+				torrents = append(torrents, torrent)
+			}
+		}
+		json.NewEncoder(w).Encode(torrents)
+	case "/api/v2/torrents/files":
+		torrent, ok := f.torrents[r.URL.Query().Get("hash")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*qBittorrentFile{{Name: torrent.Name, Size: torrent.Size, Progress: 0.5}})
+	case "/api/v2/app/preferences":
+		json.NewEncoder(w).Encode(&qBittorrentPreferences{SavePath: "/downloads", MaxRatio: 2, MaxRatioEnable: true})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestQBittorrentClient(t *testing.T) {
+	fake, server := newFakeQBittorrent(t)
+	c, err := (&InstanceConfig{Name: "qbt", Type: "qbittorrent", URL: server.URL, User: "admin", Password: "secret"}).client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName, hash := writeTestTorrent(t, "abc")
+
+	info, err := c.Add(fileName, "/downloads/films")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Hash != hash || info.Name != "abc" {
+		t.Errorf("Add() = %+v, want hash %s and name abc", info, hash)
+	}
+	torrents, err := c.Status(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 || torrents[0].Status != "downloading" || torrents[0].DownloadDir != "/downloads/films" {
+		t.Fatalf("Status() = %+v", torrents)
+	}
+
+	err = c.Stop(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrents, _ = c.Status(hash)
+	if torrents[0].Status != "stopped" {
+		t.Errorf("status after Stop() = %q, want stopped", torrents[0].Status)
+	}
+	// Adding a torrent qBittorrent already has starts it.
+	info, err = c.Add(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrents, _ = c.Status(hash)
+	if info.Hash != hash || torrents[0].Status != "downloading" {
+		t.Errorf("Add() of an existing torrent = %+v and status %q, want it started", info, torrents[0].Status)
+	}
+
+	files, err := c.Files(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].BytesCompleted != 1<<19 {
+		t.Errorf("Files() = %+v", files)
+	}
+	_, err = c.Files("missing")
+	if err != errTorrentNotFound {
+		t.Errorf("Files(missing) error = %v, want %v", err, errTorrentNotFound)
+	}
+
+	settings, err := c.Settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.DownloadDir != "/downloads" || !settings.SeedRatioLimited || settings.SeedRatioLimit != 2 {
+		t.Errorf("Settings() = %+v", settings)
+	}
+
+	err = c.Remove(hash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fake.deleted[hash] {
+		t.Error("Remove() did not ask to delete files")
+	}
+	err = c.Remove(hash, true)
+	if err != errTorrentNotFound {
+		t.Errorf("second Remove() error = %v, want %v", err, errTorrentNotFound)
+	}
+	if fake.logins != 1 {
+		t.Errorf("logged in %d times, want 1", fake.logins)
+	}
+}
+
+func TestQBittorrentClientLegacyEndpointsAndRelogin(t *testing.T) {
+	fake, server := newFakeQBittorrent(t)
+	fake.legacy = true
+	c, err := newQBittorrentClient(&InstanceConfig{URL: server.URL, User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName, hash := writeTestTorrent(t, "abc")
+	_, err = c.Add(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an expired session.
+	c.http.Jar, _ = cookiejar.New(nil)
+	err = c.Stop(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.torrents[hash].State != "pausedDL" {
+		t.Errorf("state after Stop() = %q, want pausedDL", fake.torrents[hash].State)
+	}
+	if fake.logins != 2 {
+		t.Errorf("logged in %d times, want 2", fake.logins)
+	}
+}
+
+func TestQBittorrentClientLoginFailure(t *testing.T) {
+	_, server := newFakeQBittorrent(t)
+	c, err := newQBittorrentClient(&InstanceConfig{URL: server.URL, User: "admin", Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Status()
+	if err == nil {
+		t.Fatal("Status() succeeded with wrong credentials")
+	}
+}
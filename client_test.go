@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+// newTestTorrent returns a minimal single-file .torrent and its info hash.
+func newTestTorrent(t *testing.T, name string) ([]byte, string) {
+	t.Helper()
+	info, err := bencode.EncodeBytes(map[string]interface{}{
+		"name":         name,
+		"length":       1 << 20,
+		"piece length": 1 << 18,
+		"pieces":       string(make([]byte, 4*sha1.Size)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := bencode.EncodeBytes(map[string]interface{}{
+		"announce": "http://bt.example.org/ann",
+		"info":     bencode.RawMessage(info),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum(info)
+	return body, hex.EncodeToString(hash[:])
+}
+
+// writeTestTorrent writes a minimal single-file .torrent into a temporary
+// directory and returns its path and info hash.
+func writeTestTorrent(t *testing.T, name string) (string, string) {
+	t.Helper()
+	body, hash := newTestTorrent(t, name)
+	fileName := filepath.Join(t.TempDir(), name+".torrent")
+	err := ioutil.WriteFile(fileName, body, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName, hash
+}
+
+func TestInstanceClientsAreShared(t *testing.T) {
+	for _, clientType := range []string{"transmission", "qbittorrent", "deluge"} {
+		// Nothing listens there.
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		instance := &InstanceConfig{Name: clientType, Type: clientType, URL: server.URL}
+		first, err := instance.client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := instance.client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second {
+			t.Errorf("%s client made twice", clientType)
+		}
+		if clientType == "transmission" {
+			continue
+		}
+		for i := 0; i < breakerThreshold; i++ {
+			first.Status()
+		}
+		_, err = first.Status()
+		if !errors.Is(err, errClientUnreachable) || !strings.Contains(err.Error(), "is down") {
+			t.Errorf("%s client called while down: %v", clientType, err)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+var transmissionTorrentFields = []string{
+	"id", "hashString", "name", "status", "percentDone", "downloadDir", "totalSize",
+	"uploadRatio", "secondsSeeding", "activityDate", "haveValid", "sizeWhenDone",
+	"rateDownload", "rateUpload", "eta", "peersConnected", "peersSendingToUs",
+	"uploadedEver", "addedDate", "errorString", "trackerStats",
+}
+
+// transmissionClient is a long-lived client of a Transmission daemon, shared
+// by every caller. The RPC library renegotiates the session id by itself
+// when the daemon restarts; when the daemon cannot be reached, the
+// connection is dropped and made again on the next call.
+type transmissionClient struct {
+	instance *InstanceConfig
+	breaker  *circuitBreaker
+
+	mu  sync.Mutex
+	rpc *transmissionrpc.Client
+}
+
+func newTransmissionClient(instance *InstanceConfig) (*transmissionClient, error) {
+	c := &transmissionClient{
+		instance: instance,
+		breaker:  newCircuitBreaker(instance.Name),
+	}
+	_, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial makes the RPC client of the daemon. The caller must hold c.mu,
+// except in the constructor.
+func (c *transmissionClient) dial() (*transmissionrpc.Client, error) {
+	conf := &transmissionrpc.AdvancedConfig{
+		HTTPS:       c.instance.HTTPS,
+		Port:        c.instance.Port,
+		RPCURI:      c.instance.RPCURI,
+		HTTPTimeout: TRANSMISSION_TIMEOUT,
+	}
+	rpc, err := transmissionrpc.New(c.instance.Host, c.instance.User, c.instance.Password, conf)
+	if err != nil {
+		return nil, err
+	}
+	c.rpc = rpc
+	return rpc, nil
+}
+
+// connect returns the RPC client for a call, failing right away while the
+// daemon is considered down.
+func (c *transmissionClient) connect() (*transmissionrpc.Client, error) {
+	err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rpc != nil {
+		return c.rpc, nil
+	}
+	return c.dial()
+}
+
+// release records the outcome of a call made with rpc, dropping the
+// connection if the daemon could not be reached.
+func (c *transmissionClient) release(rpc *transmissionrpc.Client, err *error) {
+	if !c.breaker.record(*err) {
+		return
+	}
+	c.mu.Lock()
+	if c.rpc == rpc {
+		c.rpc = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *transmissionClient) Add(fileName string, downloadDir string) (_ *TorrentInfo, err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(rpc, &err)
+	var torrent *transmissionrpc.Torrent
+	if downloadDir != "" {
+		torrent, err = rpc.TorrentAddFileDownloadDir(fileName, downloadDir)
+	} else {
+		torrent, err = rpc.TorrentAddFile(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = rpc.TorrentStartIDs([]int64{*torrent.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &TorrentInfo{
+		Hash: *torrent.HashString,
+		Name: *torrent.Name,
+	}, nil
+}
+
+func (c *transmissionClient) Start(hashes ...string) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	return rpc.TorrentStartHashes(hashes)
+}
+
+func (c *transmissionClient) Stop(hashes ...string) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	return rpc.TorrentStopHashes(hashes)
+}
+
+func (c *transmissionClient) Remove(hash string, deleteData bool) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	torrents, err := rpc.TorrentGetHashes([]string{"id"}, []string{hash})
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return errTorrentNotFound
+	}
+	return rpc.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
+		IDs:             []int64{*torrents[0].ID},
+		DeleteLocalData: deleteData,
+	})
+}
+
+func (c *transmissionClient) Status(hashes ...string) (_ []*TorrentInfo, err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(rpc, &err)
+	var torrents []*transmissionrpc.Torrent
+	if len(hashes) == 0 {
+		torrents, err = rpc.TorrentGet(transmissionTorrentFields, nil)
+	} else {
+		torrents, err = rpc.TorrentGetHashes(transmissionTorrentFields, hashes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []*TorrentInfo
+	for _, torrent := range torrents {
+		info := &TorrentInfo{}
+		if torrent.HashString != nil {
+			info.Hash = *torrent.HashString
+		}
+		if torrent.Name != nil {
+			info.Name = *torrent.Name
+		}
+		if torrent.Status != nil {
+			info.Status = torrent.Status.String()
+		}
+		if torrent.PercentDone != nil {
+			info.PercentDone = *torrent.PercentDone
+		}
+		if torrent.DownloadDir != nil {
+			info.DownloadDir = *torrent.DownloadDir
+		}
+		if torrent.TotalSize != nil {
+			info.TotalSize = int64(torrent.TotalSize.Byte())
+		}
+		if torrent.UploadRatio != nil {
+			info.Ratio = *torrent.UploadRatio
+		}
+		if torrent.SecondsSeeding != nil {
+			info.SeedingTime = *torrent.SecondsSeeding
+		}
+		if torrent.ActivityDate != nil && torrent.ActivityDate.Unix() > 0 {
+			info.LastActivity = *torrent.ActivityDate
+		}
+		if torrent.HaveValid != nil {
+			info.DoneSize = *torrent.HaveValid
+		}
+		if torrent.SizeWhenDone != nil {
+			info.SizeWhenDone = int64(torrent.SizeWhenDone.Byte())
+		}
+		if torrent.RateDownload != nil {
+			info.DownloadRate = *torrent.RateDownload
+		}
+		if torrent.RateUpload != nil {
+			info.UploadRate = *torrent.RateUpload
+		}
+		// Transmission reports -1 when the ETA is not available and -2
+		// when it is unknown.
+		info.ETA = -1
+		if torrent.Eta != nil && *torrent.Eta >= 0 {
+			info.ETA = time.Duration(*torrent.Eta) * time.Second
+		}
+		if torrent.PeersConnected != nil {
+			info.PeersConnected = int(*torrent.PeersConnected)
+		}
+		if torrent.PeersSendingToUs != nil {
+			info.SeedsConnected = int(*torrent.PeersSendingToUs)
+		}
+		if torrent.UploadedEver != nil {
+			info.Uploaded = *torrent.UploadedEver
+		}
+		if torrent.AddedDate != nil {
+			info.AddedAt = *torrent.AddedDate
+		}
+		if torrent.ErrorString != nil {
+			info.Error = *torrent.ErrorString
+		}
+		var announced, failed int
+		for _, tracker := range torrent.TrackerStats {
+			if !tracker.HasAnnounced {
+				continue
+			}
+			announced++
+			if tracker.LastAnnounceSucceeded {
+				continue
+			}
+			failed++
+			if info.TrackerError == "" && tracker.LastAnnounceResult != "" {
+				info.TrackerError = tracker.Host + ": " + tracker.LastAnnounceResult
+			}
+		}
+		info.TrackersFailing = announced > 0 && failed == announced
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// SetSeedLimits sets the torrent's own seedRatioLimit and seedIdleLimit, so
+// that Transmission stops seeding it without waiting for the reaper.
+func (c *transmissionClient) SetSeedLimits(hash string, ratio float64, idle time.Duration) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	torrents, err := rpc.TorrentGetHashes([]string{"id"}, []string{hash})
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return errTorrentNotFound
+	}
+	// Modes: 0 follows the global setting, 1 uses the torrent's limit.
+	ratioMode := transmissionrpc.SeedRatioModeGlobal
+	idleMode := int64(0)
+	payload := &transmissionrpc.TorrentSetPayload{
+		IDs:           []int64{*torrents[0].ID},
+		SeedRatioMode: &ratioMode,
+		SeedIdleMode:  &idleMode,
+	}
+	if ratio > 0 {
+		ratioMode = transmissionrpc.SeedRatioModeCustom
+		payload.SeedRatioLimit = &ratio
+	}
+	if idle > 0 {
+		idleMode = 1
+		// The library sends this duration as a number of minutes.
+		payload.SeedIdleLimit = &idle
+	}
+	return rpc.TorrentSet(payload)
+}
+
+func (c *transmissionClient) Reannounce(hash string) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	return rpc.TorrentReannounceHashes([]string{hash})
+}
+
+func (c *transmissionClient) Verify(hash string) (err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.release(rpc, &err)
+	return rpc.TorrentVerifyHashes([]string{hash})
+}
+
+func (c *transmissionClient) Details(hash string) (_ *TorrentDetails, err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(rpc, &err)
+	torrents, err := rpc.TorrentGetHashes([]string{"trackerStats", "peers"}, []string{hash})
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) == 0 {
+		return nil, errTorrentNotFound
+	}
+	details := &TorrentDetails{}
+	for _, tracker := range torrents[0].TrackerStats {
+		details.Trackers = append(details.Trackers, &TrackerInfo{
+			Host:         tracker.Host,
+			Tier:         int(tracker.Tier),
+			Seeders:      int(tracker.SeederCount),
+			Leechers:     int(tracker.LeecherCount),
+			Downloads:    int(tracker.DownloadCount),
+			LastAnnounce: tracker.LastAnnounceTime,
+			LastResult:   tracker.LastAnnounceResult,
+			Succeeded:    tracker.LastAnnounceSucceeded,
+		})
+	}
+	for _, peer := range torrents[0].Peers {
+		details.Peers = append(details.Peers, &PeerInfo{
+			Address:      peer.Address,
+			Client:       peer.ClientName,
+			Progress:     peer.Progress,
+			DownloadRate: peer.RateToClient,
+			UploadRate:   peer.RateToPeer,
+			Encrypted:    peer.IsEncrypted,
+		})
+	}
+	return details, nil
+}
+
+func (c *transmissionClient) Files(hash string) (_ []*TorrentFileInfo, err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(rpc, &err)
+	torrents, err := rpc.TorrentGetHashes([]string{"files"}, []string{hash})
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) == 0 {
+		return nil, errTorrentNotFound
+	}
+	var files []*TorrentFileInfo
+	for _, file := range torrents[0].Files {
+		files = append(files, &TorrentFileInfo{
+			Name:           file.Name,
+			Length:         file.Length,
+			BytesCompleted: file.BytesCompleted,
+		})
+	}
+	return files, nil
+}
+
+func (c *transmissionClient) Settings() (_ *ClientSettings, err error) {
+	rpc, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(rpc, &err)
+	session, err := rpc.SessionArgumentsGet()
+	if err != nil {
+		return nil, err
+	}
+	settings := &ClientSettings{}
+	if session.DownloadDir != nil {
+		settings.DownloadDir = *session.DownloadDir
+	}
+	if session.SeedRatioLimit != nil {
+		settings.SeedRatioLimit = *session.SeedRatioLimit
+	}
+	if session.SeedRatioLimited != nil {
+		settings.SeedRatioLimited = *session.SeedRatioLimited
+	}
+	if session.SpeedLimitDownEnabled != nil && *session.SpeedLimitDownEnabled && session.SpeedLimitDown != nil {
+		settings.DownloadLimit = *session.SpeedLimitDown * 1000
+	}
+	if session.SpeedLimitUpEnabled != nil && *session.SpeedLimitUpEnabled && session.SpeedLimitUp != nil {
+		settings.UploadLimit = *session.SpeedLimitUp * 1000
+	}
+	return settings, nil
+}
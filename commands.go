@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Telegram rejects messages longer than 4096 characters.
+const maxMessageLength = 4000
+
+// truncateMessage shortens a text to maxMessageLength bytes, cutting after
+// its last whole line, or at least between characters, which may be
+// several bytes long.
+func truncateMessage(text string) string {
+	if len(text) <= maxMessageLength {
+		return text
+	}
+	cut := maxMessageLength
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if i := strings.LastIndex(text[:cut], "\n"); i > 0 {
+		cut = i
+	}
+	return text[:cut] + "\n…"
+}
+
+// handleCommand answers a command in the thread it was sent to.
+func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, threadID int) {
+	var text string
+	p := userPrinter(message.From)
+	if destructiveCommands[message.Command()] {
+		err := authorizeChatAdmin(bot, p, message.Chat, message.From)
+		if err != nil {
+			replyCommand(bot, message, threadID, describeError(p, message.Command(), err))
+			return
+		}
+	}
+	switch message.Command() {
+	case "list":
+		text = getTorrentListMessage(p, message.From)
+	case "watch":
+		text = addWatch(p, message.Chat.ID, message.From, message.CommandArguments())
+	case "watches":
+		text = getWatchListMessage(p, message.Chat.ID)
+	case "unwatch":
+		text = removeWatch(p, message.Chat.ID, message.CommandArguments())
+	case "seed":
+		text = setSeedPolicy(p, message.Chat.ID, message.CommandArguments())
+	case "default":
+		text = setChatDefault(p, message.Chat.ID, message.CommandArguments())
+	case "quality":
+		if message.From == nil {
+			return
+		}
+		text = setQuality(p, message.From, strings.TrimSpace(message.CommandArguments()))
+	case "language":
+		if message.From == nil {
+			return
+		}
+		text = setLanguage(message.From, strings.TrimSpace(message.CommandArguments()))
+	default:
+		return
+	}
+	replyCommand(bot, message, threadID, text)
+}
+
+func replyCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, threadID int, text string) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, truncateMessage(text))
+	_, err := sendMessage(bot, msg, threadID)
+	if err != nil {
+		log.Println(err)
+	}
+}
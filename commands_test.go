@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateMessage(t *testing.T) {
+	if got := truncateMessage("Дюна"); got != "Дюна" {
+		t.Errorf("short text truncated into %q", got)
+	}
+	// Two-byte letters, the limit falling in the middle of one.
+	long := strings.Repeat("ю", maxMessageLength)
+	got := truncateMessage("a" + long)
+	if !utf8.ValidString(got) || len(got) > maxMessageLength+len("\n…") {
+		t.Errorf("truncated into %d bytes, valid %v", len(got), utf8.ValidString(got))
+	}
+	lines := strings.Repeat("Основание 1080p\n", maxMessageLength/10)
+	got = truncateMessage(lines)
+	if !strings.HasSuffix(got, "Основание 1080p\n…") {
+		t.Errorf("truncated within a line: %q", got[len(got)-40:])
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// CONFIG_FILE points to an optional JSON file holding the settings that do
+// not fit into plain environment variables.
+var CONFIG_FILE string
+
+var config = &Config{}
+
+type Config struct {
+	Instances []*InstanceConfig `json:"instances"`
+	Routes    []*RouteConfig    `json:"routes"`
+	// Admins are the Telegram user IDs administering the bot. They are
+	// notified about torrents that were not added through the bot.
+	Admins []int64 `json:"admins"`
+	// SeedPolicy applies to every torrent unless a destination or the
+	// torrent itself has its own policy.
+	SeedPolicy          *SeedPolicy          `json:"seed_policy"`
+	DestinationPolicies []*DestinationPolicy `json:"destination_policies"`
+	// ReapUnowned lets the policies remove the torrents that were not added
+	// through the bot. Without it they are only stopped.
+	ReapUnowned bool           `json:"reap_unowned"`
+	Monitor     *MonitorConfig `json:"monitor"`
+	// Quota applies to every user but the admins, unless UserQuotas has
+	// one for the user.
+	Quota      *Quota           `json:"quota"`
+	UserQuotas map[int64]*Quota `json:"user_quotas"`
+	// QualityProfiles add to or override the built-in quality profiles, by
+	// name, and DefaultQuality is the profile of the users who did not
+	// choose one, the tracker order if empty.
+	QualityProfiles map[string]*QualityProfile `json:"quality_profiles"`
+	DefaultQuality  string                     `json:"default_quality"`
+	// Templates override the built-in message templates, by name.
+	Templates map[string]string `json:"templates"`
+}
+
+// MonitorConfig tunes the detection of stalled and failing torrents. A
+// download stalls after StallTime without progress, 24h by default. With
+// AutoRetry, problems are first remedied by reannouncing or verifying the
+// torrent, and with Refetch by downloading its .torrent again.
+type MonitorConfig struct {
+	StallTime Duration `json:"stall_time"`
+	AutoRetry bool     `json:"auto_retry"`
+	Refetch   bool     `json:"refetch"`
+}
+
+// Duration is a time.Duration read from a Go duration string like "72h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// SeedPolicy tells when to stop seeding a completed torrent: once it reaches
+// Ratio, has been seeding for SeedTime or has been idle for IdleTime,
+// whichever comes first. Zero values disable a condition. Action is one of
+// "stop" (the default), "remove" which keeps the data, or "remove-data".
+type SeedPolicy struct {
+	Ratio    float64  `json:"ratio"`
+	SeedTime Duration `json:"seed_time"`
+	IdleTime Duration `json:"idle_time"`
+	Action   string   `json:"action"`
+}
+
+// DestinationPolicy overrides the global seed policy for the torrents of an
+// instance, or of a download directory (and its subdirectories) on it.
+type DestinationPolicy struct {
+	Instance    string `json:"instance"`
+	DownloadDir string `json:"download_dir"`
+	SeedPolicy
+}
+
+// InstanceConfig describes a named torrent client. Type is one of
+// "transmission" (the default), "qbittorrent" or "deluge"; the latter two
+// are reached at URL, or at Host and Port when URL is empty.
+type InstanceConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	Host        string `json:"host"`
+	Port        uint16 `json:"port"`
+	HTTPS       bool   `json:"https"`
+	RPCURI      string `json:"rpc_uri"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	DownloadDir string `json:"download_dir"`
+}
+
+// RouteConfig sends torrents matching all of its non-empty conditions to an
+// instance. Routes are evaluated in order and the first match wins.
+type RouteConfig struct {
+	Instance    string `json:"instance"`
+	Forum       string `json:"forum"`
+	MinSize     string `json:"min_size"`
+	MaxSize     string `json:"max_size"`
+	DownloadDir string `json:"download_dir"`
+}
+
+func loadConfig(fileName string) (*Config, error) {
+	var cfg Config
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
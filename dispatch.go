@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// duplicateAddWindow is how long a torrent added from a chat is not added
+// again from the same chat, e.g. when Download is pressed twice.
+const duplicateAddWindow = time.Minute
+
+// updateKey returns the key of the updates that must be handled in order:
+// the chat they come from, or the user for inline mode.
+func updateKey(update *incomingUpdate) int64 {
+	switch {
+	case update.Message != nil && update.Message.Chat != nil:
+		return update.Message.Chat.ID
+	case update.CallbackQuery != nil:
+		cq := update.CallbackQuery
+		if cq.Message != nil && cq.Message.Chat != nil {
+			return cq.Message.Chat.ID
+		}
+		if cq.From != nil {
+			return int64(cq.From.ID)
+		}
+	case update.InlineQuery != nil && update.InlineQuery.From != nil:
+		return int64(update.InlineQuery.From.ID)
+	}
+	return 0
+}
+
+// dispatch hands the updates over to workers by key, so that the updates
+// of a chat are handled one at a time and in order while different chats
+// are handled in parallel. It returns once the updates are all handled.
+func dispatch(bot *tgbotapi.BotAPI, updates <-chan *incomingUpdate, workers int) {
+	var wg sync.WaitGroup
+	queues := make([]chan *incomingUpdate, workers)
+	for i := range queues {
+		queues[i] = make(chan *incomingUpdate, bot.Buffer)
+		wg.Add(1)
+		go func(queue chan *incomingUpdate) {
+			defer wg.Done()
+			process(bot, queue)
+		}(queues[i])
+	}
+	for update := range updates {
+		queues[uint64(updateKey(update))%uint64(workers)] <- update
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// torrentLocks serialize the additions and removals of a torrent, which
+// may come from several chats at once.
+var torrentLocks = struct {
+	sync.Mutex
+	m map[string]*torrentLock
+}{m: make(map[string]*torrentLock)}
+
+type torrentLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockTorrent locks a torrent by info hash and returns the function that
+// unlocks it.
+func lockTorrent(hash string) func() {
+	torrentLocks.Lock()
+	lock, ok := torrentLocks.m[hash]
+	if !ok {
+		lock = &torrentLock{}
+		torrentLocks.m[hash] = lock
+	}
+	lock.refs++
+	torrentLocks.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		torrentLocks.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(torrentLocks.m, hash)
+		}
+		torrentLocks.Unlock()
+	}
+}
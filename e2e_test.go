@@ -0,0 +1,985 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// redirectTransport sends every request to a test server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	req.Host = ""
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testBot runs the bot against fake Telegram, tracker and Transmission
+// servers, in a temporary working directory.
+type testBot struct {
+	t            *testing.T
+	telegram     *fakeTelegram
+	tracker      *fakeTracker
+	transmission *fakeTransmission
+	bot          *tgbotapi.BotAPI
+	user         *tgbotapi.User
+	nextID       int
+}
+
+func newTestBot(t *testing.T) *testBot {
+	tb := &testBot{
+		t:    t,
+		user: &tgbotapi.User{ID: 42, FirstName: "Test", UserName: "tester", LanguageCode: "en"},
+	}
+	var err error
+	telegram, telegramServer := newFakeTelegram(t, "test-token")
+	tracker, trackerServer := newFakeTracker(t, "test-session")
+	transmission, transmissionServer := newFakeTransmission(t)
+	tb.telegram, tb.tracker, tb.transmission = telegram, tracker, transmission
+
+	savedMirrors, savedClient, savedSearches, savedSession, savedConfig, savedInstances, savedState := forumMirrors, forumClient, searches, BB_SESSION, config, instances, state
+	t.Cleanup(func() {
+		forumMirrors, forumClient, searches, BB_SESSION, config, instances, state = savedMirrors, savedClient, savedSearches, savedSession, savedConfig, savedInstances, savedState
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	err = os.Mkdir("torrents", os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	BB_SESSION = "test-session"
+	forumMirrors = newMirrorSet([]string{trackerServer.URL + "/forum"})
+	searches = newSearchCache(searchCacheSize, SEARCH_CACHE_TTL)
+	forumClient, err = newTrackerClient([]string{trackerServer.URL + "/forum"}, BB_SESSION, filepath.Join(dir, "cookies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transmissionURL, err := url.Parse(transmissionServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(transmissionURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = &Config{Instances: []*InstanceConfig{{
+		Name: "home",
+		Host: transmissionURL.Hostname(),
+		Port: uint16(port),
+	}}}
+	err = setupInstances(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	telegramURL, err := url.Parse(telegramServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.bot, err = tgbotapi.NewBotAPIWithClient("test-token", &http.Client{
+		Transport: &redirectTransport{target: telegramURL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+	go func() {
+		dispatch(tb.bot, receiveUpdates(tb.bot, 0, stop), 4)
+		close(stopped)
+	}()
+	return tb
+}
+
+// firstLine returns the status line of a status card.
+func firstLine(text string) string {
+	return strings.SplitN(text, "\n", 2)[0]
+}
+
+func (tb *testBot) id() string {
+	tb.nextID++
+	return strconv.Itoa(tb.nextID)
+}
+
+// search sends an inline query and returns the results of its answer.
+func (tb *testBot) search(query string) []tgbotapi.InlineQueryResultArticle {
+	tb.t.Helper()
+	id := tb.id()
+	tb.telegram.push(tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{
+		ID:    id,
+		From:  tb.user,
+		Query: query,
+	}})
+	call := tb.telegram.waitFor(tb.t, "answerInlineQuery", func(params url.Values) bool {
+		return params.Get("inline_query_id") == id
+	})
+	var results []tgbotapi.InlineQueryResultArticle
+	err := json.Unmarshal([]byte(call.Params.Get("results")), &results)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	return results
+}
+
+// pressInline presses a button of a message sent via inline mode, and waits
+// for the callback query to be answered.
+func (tb *testBot) pressInline(data string) fakeTelegramCall {
+	tb.t.Helper()
+	id := tb.id()
+	tb.telegram.push(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:              id,
+		From:            tb.user,
+		InlineMessageID: "inline-" + id,
+		Data:            data,
+	}})
+	return tb.telegram.waitForAnswer(tb.t, id)
+}
+
+// press presses the button labelled text of a message sent by the bot, and
+// waits for the callback query to be answered.
+func (tb *testBot) press(messageID int, text string) fakeTelegramCall {
+	tb.t.Helper()
+	message := tb.telegram.message(messageID)
+	if message == nil {
+		tb.t.Fatalf("no message %d", messageID)
+	}
+	data := message.button(text)
+	if data == "" {
+		tb.t.Fatalf("no %q button on message %q", text, message.Text)
+	}
+	id := tb.id()
+	chatType := "private"
+	if message.ChatID < 0 {
+		chatType = "supergroup"
+	}
+	tb.telegram.push(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   id,
+		From: tb.user,
+		Message: &tgbotapi.Message{
+			MessageID: messageID,
+			Chat:      &tgbotapi.Chat{ID: message.ChatID, Type: chatType},
+			Text:      message.Text,
+		},
+		Data: data,
+	}})
+	return tb.telegram.waitForAnswer(tb.t, id)
+}
+
+func TestSearchDownloadPauseRemove(t *testing.T) {
+	tb := newTestBot(t)
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+
+	results := tb.search("Dune")
+	if len(results) != 3 || !strings.HasPrefix(results[0].Title, "Дюна / Dune") {
+		t.Fatalf("search results = %+v", results)
+	}
+	download := results[0].ReplyMarkup.InlineKeyboard[0][0]
+	if download.Text != "Download" || download.CallbackData == nil {
+		t.Fatalf("first button = %+v", download)
+	}
+
+	tb.pressInline(*download.CallbackData)
+	sent := tb.telegram.waitFor(t, "sendMessage", nil)
+	if sent.Params.Get("chat_id") != "42" {
+		t.Errorf("status card sent to chat %s", sent.Params.Get("chat_id"))
+	}
+	card := 1
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: downloading (0.0%)" {
+		t.Errorf("status card = %q", text)
+	}
+	torrent := tb.transmission.torrent(hash)
+	if torrent == nil || torrent.Status != fakeTransmissionDownloading {
+		t.Fatalf("torrent after Download = %+v", torrent)
+	}
+
+	tb.press(card, "Pause")
+	if torrent := tb.transmission.torrent(hash); torrent.Status != fakeTransmissionStopped {
+		t.Errorf("torrent status after Pause = %d", torrent.Status)
+	}
+	tb.telegram.waitFor(t, "editMessageText", func(params url.Values) bool {
+		return strings.HasSuffix(firstLine(params.Get("text")), ": stopped (0.0%)")
+	})
+
+	tb.press(card, "Remove")
+	if text := tb.telegram.message(card).Text; !strings.HasPrefix(text, "Are you sure") {
+		t.Errorf("confirmation = %q", text)
+	}
+	if tb.transmission.torrent(hash) == nil {
+		t.Fatal("torrent removed before confirmation")
+	}
+
+	tb.press(card, "Yes")
+	if tb.transmission.torrent(hash) != nil {
+		t.Error("torrent not removed")
+	}
+	if !tb.transmission.removedWithData(hash) {
+		t.Error("torrent data not deleted")
+	}
+	tb.telegram.waitFor(t, "editMessageText", func(params url.Values) bool {
+		return params.Get("text") == "Dune.2021.2160p.WEB-DL: removed"
+	})
+	if tb.telegram.message(card).button("Restart") == "" {
+		t.Error("no Restart button on the removed torrent")
+	}
+}
+
+func TestErrorsAreReported(t *testing.T) {
+	tb := newTestBot(t)
+	tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	card := 1
+	if tb.telegram.message(card) == nil {
+		t.Fatal("no status card")
+	}
+
+	tb.transmission.setDown(true)
+	answer := tb.press(card, "Pause")
+	text := answer.Params.Get("text")
+	if answer.Params.Get("show_alert") != "true" || !strings.HasPrefix(text, "Torrent client unreachable (error ") {
+		t.Errorf("answer = %v", answer.Params)
+	}
+	message := tb.telegram.message(card)
+	if !strings.HasPrefix(message.Text, "Dune.2021.2160p.WEB-DL: downloading (0.0%)\n") ||
+		!strings.HasSuffix(message.Text, "\nFailed: "+text) {
+		t.Errorf("status card = %q", message.Text)
+	}
+
+	tb.transmission.setDown(false)
+	answer = tb.press(card, "Retry")
+	if answer.Params.Get("show_alert") == "true" {
+		t.Errorf("retry answer = %v", answer.Params)
+	}
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: stopped (0.0%)" || strings.Contains(text, "Failed") {
+		t.Errorf("status card after retry = %q", text)
+	}
+
+	tb.tracker.setSession("expired")
+	id := tb.id()
+	tb.telegram.push(tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: id, From: tb.user, Query: "Dune"}})
+	call := tb.telegram.waitFor(t, "answerInlineQuery", func(params url.Values) bool {
+		return params.Get("inline_query_id") == id
+	})
+	if text := call.Params.Get("switch_pm_text"); !strings.HasPrefix(text, "Tracker login expired (error ") {
+		t.Errorf("switch_pm_text = %q", text)
+	}
+}
+
+func TestRussianUser(t *testing.T) {
+	tb := newTestBot(t)
+	tb.user.LanguageCode = "ru"
+	tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+
+	results := tb.search("Dune")
+	if len(results) == 0 {
+		t.Fatal("no search results")
+	}
+	download := results[0].ReplyMarkup.InlineKeyboard[0][0]
+	if download.Text != "Скачать" {
+		t.Errorf("first button = %q", download.Text)
+	}
+	answer := tb.pressInline(*download.CallbackData)
+	if text := answer.Params.Get("text"); text != "Загрузка начата: Dune.2021.2160p.WEB-DL" {
+		t.Errorf("answer = %q", text)
+	}
+	card := 1
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: загружается (0,0%)" {
+		t.Errorf("status card = %q", text)
+	}
+
+	tb.telegram.push(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: 100,
+		From:      tb.user,
+		Chat:      &tgbotapi.Chat{ID: int64(tb.user.ID), Type: "private"},
+		Text:      "/language en",
+		Entities:  &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/language")}},
+	}})
+	tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+		return params.Get("text") == "Language: English"
+	})
+	// The card still has the buttons sent in Russian.
+	tb.press(card, "Пауза")
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: stopped (0.0%)" {
+		t.Errorf("status card after /language en = %q", text)
+	}
+	if tb.telegram.message(card).button("Pause") == "" {
+		t.Error("no Pause button after /language en")
+	}
+}
+
+func TestStatusCardDetails(t *testing.T) {
+	tb := newTestBot(t)
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	card := 1
+	tb.transmission.update(hash, func(torrent *fakeTransmissionTorrent) {
+		torrent.PercentDone = 0.25
+		torrent.HaveValid = 1 << 30
+		torrent.SizeWhenDone = 4 << 30
+		torrent.RateDownload = 2 << 20
+		torrent.RateUpload = 512 << 10
+		torrent.Eta = 3720
+		torrent.PeersConnected = 3
+		torrent.PeersSending = 2
+		torrent.UploadRatio = 0.5
+		torrent.UploadedEver = 512 << 20
+		torrent.ErrorString = "Tracker gave HTTP response code 503"
+		torrent.TrackerStats = []*fakeTransmissionTracker{{
+			Host: "bt.example.org", SeederCount: 40, LeecherCount: 3, DownloadCount: 900,
+			HasAnnounced: true, LastAnnounceResult: "Could not connect to tracker",
+		}, {
+			Host: "bt2.example.org", SeederCount: 12, LeecherCount: 1, DownloadCount: 100,
+			HasAnnounced: true, LastAnnounceSucceeded: true, LastAnnounceResult: "Success",
+		}}
+		torrent.Peers = []*fakeTransmissionPeer{
+			{Address: "10.0.0.1", ClientName: "qBittorrent 4.5.2", RateToClient: 1 << 20, IsEncrypted: true},
+			{Address: "10.0.0.2", ClientName: "Transmission 3.00", RateToClient: 1 << 20, RateToPeer: 512 << 10},
+			{Address: "10.0.0.3", ClientName: "qBittorrent 4.5.2"},
+		}
+	})
+
+	tb.press(card, "Refresh")
+	text := tb.telegram.message(card).Text
+	for _, line := range []string{
+		"Dune.2021.2160p.WEB-DL: downloading (25.0%)",
+		"█████░░░░░░░░░░░░░░░",
+		"Size: 1.00 GB of 4.00 GB",
+		"Speed: ↓ 2.00 MB/s ↑ 512.00 KB/s",
+		"ETA: 1h 2m",
+		"Peers: 3, seeds: 2",
+		"Ratio: 0.50, uploaded 512.00 MB",
+		"Error: Tracker gave HTTP response code 503",
+		"Tracker error: bt.example.org: Could not connect to tracker",
+	} {
+		if !strings.Contains(text, line+"\n") && !strings.HasSuffix(text, line) {
+			t.Errorf("status card has no %q line:\n%s", line, text)
+		}
+	}
+	if !strings.Contains(text, "\nAdded: ") {
+		t.Errorf("status card has no date added:\n%s", text)
+	}
+
+	tb.press(card, "Details")
+	want := strings.Join([]string{
+		"Dune.2021.2160p.WEB-DL",
+		"Trackers:",
+		"bt.example.org: 40 seeders, 3 leechers, 900 downloads",
+		"  Announce failed: Could not connect to tracker",
+		"bt2.example.org: 12 seeders, 1 leechers, 100 downloads",
+		"Peers: 3 connected, 2 downloading from, 1 uploading to, 1 encrypted",
+		"qBittorrent 4.5.2: 2",
+		"Transmission 3.00: 1",
+	}, "\n")
+	if text := tb.telegram.message(card).Text; text != want {
+		t.Errorf("details = %q, want %q", text, want)
+	}
+
+	tb.press(card, "Back")
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: downloading (25.0%)" {
+		t.Errorf("status card after Back = %q", text)
+	}
+}
+
+func TestStalledTorrentAlerts(t *testing.T) {
+	tb := newTestBot(t)
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	config.Monitor = &MonitorConfig{StallTime: Duration(time.Nanosecond)}
+
+	// The first check only records the progress of the torrent.
+	monitorTorrents(tb.bot)
+	monitorTorrents(tb.bot)
+	alert := 2
+	message := tb.telegram.message(alert)
+	if message == nil || message.Text != "Dune.2021.2160p.WEB-DL: no progress for 0s at 0.0%" {
+		t.Fatalf("stall alert = %+v", message)
+	}
+	monitorTorrents(tb.bot)
+	if tb.telegram.message(alert+1) != nil {
+		t.Error("stall reported twice")
+	}
+
+	tb.press(alert, "Reannounce")
+	if calls := tb.transmission.repairCalls(); len(calls) != 1 || calls[0] != "torrent-reannounce "+hash {
+		t.Errorf("repair calls = %v", calls)
+	}
+	if text := tb.telegram.message(alert).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: downloading (0.0%)" {
+		t.Errorf("alert after Reannounce = %q", text)
+	}
+
+	config.Monitor.AutoRetry = true
+	tb.transmission.update(hash, func(torrent *fakeTransmissionTorrent) {
+		torrent.Status = fakeTransmissionStopped
+		torrent.ErrorString = "No data found! Ensure your drives are connected"
+	})
+	monitorTorrents(tb.bot)
+	if calls := tb.transmission.repairCalls(); len(calls) != 2 || calls[1] != "torrent-verify "+hash {
+		t.Errorf("repair calls = %v", calls)
+	}
+	if tb.telegram.message(alert+1) != nil {
+		t.Error("error reported before retrying")
+	}
+	monitorTorrents(tb.bot)
+	want := "Dune.2021.2160p.WEB-DL: error: No data found! Ensure your drives are connected\nRetrying automatically did not help."
+	if message := tb.telegram.message(alert + 1); message == nil || message.Text != want {
+		t.Errorf("error alert = %+v, want %q", message, want)
+	}
+}
+
+func TestOwnershipAndQuotas(t *testing.T) {
+	tb := newTestBot(t)
+	config.Admins = []int64{1000}
+	config.Quota = &Quota{MaxActive: 1, MaxSize: "1 GB"}
+	tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.tracker.addTorrent(t, "6119872", "Dune.Part.Two.2024.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	card := 1
+
+	answer := tb.pressInline("init-6119872")
+	if text := answer.Params.Get("text"); answer.Params.Get("show_alert") != "true" || text != "Too many active downloads: 1 of 1 allowed" {
+		t.Errorf("answer over quota = %v", answer.Params)
+	}
+
+	owner := tb.user
+	tb.user = &tgbotapi.User{ID: 43, FirstName: "Other", LanguageCode: "en"}
+	answer = tb.press(card, "Pause")
+	if text := answer.Params.Get("text"); answer.Params.Get("show_alert") != "true" || text != "You can only manage your own torrents" {
+		t.Errorf("answer to another user = %v", answer.Params)
+	}
+	if text := tb.telegram.message(card).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: downloading (0.0%)" {
+		t.Errorf("status card after another user's press = %q", text)
+	}
+
+	list := func(user *tgbotapi.User) string {
+		tb.telegram.push(tgbotapi.Update{Message: &tgbotapi.Message{
+			MessageID: 100,
+			From:      user,
+			Chat:      &tgbotapi.Chat{ID: int64(user.ID), Type: "private"},
+			Text:      "/list",
+			Entities:  &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/list")}},
+		}})
+		call := tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+			return params.Get("chat_id") == strconv.Itoa(user.ID) && strings.HasPrefix(params.Get("text"), "[home]")
+		})
+		return call.Params.Get("text")
+	}
+	if text := list(tb.user); text != "[home]\nno torrents" {
+		t.Errorf("list of another user = %q", text)
+	}
+	if text := list(owner); text != "[home]\nDune.2021.2160p.WEB-DL: downloading (0.0%)" {
+		t.Errorf("list of the owner = %q", text)
+	}
+	if text := list(&tgbotapi.User{ID: 1000, FirstName: "Admin"}); text != "[home]\nDune.2021.2160p.WEB-DL: downloading (0.0%)" {
+		t.Errorf("list of an admin = %q", text)
+	}
+
+	tb.user = owner
+	tb.press(card, "Pause")
+	answer = tb.pressInline("init-6119872")
+	if answer.Params.Get("show_alert") == "true" {
+		t.Errorf("answer within quota = %v", answer.Params)
+	}
+}
+
+func TestGroupChat(t *testing.T) {
+	tb := newTestBot(t)
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	group := &tgbotapi.Chat{ID: -100, Type: "supergroup", Title: "Movies"}
+	thread := 7
+	send := func(text string) {
+		message := &tgbotapi.Message{MessageID: 100, From: tb.user, Chat: group, Text: text}
+		if strings.HasPrefix(text, "/") {
+			command := strings.Fields(text)[0]
+			message.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+		}
+		tb.telegram.pushInThread(tgbotapi.Update{Message: message}, thread)
+	}
+	reply := func(text string) fakeTelegramCall {
+		return tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+			return params.Get("chat_id") == "-100" && params.Get("text") == text
+		})
+	}
+
+	send("https://rutracker.org/forum/viewtopic.php?t=6119871")
+	send("/list@other_bot")
+	send("@test_bot https://rutracker.org/forum/viewtopic.php?t=6119871")
+	call := reply("Dune.2021.2160p.WEB-DL: ready to start")
+	if threadID := call.Params.Get("message_thread_id"); threadID != "7" {
+		t.Errorf("message_thread_id = %q", threadID)
+	}
+	ready := 1
+	if message := tb.telegram.message(ready); message == nil || message.Text != "Dune.2021.2160p.WEB-DL: ready to start" {
+		t.Fatalf("first reply = %+v, want the one to the mention", message)
+	}
+
+	send("/default home /downloads/movies")
+	reply("Only the admins of this chat can do this")
+	tb.telegram.setChatMember(tb.user.ID, "administrator")
+	send("/default home /downloads/movies")
+	reply("Default destination: home:/downloads/movies")
+
+	tb.press(ready, "Start")
+	if torrent := tb.transmission.torrent(hash); torrent == nil || torrent.DownloadDir != "/downloads/movies" {
+		t.Errorf("torrent = %+v, want it in the chat's default directory", torrent)
+	}
+
+	// The owner of the torrent needs to administer the chat to remove it,
+	// not to pause it.
+	tb.telegram.setChatMember(tb.user.ID, "member")
+	answer := tb.press(ready, "Remove")
+	if text := answer.Params.Get("text"); answer.Params.Get("show_alert") != "true" || text != "Only the admins of this chat can do this" {
+		t.Errorf("answer to a member = %v", answer.Params)
+	}
+	tb.press(ready, "Pause")
+	if text := tb.telegram.message(ready).Text; firstLine(text) != "Dune.2021.2160p.WEB-DL: stopped (0.0%)" {
+		t.Errorf("status card after a member's Pause = %q", text)
+	}
+
+	tb.user = &tgbotapi.User{ID: 43, FirstName: "Other", LanguageCode: "en"}
+	answer = tb.press(ready, "Start")
+	if text := answer.Params.Get("text"); answer.Params.Get("show_alert") != "true" || text != "You can only manage your own torrents" {
+		t.Errorf("answer to another member = %v", answer.Params)
+	}
+}
+
+func TestRepeatedPresses(t *testing.T) {
+	tb := newTestBot(t)
+	// Only admins may press the buttons of a torrent nobody owns anymore,
+	// like the removed one.
+	config.Admins = []int64{int64(tb.user.ID)}
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	pressTwice := func(update func(id string) tgbotapi.Update) [2]fakeTelegramCall {
+		ids := [2]string{tb.id(), tb.id()}
+		for _, id := range ids {
+			tb.telegram.push(update(id))
+		}
+		return [2]fakeTelegramCall{tb.telegram.waitForAnswer(t, ids[0]), tb.telegram.waitForAnswer(t, ids[1])}
+	}
+
+	answers := pressTwice(func(id string) tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID: id, From: tb.user, InlineMessageID: "inline-1", Data: "init-6119871",
+		}}
+	})
+	if text := answers[0].Params.Get("text"); text != "Started downloading torrent: Dune.2021.2160p.WEB-DL" {
+		t.Errorf("first answer = %q", text)
+	}
+	if text := answers[1].Params.Get("text"); text != "Already downloading torrent: Dune.2021.2160p.WEB-DL" {
+		t.Errorf("second answer = %q", text)
+	}
+	card := 1
+	if tb.telegram.message(card+1) != nil {
+		t.Error("status card sent twice")
+	}
+
+	tb.press(card, "Remove")
+	data := tb.telegram.message(card).button("Yes")
+	answers = pressTwice(func(id string) tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      id,
+			From:    tb.user,
+			Message: &tgbotapi.Message{MessageID: card, Chat: &tgbotapi.Chat{ID: int64(tb.user.ID), Type: "private"}},
+			Data:    data,
+		}}
+	})
+	for i, answer := range answers {
+		if text := answer.Params.Get("text"); answer.Params.Get("show_alert") == "true" || text != "Removed torrent: Dune.2021.2160p.WEB-DL" {
+			t.Errorf("answer %d = %v", i, answer.Params)
+		}
+	}
+	if tb.transmission.torrent(hash) != nil || !tb.transmission.removedWithData(hash) {
+		t.Error("torrent not removed with its data")
+	}
+
+	// The Download button of a regular message, like a watch
+	// notification, is guarded too and leaves the message as it is.
+	removed := tb.telegram.message(card).Text
+	answers = pressTwice(func(id string) tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      id,
+			From:    tb.user,
+			Message: &tgbotapi.Message{MessageID: card, Chat: &tgbotapi.Chat{ID: int64(tb.user.ID), Type: "private"}},
+			Data:    "init-6119871",
+		}}
+	})
+	if text := answers[0].Params.Get("text"); text != "Started downloading torrent: Dune.2021.2160p.WEB-DL" {
+		t.Errorf("first answer = %q", text)
+	}
+	if text := answers[1].Params.Get("text"); text != "Already downloading torrent: Dune.2021.2160p.WEB-DL" {
+		t.Errorf("second answer = %q", text)
+	}
+	if text := tb.telegram.message(card).Text; text != removed {
+		t.Errorf("pressed message edited into %q", text)
+	}
+	if tb.telegram.message(card+1) == nil || tb.telegram.message(card+2) != nil {
+		t.Error("status card not sent once")
+	}
+}
+
+func TestQualityProfile(t *testing.T) {
+	tb := newTestBot(t)
+	titles := func(results []tgbotapi.InlineQueryResultArticle) []string {
+		var titles []string
+		for _, result := range results {
+			titles = append(titles, strings.Fields(result.Title)[0])
+		}
+		return titles
+	}
+	if got := titles(tb.search("Dune")); strings.Join(got, " ") != "Дюна Основание Дюна" {
+		t.Errorf("results in tracker order = %v", got)
+	}
+
+	tb.telegram.push(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: 100,
+		From:      tb.user,
+		Chat:      &tgbotapi.Chat{ID: int64(tb.user.ID), Type: "private"},
+		Text:      "/quality 1080p",
+		Entities:  &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/quality")}},
+	}})
+	tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+		return params.Get("text") == "Search results are ranked by the 1080p quality profile."
+	})
+	// The 1080p release comes first, then the variants of Dune grouped
+	// together, the camera rip last.
+	results := tb.search("Dune")
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []string{"★ Основание", "Дюна / Dune", "↳ Дюна"} {
+		if !strings.HasPrefix(results[i].Title, want) {
+			t.Errorf("result %d = %q, want it to start with %q", i, results[i].Title, want)
+		}
+	}
+	if !strings.Contains(results[2].Title, "CAMRip") {
+		t.Errorf("last result = %q", results[2].Title)
+	}
+	if !strings.HasPrefix(results[0].Description, "S01E01-06/10 1080p WEB-DL MVO Original : ") {
+		t.Errorf("description = %q", results[0].Description)
+	}
+}
+
+// torznabTestItem is a Torznab result as clients read it, the attributes
+// being in the Torznab namespace.
+type torznabTestItem struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	PubDate string `xml:"pubDate"`
+	Size    int64  `xml:"size"`
+	Attrs   []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"http://torznab.com/schemas/2015/feed attr"`
+}
+
+func TestTorznab(t *testing.T) {
+	tb := newTestBot(t)
+	savedKey := TORZNAB_API_KEY
+	TORZNAB_API_KEY = "secret"
+	t.Cleanup(func() { TORZNAB_API_KEY = savedKey })
+	tb.tracker.addTorrent(t, "6120455", "Foundation.S01.1080p")
+	server := httptest.NewServer(newTorznabHandler())
+	t.Cleanup(server.Close)
+
+	get := func(query string) []byte {
+		t.Helper()
+		resp, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	var apiError torznabError
+	err := xml.Unmarshal(get("/api?t=caps"), &apiError)
+	if err != nil || apiError.Code != torznabBadCredentials {
+		t.Errorf("caps without the key = %+v, %v", apiError, err)
+	}
+	var caps torznabCaps
+	err = xml.Unmarshal(get("/api?t=caps&apikey=secret"), &caps)
+	if err != nil || caps.Searching.TVSearch.SupportedParams != "q,season,ep" || len(caps.Categories) == 0 {
+		t.Errorf("caps = %+v, %v", caps, err)
+	}
+
+	// The tracker finds the same topics for every query, which the
+	// categories and episodes filter.
+	search := func(query string) []torznabTestItem {
+		t.Helper()
+		var feed struct {
+			Items []torznabTestItem `xml:"channel>item"`
+		}
+		err := xml.Unmarshal(get(query), &feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return feed.Items
+	}
+	items := search("/api?t=tvsearch&q=Foundation&season=1&ep=3&cat=5040&apikey=secret")
+	if len(items) != 1 {
+		t.Fatalf("got %d TV results, want 1", len(items))
+	}
+	item := items[0]
+	if !strings.HasPrefix(item.Title, "Основание / Foundation") || item.Size == 0 || item.PubDate == "" {
+		t.Errorf("item = %+v", item)
+	}
+	attrs := make(map[string][]string)
+	for _, attr := range item.Attrs {
+		attrs[attr.Name] = append(attrs[attr.Name], attr.Value)
+	}
+	if strings.Join(attrs["category"], ",") != "5040,5000" || attrs["seeders"] == nil || attrs["peers"] == nil {
+		t.Errorf("attrs = %v", attrs)
+	}
+	if items := search("/api?t=tvsearch&q=Foundation&season=2&apikey=secret"); len(items) != 2 {
+		t.Errorf("season 2 results = %+v", items)
+	}
+	if items := search("/api?t=movie&q=Dune&cat=2000&apikey=secret"); len(items) != 2 {
+		t.Errorf("movie results = %+v", items)
+	}
+
+	link, err := url.Parse(item.Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := get(link.RequestURI())
+	want, err := ioutil.ReadFile(filepath.Join("torrents", "6120455.torrent"))
+	if err != nil || string(body) != string(want) {
+		t.Errorf("downloaded %d bytes, %v", len(body), err)
+	}
+}
+
+func TestFollowRemovedTorrent(t *testing.T) {
+	tb := newTestBot(t)
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	ref := torrentRef("6119871", "home")
+	err := state.update(func(s *State) {
+		s.Subscriptions[ref] = &Subscription{T: "6119871", Instance: "home", Hash: "0123456789abcdef", ChatIDs: []int64{int64(tb.user.ID)}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The topic has a new torrent but the followed one was removed: it is
+	// not downloaded again.
+	checkSubscriptions(tb.bot)
+	var followed bool
+	state.view(func(s *State) {
+		_, followed = s.Subscriptions[ref]
+	})
+	if followed {
+		t.Error("topic of a removed torrent still followed")
+	}
+	if tb.transmission.torrent(hash) != nil {
+		t.Error("torrent of the topic added again")
+	}
+}
+
+func TestWatchNotificationEscapesQuery(t *testing.T) {
+	tb := newTestBot(t)
+	err := state.update(func(s *State) {
+		s.Watches["1"] = &Watch{ID: "1", ChatID: int64(tb.user.ID), Query: "Dune & <Foundation>"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWatches(tb.bot)
+	tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+		return params.Get("parse_mode") == "HTML" && strings.HasPrefix(params.Get("text"), "New result for #1 Dune &amp; &lt;Foundation&gt;:\n")
+	})
+}
+
+func TestRouteByFetchedForum(t *testing.T) {
+	tb := newTestBot(t)
+	home := config.Instances[0]
+	config.Instances = append(config.Instances, &InstanceConfig{Name: "seedbox", Host: home.Host, Port: home.Port})
+	config.Routes = []*RouteConfig{
+		{Instance: "seedbox", Forum: "фильмы", DownloadDir: "/films"},
+		{Instance: "home"},
+	}
+	err := setupInstances(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownTopics.Lock()
+	knownTopics.order.Init()
+	knownTopics.m = make(map[string]*list.Element)
+	knownTopics.Unlock()
+	// A pasted topic link, never seen in search results.
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	if torrent := tb.transmission.torrent(hash); torrent == nil || torrent.DownloadDir != "/films" {
+		t.Errorf("torrent = %+v, want it routed by the forum of its topic page", torrent)
+	}
+	if record := getTorrentRecord(hash); record == nil || record.Instance != "seedbox" {
+		t.Errorf("record = %+v, want the torrent on seedbox", record)
+	}
+}
+
+func TestWatchAutoDownload(t *testing.T) {
+	tb := newTestBot(t)
+	config.Quota = &Quota{MaxSize: "512 KB"}
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	watch := func() {
+		err := state.update(func(s *State) {
+			s.Watches["1"] = &Watch{ID: "1", ChatID: -100, UserID: int64(tb.user.ID), Query: "Dune", Auto: true}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkWatches(tb.bot)
+	}
+
+	watch()
+	tb.telegram.waitFor(t, "sendMessage", func(params url.Values) bool {
+		return params.Get("chat_id") == "-100" && strings.HasPrefix(params.Get("text"), "Could not download it: ") && strings.HasSuffix(params.Get("text"), "is larger than your limit of 512.00 KB per torrent")
+	})
+	if tb.transmission.torrent(hash) != nil {
+		t.Error("torrent over the quota of the user downloaded")
+	}
+
+	config.Quota = nil
+	watch()
+	if tb.transmission.torrent(hash) == nil {
+		t.Fatal("torrent not downloaded")
+	}
+	if record := getTorrentRecord(hash); record == nil || record.UserID != int64(tb.user.ID) {
+		t.Errorf("record = %+v, want the torrent owned by the user who saved the search", record)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	tb := newTestBot(t)
+	config.SeedPolicy = &SeedPolicy{IdleTime: Duration(time.Hour)}
+	hash := tb.tracker.addTorrent(t, "6119871", "Dune.2021.2160p.WEB-DL")
+	tb.pressInline("init-6119871")
+	card := 1
+	instance, err := getInstance("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	isReaped := func() bool {
+		var reaped bool
+		state.view(func(s *State) { _, reaped = s.Reaped[hash] })
+		return reaped
+	}
+
+	// A torrent never active has no idle time.
+	tb.transmission.update(hash, func(torrent *fakeTransmissionTorrent) {
+		torrent.PercentDone = 1
+		torrent.Status = fakeTransmissionSeeding
+		torrent.ActivityDate = 0
+	})
+	_, err = reapInstance(instance, make(map[string]bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent := tb.transmission.torrent(hash); torrent.Status != fakeTransmissionSeeding || isReaped() {
+		t.Errorf("torrent never active stopped as idle: %+v", torrent)
+	}
+
+	tb.transmission.update(hash, func(torrent *fakeTransmissionTorrent) {
+		torrent.ActivityDate = time.Now().Add(-2 * time.Hour).Unix()
+	})
+	_, err = reapInstance(instance, make(map[string]bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent := tb.transmission.torrent(hash); torrent.Status != fakeTransmissionStopped || !isReaped() {
+		t.Fatalf("idle torrent = %+v, want it stopped", torrent)
+	}
+	tb.press(card, "Start")
+	if isReaped() {
+		t.Error("torrent started again still marked as stopped by its policy")
+	}
+
+	// The marks of the torrents gone from every instance are dropped.
+	err = state.update(func(s *State) { s.Reaped["gone"] = time.Now() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reapTorrents(tb.bot)
+	state.view(func(s *State) {
+		if _, ok := s.Reaped["gone"]; ok {
+			t.Error("mark of a torrent gone still remembered")
+		}
+	})
+}
+
+func TestReapUnownedTorrents(t *testing.T) {
+	tb := newTestBot(t)
+	config.SeedPolicy = &SeedPolicy{Ratio: 2, Action: "remove-data"}
+	instance, err := getInstance("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := instance.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A torrent added outside of the bot.
+	body, hash := newTestTorrent(t, "Dune.2021.2160p.WEB-DL")
+	err = ioutil.WriteFile("outside.torrent", body, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Add("outside.torrent", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.transmission.update(hash, func(torrent *fakeTransmissionTorrent) {
+		torrent.PercentDone = 1
+		torrent.Status = fakeTransmissionSeeding
+		torrent.UploadRatio = 3
+	})
+
+	_, err = reapInstance(instance, make(map[string]bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent := tb.transmission.torrent(hash); torrent == nil || torrent.Status != fakeTransmissionStopped {
+		t.Errorf("torrent = %+v, want it stopped but kept", torrent)
+	}
+
+	config.ReapUnowned = true
+	_, err = reapInstance(instance, make(map[string]bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tb.transmission.torrent(hash) != nil || !tb.transmission.removedWithData(hash) {
+		t.Error("torrent not removed with its data once allowed")
+	}
+}
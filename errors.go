@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/message"
+)
+
+// Kinds of failures reported to users, matched with errors.Is. Along with
+// errNotLoggedIn and errTorrentNotFound, they are attached to the
+// underlying errors with withKind.
+var (
+	errTrackerUnavailable = errors.New("tracker unavailable")
+	errClientUnreachable  = errors.New("torrent client unreachable")
+	errDiskFull           = errors.New("disk full")
+)
+
+// refusal is an expected failure, like an exceeded quota, explained to the
+// user as is rather than reported with a correlation ID.
+type refusal struct {
+	text string
+}
+
+func (r *refusal) Error() string {
+	return r.text
+}
+
+// kindError attaches a kind to an error while keeping it unwrappable.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func withKind(kind error, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// clientError classifies an error returned by a torrent client. The RPC
+// libraries flatten network errors into strings, so they are recognized by
+// their message too.
+func clientError(err error) error {
+	if err == nil || errors.Is(err, errTorrentNotFound) {
+		return err
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "no space left on device"),
+		strings.Contains(message, "disk full"),
+		strings.Contains(message, "not enough space"):
+		return withKind(errDiskFull, err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		strings.Contains(message, "request error") ||
+		strings.Contains(message, "connection refused") ||
+		strings.Contains(message, "no such host") ||
+		strings.Contains(message, "timeout") {
+		return withKind(errClientUnreachable, err)
+	}
+	return err
+}
+
+// userMessage returns a short description of err for the user, short
+// enough to fit a callback alert or an inline query button. It is a message
+// key, translated by reportError.
+func userMessage(err error) string {
+	var statusErr *httpStatusError
+	switch {
+	case errors.Is(err, errNotLoggedIn):
+		return "Tracker login expired"
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound,
+		errors.Is(err, errTorrentNotFound):
+		return "Torrent not found"
+	case errors.Is(err, errTrackerUnavailable):
+		return "Tracker unavailable, try again later"
+	case errors.Is(err, errClientUnreachable):
+		return "Torrent client unreachable"
+	case errors.Is(err, errDiskFull):
+		return "Disk full, remove some torrents"
+	default:
+		return "Something went wrong"
+	}
+}
+
+// reportError logs err under a new correlation ID and returns the text to
+// show the user, which refers to the same ID.
+func reportError(p *message.Printer, context string, err error) string {
+	id := uuid.New().String()[:8]
+	log.Printf("[%s] %s: %v", id, context, err)
+	return p.Sprintf("%s (error %s)", p.Sprintf(userMessage(err)), id)
+}
+
+// describeError returns the text of a refusal as is, and reports any other
+// error.
+func describeError(p *message.Printer, context string, err error) string {
+	var r *refusal
+	if errors.As(err, &r) {
+		return r.text
+	}
+	return reportError(p, context, err)
+}
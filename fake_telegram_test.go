@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeTelegramCall is a Bot API request made by the bot.
+type fakeTelegramCall struct {
+	Method string
+	Params url.Values
+}
+
+// fakeTelegramMessage is the current state of a message sent by the bot.
+type fakeTelegramMessage struct {
+	ChatID      int64
+	Text        string
+	ReplyMarkup tgbotapi.InlineKeyboardMarkup
+}
+
+// button returns the callback data of the message's button labelled text.
+func (m *fakeTelegramMessage) button(text string) string {
+	for _, row := range m.ReplyMarkup.InlineKeyboard {
+		for _, button := range row {
+			if button.Text == text && button.CallbackData != nil {
+				return *button.CallbackData
+			}
+		}
+	}
+	return ""
+}
+
+// fakeTelegram is a stand-in for the Bot API: it replays queued updates to
+// getUpdates and records every other call along with the messages the bot
+// sent and edited.
+type fakeTelegram struct {
+	mu            sync.Mutex
+	token         string
+	updates       []json.RawMessage
+	nextUpdateID  int
+	nextMessageID int
+	calls         []fakeTelegramCall
+	messages      map[int]*fakeTelegramMessage
+	// chatMembers are the statuses getChatMember reports, by user ID.
+	// Users are plain members by default.
+	chatMembers map[int]string
+	changed     chan struct{}
+}
+
+func newFakeTelegram(t *testing.T, token string) (*fakeTelegram, *httptest.Server) {
+	fake := &fakeTelegram{
+		token:         token,
+		nextUpdateID:  1,
+		nextMessageID: 1,
+		messages:      make(map[int]*fakeTelegramMessage),
+		chatMembers:   make(map[int]string),
+		changed:       make(chan struct{}),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+// notify wakes up everyone waiting for a change. The caller must hold f.mu.
+func (f *fakeTelegram) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// push queues an update for the bot and returns its id.
+func (f *fakeTelegram) push(update tgbotapi.Update) int {
+	return f.pushInThread(update, 0)
+}
+
+// pushInThread queues an update whose message was sent to a forum topic
+// thread, unless threadID is zero.
+func (f *fakeTelegram) pushInThread(update tgbotapi.Update, threadID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update.UpdateID = f.nextUpdateID
+	f.nextUpdateID++
+	body, _ := json.Marshal(update)
+	if threadID != 0 {
+		var fields map[string]interface{}
+		json.Unmarshal(body, &fields)
+		fields["message"].(map[string]interface{})["message_thread_id"] = threadID
+		body, _ = json.Marshal(fields)
+	}
+	f.updates = append(f.updates, body)
+	f.notify()
+	return update.UpdateID
+}
+
+func (f *fakeTelegram) setChatMember(userID int, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chatMembers[userID] = status
+}
+
+// waitFor waits until the bot has made a call matching fn and returns it.
+func (f *fakeTelegram) waitFor(t *testing.T, method string, fn func(url.Values) bool) fakeTelegramCall {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		f.mu.Lock()
+		for _, call := range f.calls {
+			if call.Method == method && (fn == nil || fn(call.Params)) {
+				f.mu.Unlock()
+				return call
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+}
+
+// waitForAnswer waits until the bot has answered a callback query.
+func (f *fakeTelegram) waitForAnswer(t *testing.T, callbackQueryID string) fakeTelegramCall {
+	t.Helper()
+	return f.waitFor(t, "answerCallbackQuery", func(params url.Values) bool {
+		return params.Get("callback_query_id") == callbackQueryID
+	})
+}
+
+func (f *fakeTelegram) message(id int) *fakeTelegramMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	message, ok := f.messages[id]
+	if !ok {
+		return nil
+	}
+	copied := *message
+	return &copied
+}
+
+func (f *fakeTelegram) reply(w http.ResponseWriter, result interface{}) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: body})
+}
+
+// getUpdates returns the queued updates from offset on, waiting a little
+// for new ones like long polling does.
+func (f *fakeTelegram) getUpdates(params url.Values) []json.RawMessage {
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		f.mu.Lock()
+		var updates []json.RawMessage
+		for i, update := range f.updates {
+			// Update ids start at 1 and follow each other.
+			if i+1 >= offset {
+				updates = append(updates, update)
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		if len(updates) > 0 {
+			return updates
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return []json.RawMessage{}
+		}
+	}
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bot" + f.token + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(tgbotapi.APIResponse{ErrorCode: 401, Description: "Unauthorized"})
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, prefix)
+	r.ParseForm()
+	switch method {
+	case "getMe":
+		f.reply(w, tgbotapi.User{ID: 1, IsBot: true, FirstName: "Bot", UserName: "test_bot"})
+		return
+	case "getUpdates":
+		f.reply(w, f.getUpdates(r.Form))
+		return
+	case "getChatMember":
+		userID, _ := strconv.Atoi(r.Form.Get("user_id"))
+		f.mu.Lock()
+		status, ok := f.chatMembers[userID]
+		f.mu.Unlock()
+		if !ok {
+			status = "member"
+		}
+		f.reply(w, tgbotapi.ChatMember{User: &tgbotapi.User{ID: userID}, Status: status})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.notify()
+	f.calls = append(f.calls, fakeTelegramCall{Method: method, Params: r.Form})
+	var markup tgbotapi.InlineKeyboardMarkup
+	if replyMarkup := r.Form.Get("reply_markup"); replyMarkup != "" {
+		json.Unmarshal([]byte(replyMarkup), &markup)
+	}
+	chatID, _ := strconv.ParseInt(r.Form.Get("chat_id"), 10, 64)
+	messageID, _ := strconv.Atoi(r.Form.Get("message_id"))
+	switch method {
+	case "sendMessage":
+		messageID = f.nextMessageID
+		f.nextMessageID++
+		f.messages[messageID] = &fakeTelegramMessage{
+			ChatID:      chatID,
+			Text:        r.Form.Get("text"),
+			ReplyMarkup: markup,
+		}
+	case "editMessageText", "editMessageReplyMarkup":
+		message, ok := f.messages[messageID]
+		if !ok || message.ChatID != chatID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tgbotapi.APIResponse{ErrorCode: 400, Description: "Bad Request: message to edit not found"})
+			return
+		}
+		if method == "editMessageText" {
+			message.Text = r.Form.Get("text")
+		}
+		message.ReplyMarkup = markup
+	case "answerCallbackQuery", "answerInlineQuery":
+		f.reply(w, true)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(tgbotapi.APIResponse{ErrorCode: 404, Description: "Not Found: method not found"})
+		return
+	}
+	message := f.messages[messageID]
+	f.reply(w, tgbotapi.Message{
+		MessageID: messageID,
+		Chat:      &tgbotapi.Chat{ID: message.ChatID},
+		Date:      int(time.Now().Unix()),
+		Text:      message.Text,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeTracker serves saved tracker pages and generated .torrent files,
+// or the login page to requests without the session cookie.
+type fakeTracker struct {
+	mu       sync.Mutex
+	session  string
+	pages    map[string][]byte
+	torrents map[string][]byte
+}
+
+func newFakeTracker(t *testing.T, session string) (*fakeTracker, *httptest.Server) {
+	fake := &fakeTracker{
+		session:  session,
+		pages:    make(map[string][]byte),
+		torrents: make(map[string][]byte),
+	}
+	for path, page := range map[string]string{
+		"/forum/tracker.php":   "tracker.html",
+		"/forum/viewtopic.php": "viewtopic.html",
+		"/forum/login.php":     "tracker_logged_out.html",
+	} {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.pages[path] = body
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+// addTorrent makes dl.php serve a .torrent for the topic and returns its
+// info hash.
+func (f *fakeTracker) addTorrent(t *testing.T, topic string, name string) string {
+	body, hash := newTestTorrent(t, name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.torrents[topic] = body
+	return hash
+}
+
+// setSession changes the session cookie the tracker accepts.
+func (f *fakeTracker) setSession(session string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.session = session
+}
+
+func (f *fakeTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cookie, err := r.Cookie("bb_session"); err != nil || cookie.Value != f.session {
+		w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+		w.Write(f.pages["/forum/login.php"])
+		return
+	}
+	if r.URL.Path == "/forum/dl.php" {
+		body, ok := f.torrents[r.URL.Query().Get("t")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Write(body)
+		return
+	}
+	page, ok := f.pages[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+	w.Write(page)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+)
+
+// Transmission torrent statuses.
+const (
+	fakeTransmissionStopped     = 0
+	fakeTransmissionDownloading = 4
+	fakeTransmissionSeeding     = 6
+)
+
+type fakeTransmissionTorrent struct {
+	ID             int64                      `json:"id"`
+	HashString     string                     `json:"hashString"`
+	Name           string                     `json:"name"`
+	Status         int                        `json:"status"`
+	PercentDone    float64                    `json:"percentDone"`
+	DownloadDir    string                     `json:"downloadDir"`
+	TotalSize      int64                      `json:"totalSize"`
+	UploadRatio    float64                    `json:"uploadRatio"`
+	SecondsSeeding int64                      `json:"secondsSeeding"`
+	ActivityDate   int64                      `json:"activityDate"`
+	AddedDate      int64                      `json:"addedDate"`
+	HaveValid      int64                      `json:"haveValid"`
+	SizeWhenDone   int64                      `json:"sizeWhenDone"`
+	RateDownload   int64                      `json:"rateDownload"`
+	RateUpload     int64                      `json:"rateUpload"`
+	Eta            int64                      `json:"eta"`
+	PeersConnected int64                      `json:"peersConnected"`
+	PeersSending   int64                      `json:"peersSendingToUs"`
+	UploadedEver   int64                      `json:"uploadedEver"`
+	ErrorString    string                     `json:"errorString"`
+	TrackerStats   []*fakeTransmissionTracker `json:"trackerStats"`
+	Peers          []*fakeTransmissionPeer    `json:"peers"`
+	Files          []struct {
+		Name           string `json:"name"`
+		Length         int64  `json:"length"`
+		BytesCompleted int64  `json:"bytesCompleted"`
+	} `json:"files"`
+}
+
+type fakeTransmissionTracker struct {
+	Host                  string `json:"host"`
+	Tier                  int64  `json:"tier"`
+	SeederCount           int64  `json:"seederCount"`
+	LeecherCount          int64  `json:"leecherCount"`
+	DownloadCount         int64  `json:"downloadCount"`
+	HasAnnounced          bool   `json:"hasAnnounced"`
+	LastAnnounceResult    string `json:"lastAnnounceResult"`
+	LastAnnounceSucceeded bool   `json:"lastAnnounceSucceeded"`
+	LastAnnounceTime      int64  `json:"lastAnnounceTime"`
+}
+
+type fakeTransmissionPeer struct {
+	Address      string  `json:"address"`
+	ClientName   string  `json:"clientName"`
+	Progress     float64 `json:"progress"`
+	RateToClient int64   `json:"rateToClient"`
+	RateToPeer   int64   `json:"rateToPeer"`
+	IsEncrypted  bool    `json:"isEncrypted"`
+}
+
+// fakeTransmission is an in-memory stand-in for the Transmission RPC,
+// including its CSRF session id handshake.
+type fakeTransmission struct {
+	mu        sync.Mutex
+	sessionID string
+	nextID    int64
+	torrents  map[string]*fakeTransmissionTorrent
+	// deletedData records, by hash, whether removed torrents had their
+	// local data deleted.
+	deletedData map[string]bool
+	// repairs records the reannounce and verify calls, e.g.
+	// "torrent-verify <hash>".
+	repairs []string
+	// down makes the daemon drop every connection.
+	down bool
+}
+
+func newFakeTransmission(t *testing.T) (*fakeTransmission, *httptest.Server) {
+	fake := &fakeTransmission{
+		sessionID:   "fake-session",
+		torrents:    make(map[string]*fakeTransmissionTorrent),
+		deletedData: make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeTransmission) torrent(hash string) *fakeTransmissionTorrent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	torrent, ok := f.torrents[hash]
+	if !ok {
+		return nil
+	}
+	copied := *torrent
+	return &copied
+}
+
+// update changes a torrent in place.
+func (f *fakeTransmission) update(hash string, fn func(*fakeTransmissionTorrent)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(f.torrents[hash])
+}
+
+// removedWithData reports whether the torrent was removed along with its
+// local data.
+func (f *fakeTransmission) removedWithData(hash string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deletedData[hash]
+}
+
+// selectTorrents returns the torrents matching RPC ids, which may be
+// numeric ids or hashes, or all torrents if there are none.
+func (f *fakeTransmission) selectTorrents(ids []interface{}) []*fakeTransmissionTorrent {
+	var torrents []*fakeTransmissionTorrent
+	for _, torrent := range f.torrents {
+		if len(ids) == 0 {
+			torrents = append(torrents, torrent)
+			continue
+		}
+		for _, id := range ids {
+			if id == torrent.HashString || id == float64(torrent.ID) {
+				torrents = append(torrents, torrent)
+				break
+			}
+		}
+	}
+	return torrents
+}
+
+func (f *fakeTransmission) repairCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.repairs...)
+}
+
+func (f *fakeTransmission) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeTransmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+	if down {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if r.URL.Path != "/transmission/rpc" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("X-Transmission-Session-Id") != f.sessionID {
+		w.Header().Set("X-Transmission-Session-Id", f.sessionID)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	var req struct {
+		Method    string `json:"method"`
+		Arguments struct {
+			IDs             []interface{} `json:"ids"`
+			MetaInfo        string        `json:"metainfo"`
+			DownloadDir     string        `json:"download-dir"`
+			DeleteLocalData bool          `json:"delete-local-data"`
+		} `json:"arguments"`
+		Tag int `json:"tag"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := "success"
+	arguments := map[string]interface{}{}
+	switch req.Method {
+	case "torrent-add":
+		body, err := base64.StdEncoding.DecodeString(req.Arguments.MetaInfo)
+		if err != nil {
+			result = "invalid metainfo"
+			break
+		}
+		torrentFile, err := gtp.Parse(bytes.NewReader(body))
+		if err != nil {
+			result = "invalid or corrupt torrent file"
+			break
+		}
+		if torrent, ok := f.torrents[torrentFile.InfoHash]; ok {
+			arguments["torrent-duplicate"] = torrent
+			break
+		}
+		f.nextID++
+		torrent := &fakeTransmissionTorrent{
+			ID:           f.nextID,
+			HashString:   torrentFile.InfoHash,
+			Name:         torrentFile.Info.Name,
+			Status:       fakeTransmissionDownloading,
+			DownloadDir:  req.Arguments.DownloadDir,
+			ActivityDate: time.Now().Unix(),
+			AddedDate:    time.Now().Unix(),
+			Eta:          -1,
+		}
+		if torrent.DownloadDir == "" {
+			torrent.DownloadDir = "/downloads"
+		}
+		for _, file := range torrentFile.Files {
+			torrent.TotalSize += file.Length
+		}
+		torrent.SizeWhenDone = torrent.TotalSize
+		f.torrents[torrent.HashString] = torrent
+		arguments["torrent-added"] = torrent
+	case "torrent-start":
+		for _, torrent := range f.selectTorrents(req.Arguments.IDs) {
+			torrent.Status = fakeTransmissionDownloading
+			if torrent.PercentDone == 1 {
+				torrent.Status = fakeTransmissionSeeding
+			}
+		}
+	case "torrent-stop":
+		for _, torrent := range f.selectTorrents(req.Arguments.IDs) {
+			torrent.Status = fakeTransmissionStopped
+		}
+	case "torrent-get":
+		torrents := f.selectTorrents(req.Arguments.IDs)
+		if torrents == nil {
+			torrents = []*fakeTransmissionTorrent{}
+		}
+		arguments["torrents"] = torrents
+	case "torrent-set":
+	case "torrent-remove":
+		for _, torrent := range f.selectTorrents(req.Arguments.IDs) {
+			delete(f.torrents, torrent.HashString)
+			f.deletedData[torrent.HashString] = req.Arguments.DeleteLocalData
+		}
+	case "torrent-reannounce", "torrent-verify":
+		for _, torrent := range f.selectTorrents(req.Arguments.IDs) {
+			f.repairs = append(f.repairs, req.Method+" "+torrent.HashString)
+		}
+	case "session-get":
+		arguments["download-dir"] = "/downloads"
+	default:
+		result = "method name not recognized"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result":    result,
+		"arguments": arguments,
+		"tag":       req.Tag,
+	})
+}
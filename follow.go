@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// FOLLOW_INTERVAL is how often followed topics are checked for a
+// re-registered torrent.
+var FOLLOW_INTERVAL time.Duration = time.Hour
+
+// Subscription is a torrent whose tracker topic is followed: whenever the
+// topic gets a new .torrent, it replaces the one on the instance.
+type Subscription struct {
+	T         string    `json:"t"`
+	Instance  string    `json:"instance"`
+	Hash      string    `json:"hash"`
+	ChatIDs   []int64   `json:"chat_ids"`
+	CheckedAt time.Time `json:"checked_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func getTopicInfoHash(t string) (string, error) {
+	body, err := doForumGETRequest("/viewtopic.php", url.Values{"t": []string{t}})
+	if err != nil {
+		return "", err
+	}
+	return parseTopicInfoHash(bytes.NewReader(body))
+}
+
+// downloadTorrentFile fetches the topic's current .torrent from the tracker,
+// replacing the saved one.
+func downloadTorrentFile(t string) (string, []byte, error) {
+	fileName := filepath.Join("torrents", fmt.Sprintf("%s.torrent", t))
+	body, err := doForumGETRequest("/dl.php", url.Values{"t": []string{t}})
+	if err != nil {
+		return fileName, body, err
+	}
+	_, err = gtp.Parse(bytes.NewReader(body))
+	if err != nil && isLoginPage(body) {
+		return fileName, body, errNotLoggedIn
+	}
+	if err != nil {
+		return fileName, body, fmt.Errorf("invalid torrent file for topic %s: %v", t, err)
+	}
+	err = ioutil.WriteFile(fileName, body, os.ModePerm)
+	return fileName, body, err
+}
+
+func isFollowed(ref string) bool {
+	var followed bool
+	state.view(func(s *State) {
+		_, followed = s.Subscriptions[ref]
+	})
+	return followed
+}
+
+// toggleFollow subscribes the chat to the torrent's topic or unsubscribes it
+// if it already follows the topic, and reports whether it now follows it.
+func toggleFollow(t string, instance string, hash string, chatID int64) (bool, error) {
+	ref := torrentRef(t, instance)
+	var following bool
+	err := state.update(func(s *State) {
+		sub, ok := s.Subscriptions[ref]
+		if !ok {
+			sub = &Subscription{T: t, Instance: instance, Hash: hash, CheckedAt: time.Now()}
+			s.Subscriptions[ref] = sub
+		}
+		for i, id := range sub.ChatIDs {
+			if id == chatID {
+				sub.ChatIDs = append(sub.ChatIDs[:i], sub.ChatIDs[i+1:]...)
+				if len(sub.ChatIDs) == 0 {
+					delete(s.Subscriptions, ref)
+				}
+				return
+			}
+		}
+		sub.ChatIDs = append(sub.ChatIDs, chatID)
+		following = true
+	})
+	return following, err
+}
+
+func unfollow(ref string) error {
+	return state.update(func(s *State) {
+		delete(s.Subscriptions, ref)
+	})
+}
+
+// updateSubscription checks a followed topic and, if its torrent was
+// re-registered, swaps the torrent on the instance: the new one is added
+// into the directory of the old one, so that only new files are downloaded,
+// and the old one is removed without its data. It returns the name of the
+// new torrent, or an empty string if there was nothing to update.
+func updateSubscription(sub *Subscription) (string, error) {
+	hash, err := getTopicInfoHash(sub.T)
+	if err != nil {
+		return "", err
+	}
+	if hash == sub.Hash {
+		return "", nil
+	}
+	instance, err := getInstance(sub.Instance)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	torrent, err := replaceTorrent(c, sub.T, sub.Hash)
+	if err == errTorrentNotFound {
+		// The torrent was removed since it was followed, so there is
+		// nothing to update anymore.
+		log.Printf("Unfollowing topic %s: its torrent was removed", sub.T)
+		return "", unfollow(torrentRef(sub.T, sub.Instance))
+	}
+	if err != nil || torrent == nil {
+		// A nil torrent means the magnet link changed ahead of the .torrent
+		// file.
+		return "", err
+	}
+	sub.Hash = torrent.Hash
+	sub.UpdatedAt = time.Now()
+	return torrent.Name, nil
+}
+
+// replaceTorrent downloads the topic's current .torrent and, if it differs
+// from the torrent oldHash on the instance, adds it into the directory of the
+// old one and removes the old one without its data. It returns nil if the
+// topic still has the same torrent, and errTorrentNotFound if the old one is
+// not on the instance anymore.
+func replaceTorrent(c Client, t string, oldHash string) (*TorrentInfo, error) {
+	torrents, err := c.Status(oldHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) == 0 {
+		return nil, errTorrentNotFound
+	}
+	downloadDir := torrents[0].DownloadDir
+	fileName, _, err := downloadTorrentFile(t)
+	if err != nil {
+		return nil, err
+	}
+	torrent, err := c.Add(fileName, downloadDir)
+	if err != nil {
+		return nil, err
+	}
+	if torrent.Hash == oldHash {
+		return nil, nil
+	}
+	err = c.Remove(oldHash, false)
+	if err != nil && err != errTorrentNotFound {
+		return nil, err
+	}
+	err = moveTorrentRecord(oldHash, torrent.Hash)
+	if err != nil {
+		log.Println(err)
+	}
+	return torrent, nil
+}
+
+// checkSubscriptions updates every followed topic that is due for a check
+// and notifies the followers of the updated ones.
+func checkSubscriptions(bot *tgbotapi.BotAPI) {
+	var subs []Subscription
+	state.view(func(s *State) {
+		for _, sub := range s.Subscriptions {
+			if time.Since(sub.CheckedAt) >= FOLLOW_INTERVAL {
+				subs = append(subs, *sub)
+			}
+		}
+	})
+	for i := range subs {
+		sub := &subs[i]
+		ref := torrentRef(sub.T, sub.Instance)
+		name, err := updateSubscription(sub)
+		if err != nil {
+			log.Printf("Could not check followed topic %s: %v", sub.T, err)
+		}
+		sub.CheckedAt = time.Now()
+		err = state.update(func(s *State) {
+			if current, ok := s.Subscriptions[ref]; ok {
+				current.Hash = sub.Hash
+				current.CheckedAt = sub.CheckedAt
+				current.UpdatedAt = sub.UpdatedAt
+			}
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		if name == "" {
+			continue
+		}
+		log.Printf("Followed topic %s was updated: %s", sub.T, name)
+		for _, chatID := range sub.ChatIDs {
+			p := chatPrinter(chatID)
+			msg := tgbotapi.NewMessage(chatID, renderMessage(p, "topic_updated", &TorrentInfo{Name: name}))
+			msg.ReplyMarkup = getReplyMarkup(p, sub.T, sub.Instance)
+			_, err = send(bot, msg)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func runFollower(bot *tgbotapi.BotAPI) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkSubscriptions(bot)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/arkhipovkm/transmission-bot
 
-go 1.17
+go 1.18
 
 require (
 	github.com/arkhipovkm/go-torrent-parser v0.0.0-20211002192440-04e163df5aff
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+const defaultUsage = "Usage: /default <instance> [download dir], or /default reset"
+
+// destructiveCallbacks are the buttons only the admins of a group may press.
+var destructiveCallbacks = map[string]bool{
+	"remove-":     true,
+	"remove-yes-": true,
+}
+
+// destructiveCommands change the settings of a whole group, so only its
+// admins may use them.
+var destructiveCommands = map[string]bool{
+	"default": true,
+	"seed":    true,
+}
+
+// ChatSettings are the defaults of a chat. Torrents added from the chat go
+// to Instance, into DownloadDir or the instance's download directory,
+// instead of being routed.
+type ChatSettings struct {
+	Instance    string `json:"instance"`
+	DownloadDir string `json:"download_dir,omitempty"`
+}
+
+// addressedToBot reports whether a message is meant for the bot. In groups
+// the bot only reacts to commands, bare or with its name, to mentions and to
+// replies to its messages.
+func addressedToBot(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if msg.Chat == nil || msg.Chat.IsPrivate() {
+		return true
+	}
+	if msg.IsCommand() {
+		command := msg.CommandWithAt()
+		i := strings.Index(command, "@")
+		return i < 0 || strings.EqualFold(command[i+1:], bot.Self.UserName)
+	}
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == bot.Self.ID {
+		return true
+	}
+	return bot.Self.UserName != "" && strings.Contains(strings.ToLower(msg.Text), "@"+strings.ToLower(bot.Self.UserName))
+}
+
+// authorizeChatAdmin refuses destructive actions in groups to users who are
+// neither admins of the group, as reported by Telegram, nor of the bot.
+func authorizeChatAdmin(bot *tgbotapi.BotAPI, p *message.Printer, chat *tgbotapi.Chat, user *tgbotapi.User) error {
+	if chat == nil || chat.IsPrivate() {
+		return nil
+	}
+	if user == nil {
+		return &refusal{p.Sprintf("Only the admins of this chat can do this")}
+	}
+	if isAdmin(int64(user.ID)) {
+		return nil
+	}
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: user.ID})
+	if err != nil {
+		return err
+	}
+	if member.IsCreator() || member.IsAdministrator() {
+		return nil
+	}
+	return &refusal{p.Sprintf("Only the admins of this chat can do this")}
+}
+
+func getChatSettings(chatID int64) *ChatSettings {
+	var settings *ChatSettings
+	state.view(func(s *State) {
+		if cs, ok := s.Chats[chatID]; ok {
+			copied := *cs
+			settings = &copied
+		}
+	})
+	return settings
+}
+
+// setChatDefault handles the /default command, showing, setting or
+// resetting where the chat's torrents go.
+func setChatDefault(p *message.Printer, chatID int64, args string) string {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		settings := getChatSettings(chatID)
+		if settings == nil {
+			return p.Sprintf("No default destination, torrents are routed by the configuration.\n%s", p.Sprintf(defaultUsage))
+		}
+		return p.Sprintf("Default destination: %s", formatDestination(settings))
+	}
+	if len(fields) == 1 && strings.EqualFold(fields[0], "reset") {
+		err := state.update(func(s *State) {
+			delete(s.Chats, chatID)
+		})
+		if err != nil {
+			return p.Sprintf("Could not save the default destination: %s", reportError(p, "default "+args, err))
+		}
+		return p.Sprintf("Default destination reset, torrents are routed by the configuration.")
+	}
+	instance, err := getInstance(fields[0])
+	if err != nil {
+		log.Println(err)
+		return p.Sprintf("Unknown instance %s. %s", fields[0], p.Sprintf(defaultUsage))
+	}
+	settings := &ChatSettings{
+		Instance:    instance.Name,
+		DownloadDir: strings.Join(fields[1:], " "),
+	}
+	err = state.update(func(s *State) {
+		s.Chats[chatID] = settings
+	})
+	if err != nil {
+		return p.Sprintf("Could not save the default destination: %s", reportError(p, "default "+args, err))
+	}
+	return p.Sprintf("Default destination: %s", formatDestination(settings))
+}
+
+func formatDestination(settings *ChatSettings) string {
+	if settings.DownloadDir == "" {
+		return settings.Instance
+	}
+	return settings.Instance + ":" + settings.DownloadDir
+}
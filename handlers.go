@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gtp "github.com/arkhipovkm/go-torrent-parser"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+// callbackHandler handles a button press whose data starts with its prefix.
+// It returns the text of the callback answer, in the language of p.
+type callbackHandler func(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error)
+
+// callbackHandlers are tried in order, so a prefix must come before the
+// shorter ones it starts with.
+var callbackHandlers = []struct {
+	prefix  string
+	handler callbackHandler
+}{
+	{"start-", handleStart},
+	{"pause-", handlePause},
+	{"refresh-", handleRefresh},
+	{"details-", handleDetails},
+	{"reannounce-", handleReannounce},
+	{"verify-", handleVerify},
+	{"follow-", handleFollow},
+	{"remove-yes-", handleRemoveConfirmed},
+	{"remove-", handleRemove},
+	{"init-", handleInit},
+}
+
+func parseTorrentFile(t string) (*gtp.Torrent, error) {
+	_, body, err := getTorrentFile(t)
+	if err != nil {
+		return nil, err
+	}
+	return gtp.Parse(bytes.NewReader(body))
+}
+
+// editCallbackMessage replaces the text and buttons of the message whose
+// button was pressed.
+func editCallbackMessage(bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery, chatID int64, text string, markup *tgbotapi.InlineKeyboardMarkup) {
+	var msg tgbotapi.EditMessageTextConfig
+	if cq.Message != nil {
+		msg = tgbotapi.NewEditMessageText(chatID, cq.Message.MessageID, text)
+	} else if cq.InlineMessageID != "" {
+		msg = tgbotapi.EditMessageTextConfig{
+			BaseEdit: tgbotapi.BaseEdit{InlineMessageID: cq.InlineMessageID},
+			Text:     text,
+		}
+	} else {
+		return
+	}
+	msg.ReplyMarkup = markup
+	_, err := send(bot, msg)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// editTorrentCard refreshes the status message of a torrent.
+func editTorrentCard(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, c Client, t string, instance string) error {
+	msg, err := getUpdatedTorrentInfoMessage(p, c, t, instance)
+	if err != nil {
+		return err
+	}
+	editCallbackMessage(bot, cq, chatID, msg.Text, msg.ReplyMarkup)
+	return nil
+}
+
+func handleStart(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	err := checkQuota(p, int64(cq.From.ID), t)
+	if err != nil {
+		return "", err
+	}
+	instance, c, torrent, err := addTorrent(t, instanceName, chatID, int64(cq.From.ID))
+	if err != nil {
+		return "", err
+	}
+	if instance == nil {
+		if cq.Message != nil {
+			msg := tgbotapi.NewEditMessageReplyMarkup(chatID, cq.Message.MessageID, *getInstanceChooserMarkup("start", t))
+			_, err = send(bot, msg)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return p.Sprintf("Choose where to download the torrent"), nil
+	}
+	err = editTorrentCard(bot, p, cq, chatID, c, t, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	return p.Sprintf("Started torrent: %s", torrent.Name), nil
+}
+
+func handlePause(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	err = c.Stop(torrentFile.InfoHash)
+	if err != nil {
+		return "", clientError(err)
+	}
+	err = editTorrentCard(bot, p, cq, chatID, c, t, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	return p.Sprintf("Stopped torrent: %s", torrentFile.Info.Name), nil
+}
+
+func handleRefresh(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	return "", editTorrentCard(bot, p, cq, chatID, c, t, instance.Name)
+}
+
+// handleDetails shows the trackers and peers of a torrent in place of its
+// status card, until Back or another button refreshes it.
+func handleDetails(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	detailer, ok := c.(torrentDetailer)
+	if !ok {
+		return p.Sprintf("Details are not available for %s", instance.Name), nil
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	torrent, err := getTorrentInfo(c, torrentFile.InfoHash)
+	if err != nil {
+		return "", err
+	}
+	details, err := detailer.Details(torrentFile.InfoHash)
+	if err != nil {
+		return "", clientError(err)
+	}
+	detailsCbData := fmt.Sprintf("details-%s", ref)
+	backCbData := fmt.Sprintf("refresh-%s", ref)
+	editCallbackMessage(bot, cq, chatID, renderMessage(p, "details", newDetailsView(torrent, details)), &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+			tgbotapi.InlineKeyboardButton{
+				Text:         p.Sprintf("Refresh"),
+				CallbackData: &detailsCbData,
+			},
+			tgbotapi.InlineKeyboardButton{
+				Text:         p.Sprintf("Back"),
+				CallbackData: &backCbData,
+			},
+		}},
+	})
+	return "", nil
+}
+
+// repairTorrent reannounces or verifies a torrent and turns the message
+// into its status card.
+func repairTorrent(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string, verify bool) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	repairer, ok := c.(torrentRepairer)
+	if !ok {
+		return "", fmt.Errorf("instance %s cannot repair torrents", instance.Name)
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	answer := p.Sprintf("Reannounced torrent: %s", torrentFile.Info.Name)
+	if verify {
+		err = repairer.Verify(torrentFile.InfoHash)
+		answer = p.Sprintf("Verifying torrent: %s", torrentFile.Info.Name)
+	} else {
+		err = repairer.Reannounce(torrentFile.InfoHash)
+	}
+	if err != nil {
+		return "", clientError(err)
+	}
+	err = editTorrentCard(bot, p, cq, chatID, c, t, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	return answer, nil
+}
+
+func handleReannounce(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	return repairTorrent(bot, p, cq, chatID, ref, false)
+}
+
+func handleVerify(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	return repairTorrent(bot, p, cq, chatID, ref, true)
+}
+
+func handleFollow(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	following, err := toggleFollow(t, instance.Name, torrentFile.InfoHash, chatID)
+	if err != nil {
+		return "", err
+	}
+	answer := p.Sprintf("Stopped following updates of: %s", torrentFile.Info.Name)
+	if following {
+		answer = p.Sprintf("Following updates of: %s", torrentFile.Info.Name)
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	err = editTorrentCard(bot, p, cq, chatID, c, t, instance.Name)
+	if err != nil {
+		return "", err
+	}
+	return answer, nil
+}
+
+func handleRemoveConfirmed(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	instance, err := getInstance(instanceName)
+	if err != nil {
+		return "", err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return "", err
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	unlock := lockTorrent(torrentFile.InfoHash)
+	defer unlock()
+	// A torrent already removed, e.g. by a second press of Yes, is
+	// cleaned up all the same.
+	err = c.Remove(torrentFile.InfoHash, true)
+	if err != nil && !errors.Is(err, errTorrentNotFound) {
+		return "", clientError(err)
+	}
+	err = unfollow(torrentRef(t, instance.Name))
+	if err != nil {
+		log.Println(err)
+	}
+	err = forgetTorrent(torrentFile.InfoHash)
+	if err != nil {
+		log.Println(err)
+	}
+	startCbData := fmt.Sprintf("start-%s", torrentRef(t, instance.Name))
+	editCallbackMessage(bot, cq, chatID, renderMessage(p, "removed", &TorrentInfo{Name: torrentFile.Info.Name}), &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+			tgbotapi.InlineKeyboardButton{
+				Text:         p.Sprintf("Restart"),
+				CallbackData: &startCbData,
+			},
+		}},
+	})
+	return p.Sprintf("Removed torrent: %s", torrentFile.Info.Name), nil
+}
+
+func handleRemove(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, _ := parseTorrentRef(ref)
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	removeYesCbData := fmt.Sprintf("remove-yes-%s", ref)
+	removeNoCbData := fmt.Sprintf("refresh-%s", ref)
+	editCallbackMessage(bot, cq, chatID,
+		renderMessage(p, "remove_confirm", &TorrentInfo{Name: torrentFile.Info.Name}),
+		&tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+				tgbotapi.InlineKeyboardButton{
+					Text:         p.Sprintf("Yes"),
+					CallbackData: &removeYesCbData,
+				},
+				tgbotapi.InlineKeyboardButton{
+					Text:         p.Sprintf("No"),
+					CallbackData: &removeNoCbData,
+				},
+			}},
+		},
+	)
+	return "", nil
+}
+
+func handleInit(bot *tgbotapi.BotAPI, p *message.Printer, cq *tgbotapi.CallbackQuery, chatID int64, ref string) (string, error) {
+	t, instanceName := parseTorrentRef(ref)
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return "", err
+	}
+	// The updates of a chat are handled in order, so a second press
+	// finds the torrent the first one added, whatever message the button
+	// is on.
+	record := getTorrentRecord(torrentFile.InfoHash)
+	if record != nil && record.ChatID == chatID && time.Since(record.AddedAt) < duplicateAddWindow {
+		return p.Sprintf("Already downloading torrent: %s", torrentFile.Info.Name), nil
+	}
+	err = checkQuota(p, int64(cq.From.ID), t)
+	if err != nil {
+		return "", err
+	}
+	instance, c, torrent, err := addTorrent(t, instanceName, chatID, int64(cq.From.ID))
+	if err != nil {
+		return "", err
+	}
+	if instance == nil {
+		msg := tgbotapi.NewMessage(chatID, p.Sprintf("%s: choose where to download", torrentFile.Info.Name))
+		msg.ReplyMarkup = getInstanceChooserMarkup("init", t)
+		_, err = send(bot, msg)
+		if err != nil {
+			log.Println(err)
+		}
+		return p.Sprintf("Choose where to download the torrent"), nil
+	}
+	info, err := getTorrentInfo(c, torrent.Hash)
+	if err != nil {
+		return "", err
+	}
+	text := renderMessage(p, "status_card", info)
+	if instanceName != "" {
+		// The destination was picked from the instance chooser, whose
+		// buttons carry the instance.
+		editCallbackMessage(bot, cq, chatID, text, getReplyMarkup(p, t, instance.Name))
+	} else {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = getReplyMarkup(p, t, instance.Name)
+		_, err = send(bot, msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return p.Sprintf("Started downloading torrent: %s", torrent.Name), nil
+}
+
+// handleCallback runs the handler of a button press on a torrent the user
+// may manage. Every press is answered: failures with an alert, also written
+// into the message whose button was pressed along with a Retry button.
+// Refusals are only answered.
+func handleCallback(bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery) {
+	var chatID int64
+	if cq.Message != nil && cq.Message.Chat != nil && cq.Message.Chat.ID != 0 {
+		chatID = cq.Message.Chat.ID
+	} else if cq.From != nil {
+		chatID = int64(cq.From.ID)
+	} else {
+		return
+	}
+	p := userPrinter(cq.From)
+	var answer string
+	var err error
+	handled := false
+	for _, h := range callbackHandlers {
+		if strings.HasPrefix(cq.Data, h.prefix) {
+			ref := strings.TrimPrefix(cq.Data, h.prefix)
+			err = authorizeCallback(p, cq.From, h.prefix, ref)
+			if err == nil && destructiveCallbacks[h.prefix] && cq.Message != nil {
+				err = authorizeChatAdmin(bot, p, cq.Message.Chat, cq.From)
+			}
+			if err == nil {
+				answer, err = h.handler(bot, p, cq, chatID, ref)
+			}
+			handled = true
+			break
+		}
+	}
+	if !handled {
+		err = fmt.Errorf("unknown callback data %q", cq.Data)
+	}
+	callback := tgbotapi.NewCallback(cq.ID, answer)
+	var r *refusal
+	if errors.As(err, &r) {
+		callback = tgbotapi.NewCallbackWithAlert(cq.ID, r.text)
+	} else if err != nil {
+		text := reportError(p, cq.Data, err)
+		callback = tgbotapi.NewCallbackWithAlert(cq.ID, text)
+		if cq.Message != nil && handled {
+			retryCbData := cq.Data
+			status := cq.Message.Text
+			if i := strings.Index(status, "\n"+p.Sprintf("Failed: %s", "")); i >= 0 {
+				status = status[:i]
+			}
+			editCallbackMessage(bot, cq, chatID, strings.TrimSpace(status+"\n"+p.Sprintf("Failed: %s", text)), &tgbotapi.InlineKeyboardMarkup{
+				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+					tgbotapi.InlineKeyboardButton{
+						Text:         p.Sprintf("Retry"),
+						CallbackData: &retryCbData,
+					},
+				}},
+			})
+		}
+	}
+	_, err = bot.AnswerCallbackQuery(callback)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findTopicLink returns the topic of the first link with a t parameter in
+// a message, which may also mention the bot.
+func findTopicLink(text string) string {
+	for _, field := range strings.Fields(text) {
+		uri, err := url.ParseRequestURI(field)
+		if err != nil {
+			continue
+		}
+		if t := uri.Query().Get("t"); t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+// handleMessage offers to start the torrent of a topic link, replying in
+// the thread of the message.
+func handleMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, threadID int) {
+	t := findTopicLink(message.Text)
+	if t == "" {
+		return
+	}
+	p := userPrinter(message.From)
+	var msg tgbotapi.MessageConfig
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		msg = tgbotapi.NewMessage(message.Chat.ID, reportError(p, message.Text, err))
+	} else {
+		msg = tgbotapi.NewMessage(message.Chat.ID, p.Sprintf("%s: ready to start", torrentFile.Info.Name))
+		startCbData := fmt.Sprintf("start-%s", t)
+		msg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+				tgbotapi.InlineKeyboardButton{
+					Text:         p.Sprintf("Start"),
+					CallbackData: &startCbData,
+				},
+			}},
+		}
+	}
+	msg.ReplyToMessageID = message.MessageID
+	_, err = sendMessage(bot, msg, threadID)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// handleInlineQuery answers a search. A failed search is reported on the
+// button shown above the (empty) results.
+func handleInlineQuery(bot *tgbotapi.BotAPI, query *tgbotapi.InlineQuery) {
+	log.Println("Got an inline query", query.Query)
+	inlineQueryAnswer := tgbotapi.InlineConfig{
+		InlineQueryID: query.ID,
+		Results:       []interface{}{},
+		CacheTime:     0,
+		IsPersonal:    false,
+	}
+	if strings.TrimSpace(query.Query) != "" {
+		var offset int
+		if query.Offset != "" {
+			offset, _ = strconv.Atoi(query.Offset)
+		}
+		p := userPrinter(query.From)
+		var profile *QualityProfile
+		if query.From != nil {
+			_, profile = userQualityProfile(int64(query.From.ID))
+		}
+		results, _, err := getSectionInlineResults(p, query.Query, offset, profile)
+		if err != nil {
+			inlineQueryAnswer.SwitchPMText = reportError(p, "search "+query.Query, err)
+			inlineQueryAnswer.SwitchPMParameter = "error"
+		} else if results != nil {
+			inlineQueryAnswer.Results = results
+		}
+		log.Println("Sending Inline Answer..")
+	}
+	_, err := bot.AnswerInlineQuery(inlineQueryAnswer)
+	if err != nil {
+		log.Println(err)
+	}
+}
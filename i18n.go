@@ -0,0 +1,327 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// Messages are keyed by their English text, which is used as is for
+// English and for anything missing from a translation.
+var supportedLanguages = []language.Tag{language.English, language.Russian}
+
+var languageMatcher = language.NewMatcher(supportedLanguages)
+
+var messages = catalog.NewBuilder(catalog.Fallback(language.English))
+
+var russianMessages = map[string]string{
+	// Buttons
+	"Start":      "Старт",
+	"Refresh":    "Обновить",
+	"Pause":      "Пауза",
+	"Remove":     "Удалить",
+	"Follow":     "Следить",
+	"Unfollow":   "Не следить",
+	"Yes":        "Да",
+	"No":         "Нет",
+	"Retry":      "Повторить",
+	"Restart":    "Перезапустить",
+	"Download":   "Скачать",
+	"View topic": "Открыть тему",
+	"Back":       "Назад",
+	"Details":    "Подробнее",
+	"Reannounce": "Переанонсировать",
+	"Verify":     "Проверить",
+
+	// Torrent statuses
+	"stopped":                "остановлен",
+	"waiting to check files": "ожидает проверки",
+	"checking files":         "проверка файлов",
+	"waiting to download":    "в очереди на загрузку",
+	"downloading":            "загружается",
+	"waiting to seed":        "в очереди на раздачу",
+	"seeding":                "раздаётся",
+	"can't find peers":       "нет пиров",
+	"error":                  "ошибка",
+	"missing files":          "файлы отсутствуют",
+	"moving":                 "перемещается",
+	"queued":                 "в очереди",
+
+	// Sizes
+	"%.2f KB": "%.2f КБ",
+	"%.2f MB": "%.2f МБ",
+	"%.2f GB": "%.2f ГБ",
+	"%.2f TB": "%.2f ТБ",
+	"%.2f PB": "%.2f ПБ",
+
+	// Durations
+	"%dd %dh":  "%dд %dч",
+	"%dh %dm":  "%dч %dм",
+	"just now": "только что",
+	"%dm %ds":  "%dм %dс",
+	"%ds":      "%dс",
+
+	// Search results and torrents
+	"Size: %s\nSeeders: %s\nDownloads: %s":                                 "Размер: %s\nСиды: %s\nСкачиваний: %s",
+	"%s: ready to start":                                                   "%s: готов к запуску",
+	"%s: choose where to download":                                         "%s: выберите, куда скачать",
+	"Choose where to download the torrent":                                 "Выберите, куда скачать торрент",
+	"Started torrent: %s":                                                  "Торрент запущен: %s",
+	"Started downloading torrent: %s":                                      "Загрузка начата: %s",
+	"Already downloading torrent: %s":                                      "Уже загружается: %s",
+	"Stopped torrent: %s":                                                  "Торрент остановлен: %s",
+	"Following updates of: %s":                                             "Слежу за обновлениями: %s",
+	"Stopped following updates of: %s":                                     "Больше не слежу за обновлениями: %s",
+	"Are you sure you want to remove torrent \"%s\" and all its contents?": "Удалить торрент «%s» вместе со всеми файлами?",
+	"Removed torrent: %s":                                                  "Торрент удалён: %s",
+	"%s: removed":                                                          "%s: удалён",
+	"%s: updated on the tracker, downloading new files":                    "%s: обновлён на трекере, скачиваю новые файлы",
+	"unavailable":                                                          "недоступен",
+	"unavailable: %s":                                                      "недоступен: %s",
+	"no torrents":                                                          "нет торрентов",
+
+	// Status cards
+	"Size: %s of %s":                        "Размер: %s из %s",
+	"Speed: ↓ %s/s ↑ %s/s":                  "Скорость: ↓ %s/с ↑ %s/с",
+	"ETA: %s":                               "Осталось: %s",
+	"Peers: %d, seeds: %d":                  "Пиры: %d, сиды: %d",
+	"Ratio: %.2f, uploaded %s":              "Рейтинг: %.2f, отдано %s",
+	"Added: %s":                             "Добавлен: %s",
+	"Error: %s":                             "Ошибка клиента: %s",
+	"Tracker error: %s":                     "Ошибка трекера: %s",
+	"Trackers:":                             "Трекеры:",
+	"none":                                  "нет",
+	"Announce failed: %s":                   "Анонс не удался: %s",
+	"%d seeders, %d leechers, %d downloads": "сидов: %d, личей: %d, скачиваний: %d",
+	"Peers: %d connected, %d downloading from, %d uploading to, %d encrypted": "Пиры: %d подключено, %d отдают нам, %d качают у нас, %d с шифрованием",
+	"%s: error: %s":                        "%s: ошибка: %s",
+	"%s: every tracker is failing: %s":     "%s: все трекеры недоступны: %s",
+	"%s: no progress for %s at %s":         "%s: нет прогресса уже %s, загружено %s",
+	"Retrying automatically did not help.": "Автоматический повтор не помог.",
+	"Reannounced torrent: %s":              "Торрент переанонсирован: %s",
+	"Verifying torrent: %s":                "Проверка торрента: %s",
+	"Details are not available for %s":     "Подробности недоступны для %s",
+
+	// Errors
+	"Failed: %s":                           "Ошибка: %s",
+	"%s (error %s)":                        "%s (ошибка %s)",
+	"Tracker login expired":                "Сессия трекера истекла",
+	"Torrent not found":                    "Торрент не найден",
+	"Tracker unavailable, try again later": "Трекер недоступен, попробуйте позже",
+	"Torrent client unreachable":           "Торрент-клиент недоступен",
+	"Disk full, remove some torrents":      "Диск заполнен, удалите торренты",
+	"Something went wrong":                 "Что-то пошло не так",
+
+	// Ownership and quotas
+	"You can only manage your own torrents":                             "Вы можете управлять только своими торрентами",
+	"%s is larger than your limit of %s per torrent":                    "%s больше вашего лимита в %s на торрент",
+	"This torrent of %s would exceed your monthly limit: %s of %s used": "Торрент размером %s превысит ваш месячный лимит: использовано %s из %s",
+	"Too many active downloads: %d of %d allowed":                       "Слишком много активных загрузок: %d из %d разрешённых",
+
+	// Groups
+	"Only the admins of this chat can do this":                              "Это могут делать только администраторы чата",
+	"Usage: /default <instance> [download dir], or /default reset":          "Использование: /default <инстанс> [папка загрузки] или /default reset",
+	"No default destination, torrents are routed by the configuration.\n%s": "Назначение по умолчанию не задано, торренты распределяются по конфигурации.\n%s",
+	"Default destination: %s":                                               "Назначение по умолчанию: %s",
+	"Default destination reset, torrents are routed by the configuration.":  "Назначение по умолчанию сброшено, торренты распределяются по конфигурации.",
+	"Could not save the default destination: %s":                            "Не удалось сохранить назначение по умолчанию: %s",
+	"Unknown instance %s. %s":                                               "Неизвестный инстанс %s. %s",
+
+	// Saved searches
+	"Usage: /watch <query> [seeders>=N] [size>=10GB] [size<=40GB] [res>=1080p] [auto]": "Использование: /watch <запрос> [seeders>=N] [size>=10GB] [size<=40GB] [res>=1080p] [auto]",
+	"Could not search the tracker: %s":                                                 "Не удалось выполнить поиск: %s",
+	"Could not save the search: %s":                                                    "Не удалось сохранить поиск: %s",
+	"Could not remove the search: %s":                                                  "Не удалось удалить поиск: %s",
+	"No such search. Usage: /unwatch <id>":                                             "Нет такого поиска. Использование: /unwatch <id>",
+	"Stopped watching #%s":                                                             "Поиск #%s удалён",
+	"No saved searches. %s":                                                            "Нет сохранённых поисков. %s",
+	"New result for #%s %s:\n":                                                         "Новый результат для #%s %s:\n",
+	"Invalid filter %s":                                                                "Неверный фильтр %s",
+	"Empty query":                                                                      "Пустой запрос",
+	"Could not download it: %s":                                                        "Не удалось его скачать: %s",
+
+	// Seeding policies
+	"Usage: /seed <topic link or id> [ratio=2] [seed_time=72h] [idle_time=24h] [action=stop|remove|remove-data]": "Использование: /seed <ссылка или номер темы> [ratio=2] [seed_time=72h] [idle_time=24h] [action=stop|remove|remove-data]",
+	"Invalid topic. %s":                                  "Неверная тема. %s",
+	"Could not save the policy: %s":                      "Не удалось сохранить политику: %s",
+	"No torrent of this topic was added from this chat.": "Из этого чата не добавлялось торрентов этой темы.",
+	"Seed policy of topic %s: %s":                        "Политика раздачи темы %s: %s",
+	"ratio %.2f":                                         "рейтинг %.2f",
+	"seeded for %s":                                      "раздавался %s",
+	"idle for %s":                                        "без активности %s",
+	"removed":                                            "удалён",
+	"removed with data":                                  "удалён вместе с данными",
+
+	// Quality profiles
+	"Usage: /quality [%s]":                                     "Использование: /quality [%s]",
+	"Search results are in tracker order.":                     "Результаты поиска идут в порядке трекера.",
+	"Search results are in tracker order.\n%s":                 "Результаты поиска идут в порядке трекера.\n%s",
+	"Search results are ranked by the %s quality profile.":     "Результаты поиска отсортированы по профилю качества %s.",
+	"Search results are ranked by the %s quality profile.\n%s": "Результаты поиска отсортированы по профилю качества %s.\n%s",
+	"Could not save the quality profile: %s":                   "Не удалось сохранить профиль качества: %s",
+
+	// Language
+	"Language: %s":                  "Язык: %s",
+	"Usage: /language [en|ru|auto]": "Использование: /language [en|ru|auto]",
+}
+
+func init() {
+	for key, translation := range russianMessages {
+		setMessage(language.Russian, key, catalog.String(translation))
+	}
+
+	setMessage(language.English, "%d bytes", plural.Selectf(1, "%d",
+		plural.One, "%d byte",
+		plural.Other, "%d bytes",
+	))
+	setMessage(language.Russian, "%d bytes", plural.Selectf(1, "%d",
+		plural.One, "%d байт",
+		plural.Few, "%d байта",
+		plural.Other, "%d байт",
+	))
+	setMessage(language.English, "Watching %s\n%d current results will not be reported.", plural.Selectf(2, "%d",
+		plural.One, "Watching %s\n%d current result will not be reported.",
+		plural.Other, "Watching %s\n%d current results will not be reported.",
+	))
+	setMessage(language.Russian, "Watching %s\n%d current results will not be reported.", plural.Selectf(2, "%d",
+		plural.One, "Слежу за %s\n%d текущий результат не будет показан.",
+		plural.Few, "Слежу за %s\n%d текущих результата не будут показаны.",
+		plural.Other, "Слежу за %s\n%d текущих результатов не будут показаны.",
+	))
+	for _, age := range []struct {
+		key, one, ruOne, ruFew, ruMany string
+	}{
+		{"%d minutes ago", "%d minute ago", "%d минуту назад", "%d минуты назад", "%d минут назад"},
+		{"%d hours ago", "%d hour ago", "%d час назад", "%d часа назад", "%d часов назад"},
+		{"%d days ago", "%d day ago", "%d день назад", "%d дня назад", "%d дней назад"},
+		{"%d months ago", "%d month ago", "%d месяц назад", "%d месяца назад", "%d месяцев назад"},
+		{"%d years ago", "%d year ago", "%d год назад", "%d года назад", "%d лет назад"},
+	} {
+		setMessage(language.English, age.key, plural.Selectf(1, "%d",
+			plural.One, age.one,
+			plural.Other, age.key,
+		))
+		setMessage(language.Russian, age.key, plural.Selectf(1, "%d",
+			plural.One, age.ruOne,
+			plural.Few, age.ruFew,
+			plural.Other, age.ruMany,
+		))
+	}
+	setMessage(language.English, "Seeding finished for %d torrents:", plural.Selectf(1, "%d",
+		plural.One, "Seeding finished for %d torrent:",
+		plural.Other, "Seeding finished for %d torrents:",
+	))
+	setMessage(language.Russian, "Seeding finished for %d torrents:", plural.Selectf(1, "%d",
+		plural.One, "Раздача завершена для %d торрента:",
+		plural.Other, "Раздача завершена для %d торрентов:",
+	))
+}
+
+func setMessage(tag language.Tag, key string, msg ...catalog.Message) {
+	err := messages.Set(tag, key, msg...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// matchLanguage returns the supported language closest to a Telegram
+// language code, English if there is none.
+func matchLanguage(code string) language.Tag {
+	if code == "" {
+		return language.English
+	}
+	tag, _, confidence := languageMatcher.Match(language.Make(code))
+	if confidence == language.No {
+		return language.English
+	}
+	base, _ := tag.Base()
+	return language.Make(base.String())
+}
+
+// LanguagePreference is the language of a user, either picked with the
+// /language command or detected from their Telegram client.
+type LanguagePreference struct {
+	Code     string `json:"code"`
+	Override bool   `json:"override"`
+}
+
+func newPrinter(tag language.Tag) *message.Printer {
+	return message.NewPrinter(tag, message.Catalog(messages))
+}
+
+var languageNames = map[string]string{
+	"en": "English",
+	"ru": "русский",
+}
+
+// userLanguage returns the language code of a user interacting with the
+// bot, and remembers it for the messages sent to them later on.
+func userLanguage(user *tgbotapi.User) string {
+	code := matchLanguage(user.LanguageCode).String()
+	var pref LanguagePreference
+	state.view(func(s *State) {
+		if p, ok := s.Languages[int64(user.ID)]; ok {
+			pref = *p
+		}
+	})
+	if pref.Override {
+		return pref.Code
+	}
+	if pref.Code != code {
+		err := state.update(func(s *State) {
+			s.Languages[int64(user.ID)] = &LanguagePreference{Code: code}
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return code
+}
+
+// userPrinter returns the printer for a user interacting with the bot.
+func userPrinter(user *tgbotapi.User) *message.Printer {
+	if user == nil {
+		return newPrinter(language.English)
+	}
+	return newPrinter(language.Make(userLanguage(user)))
+}
+
+// chatPrinter returns the printer for messages the bot sends on its own,
+// in the language of the user of a private chat.
+func chatPrinter(chatID int64) *message.Printer {
+	code := "en"
+	state.view(func(s *State) {
+		if pref, ok := s.Languages[chatID]; ok {
+			code = pref.Code
+		}
+	})
+	return newPrinter(language.Make(code))
+}
+
+// setLanguage handles the /language command.
+func setLanguage(user *tgbotapi.User, args string) string {
+	var pref *LanguagePreference
+	switch args {
+	case "":
+		code := userLanguage(user)
+		return newPrinter(language.Make(code)).Sprintf("Language: %s", languageNames[code])
+	case "auto":
+		pref = &LanguagePreference{Code: matchLanguage(user.LanguageCode).String()}
+	case "en", "ru":
+		pref = &LanguagePreference{Code: args, Override: true}
+	default:
+		return userPrinter(user).Sprintf("Usage: /language [en|ru|auto]")
+	}
+	err := state.update(func(s *State) {
+		s.Languages[int64(user.ID)] = pref
+	})
+	p := newPrinter(language.Make(pref.Code))
+	if err != nil {
+		return reportError(p, "language "+args, err)
+	}
+	return p.Sprintf("Language: %s", languageNames[pref.Code])
+}
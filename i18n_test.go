@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestMatchLanguage(t *testing.T) {
+	for code, want := range map[string]string{
+		"":      "en",
+		"en":    "en",
+		"en-GB": "en",
+		"ru":    "ru",
+		"ru-RU": "ru",
+		"fr":    "en",
+	} {
+		if got := matchLanguage(code).String(); got != want {
+			t.Errorf("matchLanguage(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestLocalizeSize(t *testing.T) {
+	en, ru := newPrinter(language.English), newPrinter(language.Russian)
+	for _, tt := range []struct {
+		size   int64
+		en, ru string
+	}{
+		{1, "1 byte", "1 байт"},
+		{3, "3 bytes", "3 байта"},
+		{5, "5 bytes", "5 байт"},
+		{21, "21 bytes", "21 байт"},
+		{4692251770, "4.37 GB", "4,37 ГБ"},
+	} {
+		if got := localizeSize(en, tt.size); got != tt.en {
+			t.Errorf("localizeSize(en, %d) = %q, want %q", tt.size, got, tt.en)
+		}
+		if got := localizeSize(ru, tt.size); got != tt.ru {
+			t.Errorf("localizeSize(ru, %d) = %q, want %q", tt.size, got, tt.ru)
+		}
+	}
+}
+
+func TestPluralCounts(t *testing.T) {
+	ru := newPrinter(language.Russian)
+	for n, want := range map[int]string{
+		1:  "Раздача завершена для 1 торрента:",
+		2:  "Раздача завершена для 2 торрентов:",
+		11: "Раздача завершена для 11 торрентов:",
+	} {
+		if got := ru.Sprintf("Seeding finished for %d torrents:", n); got != want {
+			t.Errorf("%d torrents = %q, want %q", n, got, want)
+		}
+	}
+	en := newPrinter(language.English)
+	if got := en.Sprintf("Seeding finished for %d torrents:", 1); got != "Seeding finished for 1 torrent:" {
+		t.Errorf("1 torrent = %q", got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+var instances []*InstanceConfig
+
+// knownTopicsSize is how many topics knownTopics remembers.
+const knownTopicsSize = 10000
+
+// knownTopics remembers the latest topics seen in search results, or whose
+// forum was fetched, so that torrents can be routed by their forum when they
+// are added. The least recently seen are forgotten first.
+var knownTopics = struct {
+	sync.Mutex
+	order *list.List
+	m     map[string]*list.Element
+}{order: list.New(), m: make(map[string]*list.Element)}
+
+func rememberTopics(topics []*Topic) {
+	knownTopics.Lock()
+	defer knownTopics.Unlock()
+	for _, topic := range topics {
+		if element, ok := knownTopics.m[topic.ID]; ok {
+			element.Value = topic
+			knownTopics.order.MoveToFront(element)
+			continue
+		}
+		knownTopics.m[topic.ID] = knownTopics.order.PushFront(topic)
+	}
+	for knownTopics.order.Len() > knownTopicsSize {
+		oldest := knownTopics.order.Back()
+		knownTopics.order.Remove(oldest)
+		delete(knownTopics.m, oldest.Value.(*Topic).ID)
+	}
+}
+
+func getKnownTopic(t string) *Topic {
+	knownTopics.Lock()
+	defer knownTopics.Unlock()
+	element, ok := knownTopics.m[t]
+	if !ok {
+		return nil
+	}
+	knownTopics.order.MoveToFront(element)
+	return element.Value.(*Topic)
+}
+
+// setupInstances builds the list of Transmission instances from the config
+// file, falling back to a single instance described by the legacy
+// TRANSMISSION_RPC_* environment variables.
+func setupInstances(cfg *Config) error {
+	instances = cfg.Instances
+	if len(instances) == 0 {
+		if TRANSMISSION_RPC_HOST == "" {
+			return fmt.Errorf("no TRANSMISSION_RPC_HOST or instances provided")
+		}
+		instances = []*InstanceConfig{{
+			Name:     "default",
+			Host:     TRANSMISSION_RPC_HOST,
+			User:     TRANSMISSION_RPC_USER,
+			Password: TRANSMISSION_RPC_PASSWORD,
+		}}
+	}
+	names := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.Name == "" || strings.Contains(instance.Name, "@") {
+			return fmt.Errorf("invalid instance name %q", instance.Name)
+		}
+		if names[instance.Name] {
+			return fmt.Errorf("duplicate instance name %q", instance.Name)
+		}
+		names[instance.Name] = true
+	}
+	for _, route := range cfg.Routes {
+		if !names[route.Instance] {
+			return fmt.Errorf("route refers to unknown instance %q", route.Instance)
+		}
+		for _, size := range []string{route.MinSize, route.MaxSize} {
+			if size == "" {
+				continue
+			}
+			if _, err := parseSize(size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getInstance(name string) (*InstanceConfig, error) {
+	if name == "" {
+		return instances[0], nil
+	}
+	for _, instance := range instances {
+		if instance.Name == name {
+			return instance, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown transmission instance %q", name)
+}
+
+// torrentRef builds the callback data suffix identifying a torrent on an instance.
+func torrentRef(t string, instance string) string {
+	if instance == "" {
+		return t
+	}
+	return t + "@" + instance
+}
+
+// parseTorrentRef splits callback data built by torrentRef. Callback data
+// from older messages carries no instance and refers to the default one.
+func parseTorrentRef(ref string) (t string, instance string) {
+	i := strings.LastIndex(ref, "@")
+	if i < 0 {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// getTopicForum returns the forum of a topic, from the search results it was
+// seen in or else from its page on the tracker.
+func getTopicForum(t string) (string, error) {
+	if topic := getKnownTopic(t); topic != nil {
+		return topic.Forum, nil
+	}
+	body, err := doForumGETRequest("/viewtopic.php", url.Values{"t": []string{t}})
+	if err != nil {
+		return "", err
+	}
+	forum, err := parseTopicForum(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	rememberTopics([]*Topic{{ID: t, Forum: forum}})
+	return forum, nil
+}
+
+// routeTorrent returns the instance and download directory a torrent should
+// be added to, or a nil instance if the user has to choose one, as when the
+// forum of the topic is needed but cannot be found.
+func routeTorrent(t string, size int64) (*InstanceConfig, string) {
+	if len(instances) == 1 {
+		return instances[0], instances[0].DownloadDir
+	}
+	var forum string
+	for _, route := range config.Routes {
+		if route.Forum != "" {
+			if forum == "" {
+				var err error
+				forum, err = getTopicForum(t)
+				if err != nil {
+					log.Printf("Could not get the forum of topic %s: %v", t, err)
+					return nil, ""
+				}
+			}
+			if !strings.Contains(strings.ToLower(forum), strings.ToLower(route.Forum)) {
+				continue
+			}
+		}
+		if route.MinSize != "" {
+			minSize, _ := parseSize(route.MinSize)
+			if size < minSize {
+				continue
+			}
+		}
+		if route.MaxSize != "" {
+			maxSize, _ := parseSize(route.MaxSize)
+			if size > maxSize {
+				continue
+			}
+		}
+		instance, err := getInstance(route.Instance)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		downloadDir := route.DownloadDir
+		if downloadDir == "" {
+			downloadDir = instance.DownloadDir
+		}
+		return instance, downloadDir
+	}
+	return nil, ""
+}
+
+// getInstanceChooserMarkup offers every instance as a destination for a
+// torrent; the chosen one is appended to the action's callback data.
+func getInstanceChooserMarkup(action string, t string) *tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	for _, instance := range instances {
+		cbData := fmt.Sprintf("%s-%s", action, torrentRef(t, instance.Name))
+		row = append(row, tgbotapi.InlineKeyboardButton{
+			Text:         instance.Name,
+			CallbackData: &cbData,
+		})
+	}
+	return &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{row},
+	}
+}
+
+// getTorrentListMessage lists the torrents of every instance the user may
+// manage. Instances that cannot be reached are reported instead of failing
+// the whole list.
+func getTorrentListMessage(p *message.Printer, user *tgbotapi.User) string {
+	var userID int64
+	if user != nil {
+		userID = int64(user.ID)
+	}
+	var records map[string]TorrentRecord
+	state.view(func(s *State) {
+		records = make(map[string]TorrentRecord, len(s.Torrents))
+		for hash, record := range s.Torrents {
+			records[hash] = *record
+		}
+	})
+	var lines []string
+	for _, instance := range instances {
+		lines = append(lines, fmt.Sprintf("[%s]", instance.Name))
+		c, err := instance.client()
+		if err != nil {
+			lines = append(lines, p.Sprintf("unavailable: %s", err))
+			continue
+		}
+		torrents, err := c.Status()
+		if err != nil {
+			log.Println(err)
+			lines = append(lines, p.Sprintf("unavailable"))
+			continue
+		}
+		var visible []*TorrentInfo
+		for _, torrent := range torrents {
+			var record *TorrentRecord
+			if r, ok := records[torrent.Hash]; ok {
+				record = &r
+			}
+			if canManage(userID, record) {
+				visible = append(visible, torrent)
+			}
+		}
+		torrents = visible
+		if len(torrents) == 0 {
+			lines = append(lines, p.Sprintf("no torrents"))
+			continue
+		}
+		sort.Slice(torrents, func(i, j int) bool {
+			return torrents[i].Name < torrents[j].Name
+		})
+		for _, torrent := range torrents {
+			lines = append(lines, renderMessage(p, "status", torrent))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestKnownTopicsBounded(t *testing.T) {
+	rememberTopics([]*Topic{{ID: "first", Forum: "Фильмы"}, {ID: "second", Forum: "Музыка"}})
+	// Seeing the first topic again keeps it.
+	getKnownTopic("first")
+	var topics []*Topic
+	for i := 0; i < knownTopicsSize-1; i++ {
+		topics = append(topics, &Topic{ID: strconv.Itoa(i)})
+	}
+	rememberTopics(topics)
+	if topic := getKnownTopic("first"); topic == nil || topic.Forum != "Фильмы" {
+		t.Errorf("recently seen topic = %+v", topic)
+	}
+	if topic := getKnownTopic("second"); topic != nil {
+		t.Error("least recently seen topic still remembered")
+	}
+	knownTopics.Lock()
+	defer knownTopics.Unlock()
+	if len(knownTopics.m) != knownTopicsSize || knownTopics.order.Len() != knownTopicsSize {
+		t.Errorf("%d topics remembered, want %d", len(knownTopics.m), knownTopicsSize)
+	}
+}
@@ -6,24 +6,21 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	gtp "github.com/arkhipovkm/go-torrent-parser"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/google/uuid"
-	"github.com/hekmon/transmissionrpc"
 	"golang.org/x/net/html"
-	"golang.org/x/net/publicsuffix"
-	"golang.org/x/text/encoding/charmap"
-	"golang.org/x/text/transform"
+	"golang.org/x/text/message"
 )
 
 var BB_SESSION string = os.Getenv("BB_SESSION")
@@ -31,6 +28,8 @@ var FORUM_URL string = os.Getenv("FORUM_URL")
 var TRANSMISSION_RPC_HOST string = os.Getenv("TRANSMISSION_RPC_HOST")
 var TRANSMISSION_RPC_USER string = os.Getenv("TRANSMISSION_RPC_USER")
 var TRANSMISSION_RPC_PASSWORD string = os.Getenv("TRANSMISSION_RPC_PASSWORD")
+var FORUM_TIMEOUT time.Duration = 30 * time.Second
+var TRANSMISSION_TIMEOUT time.Duration = 10 * time.Second
 
 type Topic struct {
 	ID            string
@@ -43,10 +42,19 @@ type Topic struct {
 	Seeders       string
 	Leechers      string
 	Downloads     string
-	CreatedAt     string
-	TopicURL      string
-	TorrentURL    string
-	Content       *TopicContent
+	// SizeBytes, SeedersCount, LeechersCount and DownloadsCount are Size,
+	// Seeders, Leechers and Downloads parsed, zero when unknown.
+	SizeBytes      int64
+	SeedersCount   int
+	LeechersCount  int
+	DownloadsCount int
+	// CreatedAt is when the torrent was registered, zero when unknown.
+	CreatedAt time.Time
+	// Release is what the title tells about the release.
+	Release    *Release
+	TopicURL   string
+	TorrentURL string
+	Content    *TopicContent
 }
 
 type TopicContent struct {
@@ -70,99 +78,77 @@ type TopicContent struct {
 	Breadcrumb   string
 }
 
-func newHttpClient(uri string) (*http.Client, *url.URL, error) {
-	var err error
-	var client *http.Client
-	var _url *url.URL
-
-	_url, err = url.Parse(uri)
-	if err != nil {
-		return client, _url, err
-	}
-	cookie := http.Cookie{
-		Name:  "bb_session",
-		Value: BB_SESSION,
-	}
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-	if err != nil {
-		return client, _url, err
-	}
-	jar.SetCookies(_url, []*http.Cookie{&cookie})
-	client = &http.Client{
-		Jar: jar,
-	}
-	return client, _url, err
-}
-
 func doPOSTRequest(uri string, data url.Values) ([]byte, error) {
-	var err error
-	var body []byte
-
-	client, _url, err := newHttpClient(uri)
-	if err != nil {
-		return body, err
-	}
-	resp, err := client.PostForm(_url.String(), data)
+	req, err := http.NewRequest(http.MethodPost, uri, strings.NewReader(data.Encode()))
 	if err != nil {
-		return body, err
-	}
-
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return body, err
-	}
-	defer resp.Body.Close()
-	body, _, err = transform.Bytes(charmap.Windows1251.NewDecoder(), body)
-	if err != nil {
-		return body, err
+		return nil, err
 	}
-	return body, err
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return forumClient.do(req)
 }
 
 func doGETRequest(uri string, query url.Values) ([]byte, error) {
-	var err error
-	var body []byte
-
-	client, _url, err := newHttpClient(uri)
+	_url, err := url.Parse(uri)
 	if err != nil {
-		return body, err
+		return nil, err
 	}
 	_url.ForceQuery = true
-	resp, err := client.Get(_url.String() + query.Encode())
+	req, err := http.NewRequest(http.MethodGet, _url.String()+query.Encode(), nil)
 	if err != nil {
-		return body, err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return body, err
+	return forumClient.do(req)
+}
+
+func checkResponse(resp *http.Response, body []byte) error {
+	if isInterstitial(resp, body) {
+		return errInterstitial
 	}
-	return body, err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{StatusCode: resp.StatusCode, URL: resp.Request.URL.String()}
+	}
+	return nil
 }
 
-func getReplyMarkup(t string) *tgbotapi.InlineKeyboardMarkup {
-	startCbData := fmt.Sprintf("start-%s", t)
-	refreshCbData := fmt.Sprintf("refresh-%s", t)
-	pauseCbData := fmt.Sprintf("pause-%s", t)
-	removeCbData := fmt.Sprintf("remove-%s", t)
+func getReplyMarkup(p *message.Printer, t string, instance string) *tgbotapi.InlineKeyboardMarkup {
+	ref := torrentRef(t, instance)
+	startCbData := fmt.Sprintf("start-%s", ref)
+	refreshCbData := fmt.Sprintf("refresh-%s", ref)
+	pauseCbData := fmt.Sprintf("pause-%s", ref)
+	removeCbData := fmt.Sprintf("remove-%s", ref)
+	followCbData := fmt.Sprintf("follow-%s", ref)
+	detailsCbData := fmt.Sprintf("details-%s", ref)
+	followText := p.Sprintf("Follow")
+	if isFollowed(ref) {
+		followText = p.Sprintf("Unfollow")
+	}
 	return &tgbotapi.InlineKeyboardMarkup{
 		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
 			tgbotapi.InlineKeyboardButton{
-				Text:         "Start",
+				Text:         p.Sprintf("Start"),
 				CallbackData: &startCbData,
 			},
 			tgbotapi.InlineKeyboardButton{
-				Text:         "Refresh",
+				Text:         p.Sprintf("Refresh"),
 				CallbackData: &refreshCbData,
 			},
 			tgbotapi.InlineKeyboardButton{
-				Text:         "Pause",
+				Text:         p.Sprintf("Pause"),
 				CallbackData: &pauseCbData,
 			},
 			tgbotapi.InlineKeyboardButton{
-				Text:         "Remove",
+				Text:         p.Sprintf("Remove"),
 				CallbackData: &removeCbData,
 			},
+		}, {
+			tgbotapi.InlineKeyboardButton{
+				Text:         followText,
+				CallbackData: &followCbData,
+			},
+			tgbotapi.InlineKeyboardButton{
+				Text:         p.Sprintf("Details"),
+				CallbackData: &detailsCbData,
+			},
 		}},
 	}
 }
@@ -201,8 +187,76 @@ func parseNodeText(n *html.Node) string {
 	return strings.Join(cleanTextNodes(extractChildrenTextNodes(n)), " ")
 }
 
-func getTransmissionRpc() (*transmissionrpc.Client, error) {
-	return transmissionrpc.New(TRANSMISSION_RPC_HOST, "", "", nil)
+// resolveInstance returns the instance named in callback data, or routes a
+// torrent being added without one. A nil instance means the user must choose.
+func resolveInstance(t string, name string, chatID int64, size int64) (*InstanceConfig, string, error) {
+	if name != "" {
+		instance, err := getInstance(name)
+		if err != nil {
+			return nil, "", err
+		}
+		return instance, instance.DownloadDir, nil
+	}
+	if settings := getChatSettings(chatID); settings != nil {
+		instance, err := getInstance(settings.Instance)
+		if err != nil {
+			return nil, "", err
+		}
+		if settings.DownloadDir != "" {
+			return instance, settings.DownloadDir, nil
+		}
+		return instance, instance.DownloadDir, nil
+	}
+	instance, downloadDir := routeTorrent(t, size)
+	return instance, downloadDir, nil
+}
+
+func torrentFileSize(torrentFile *gtp.Torrent) int64 {
+	var size int64
+	for _, file := range torrentFile.Files {
+		size += file.Length
+	}
+	return size
+}
+
+// addTorrent adds the topic's torrent to the given instance, or to the one
+// chosen by the routing rules. It returns a nil instance if there is no
+// matching route and the user has to choose one. The torrent is recorded as
+// added by userID from chatID; a zero userID stands for the chat.
+func addTorrent(t string, instanceName string, chatID int64, userID int64) (*InstanceConfig, Client, *TorrentInfo, error) {
+	fileName, body, err := getTorrentFile(t)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	torrentFile, err := gtp.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	unlock := lockTorrent(torrentFile.InfoHash)
+	defer unlock()
+	size := torrentFileSize(torrentFile)
+	instance, downloadDir, err := resolveInstance(t, instanceName, chatID, size)
+	if err != nil || instance == nil {
+		return nil, nil, nil, err
+	}
+	c, err := instance.client()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	torrent, err := c.Add(fileName, downloadDir)
+	if err != nil {
+		return nil, nil, nil, clientError(err)
+	}
+	err = recordTorrent(instance, c, torrent, &TorrentRecord{
+		T:      t,
+		ChatID: chatID,
+		UserID: userID,
+		Size:   size,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return instance, c, torrent, nil
 }
 
 func getTorrentFile(t string) (string, []byte, error) {
@@ -214,11 +268,7 @@ func getTorrentFile(t string) (string, []byte, error) {
 	body, err = ioutil.ReadFile(fileName)
 	if err != nil {
 		log.Printf("Could not find torrent %s in saved torrents. Downloading from the forum..", t)
-		body, err = doGETRequest(FORUM_URL+"/dl.php", url.Values{"t": []string{t}})
-		if err != nil {
-			return fileName, body, err
-		}
-		_ = ioutil.WriteFile(fileName, body, os.ModePerm)
+		return downloadTorrentFile(t)
 	}
 	if len(body) == 0 {
 		return fileName, body, err
@@ -227,35 +277,18 @@ func getTorrentFile(t string) (string, []byte, error) {
 
 }
 
-func getTransmissionTorrentInfo(tm *transmissionrpc.Client, hash string) (string, string, float64, error) {
-	var err error
-	var torrentName string
-	var torrentStatus transmissionrpc.TorrentStatus
-	var torrentPercent float64
-	torrents, err := tm.TorrentGetHashes(
-		[]string{"id", "name", "status", "percentDone"},
-		[]string{hash},
-	)
+func getTorrentInfo(c Client, hash string) (*TorrentInfo, error) {
+	torrents, err := c.Status(hash)
 	if err != nil {
-		return torrentName, torrentStatus.String(), torrentPercent, err
+		return &TorrentInfo{}, clientError(err)
 	}
 	if len(torrents) == 0 {
-		return torrentName, torrentStatus.String(), torrentPercent, err
+		return &TorrentInfo{}, nil
 	}
-	torrent := torrents[0]
-	if torrent.Name != nil {
-		torrentName = *torrent.Name
-	}
-	if torrent.Status != nil {
-		torrentStatus = *torrent.Status
-	}
-	if torrent.PercentDone != nil {
-		torrentPercent = *torrent.PercentDone
-	}
-	return torrentName, torrentStatus.String(), torrentPercent, err
+	return torrents[0], nil
 }
 
-func getUpdatedTorrentInfoMessage(tm *transmissionrpc.Client, t string) (*tgbotapi.EditMessageTextConfig, error) {
+func getUpdatedTorrentInfoMessage(p *message.Printer, c Client, t string, instance string) (*tgbotapi.EditMessageTextConfig, error) {
 	var err error
 	_, body, err := getTorrentFile(t)
 	if err != nil {
@@ -265,13 +298,13 @@ func getUpdatedTorrentInfoMessage(tm *transmissionrpc.Client, t string) (*tgbota
 	if err != nil {
 		return nil, err
 	}
-	torrentName, torrentStatus, torrentPercent, err := getTransmissionTorrentInfo(tm, torrentFile.InfoHash)
+	torrent, err := getTorrentInfo(c, torrentFile.InfoHash)
 	msg := tgbotapi.NewEditMessageText(
 		0,
 		0,
-		fmt.Sprintf("%s: %s (%.1f%%)", torrentName, torrentStatus, torrentPercent*100),
+		renderMessage(p, "status_card", torrent),
 	)
-	msg.ReplyMarkup = getReplyMarkup(t)
+	msg.ReplyMarkup = getReplyMarkup(p, t, instance)
 	return &msg, err
 }
 
@@ -284,88 +317,86 @@ func getTopics(query string) ([]*Topic, error) {
 		"o":  {"7"},
 		"s":  {"2"},
 	}
-	body, err := doPOSTRequest(FORUM_URL+"/tracker.php", form)
+	body, err := doForumPOSTRequest("/tracker.php", form)
 	if err != nil {
 		return nil, err
 	}
-	doc, err := html.Parse(bytes.NewReader(body))
+	topics, err = parseTopics(bytes.NewReader(body))
 	if err != nil {
-		return topics, err
+		return nil, err
 	}
+	rememberTopics(topics)
+	return topics, nil
+}
 
-	var currentTopic *Topic
+// localizeTopicSize renders the size of a topic in the user's language, or
+// as the tracker shows it if it cannot be parsed.
+func localizeTopicSize(p *message.Printer, topic *Topic) string {
+	if topic.SizeBytes == 0 {
+		return topic.Size
+	}
+	return localizeSize(p, topic.SizeBytes)
+}
 
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "tr" {
-			for _, attr := range n.Attr {
-				if attr.Key == "id" && strings.Contains(attr.Val, "trs-tr-") {
-					_id := strings.Split(attr.Val, "trs-tr-")
-					currentTopic = &Topic{
-						ID: _id[1],
-					}
-					topics = append(topics, currentTopic)
-				}
-			}
-		}
-		if n.Type == html.ElementNode && n.Data == "td" {
-			for _, attr := range n.Attr {
-				if attr.Key == "class" && strings.Contains(attr.Val, "f-name-col") {
-					currentTopic.Forum = parseNodeText(n)
-				}
-				if attr.Key == "class" && strings.Contains(attr.Val, "t-title-col") {
-					currentTopic.TitleSections = cleanTextNodes(extractChildrenTextNodes(n))
-					currentTopic.Title = parseNodeText(n)
-				}
-				if attr.Key == "class" && strings.Contains(attr.Val, "u-name-col") {
-					currentTopic.Author = parseNodeText(n)
-				}
-				if attr.Key == "class" && strings.Contains(attr.Val, "tor-size") {
-					currentTopic.Size = parseNodeText(n)
-					currentTopic.Size = strings.ReplaceAll(currentTopic.Size, " ↓", "")
-				}
-				if attr.Key == "class" && strings.Contains(attr.Val, "row4 leechmed bold") {
-					currentTopic.Leechers = parseNodeText(n)
-				}
-				if attr.Key == "class" && strings.Contains(attr.Val, "row4 small number-format") {
-					currentTopic.Downloads = parseNodeText(n)
-				}
-				if attr.Key == "data-ts_text" {
-					currentTopic.CreatedAt = parseNodeText(n)
-				}
-			}
-		}
-		if n.Type == html.ElementNode && n.Data == "b" {
-			for _, attr := range n.Attr {
-				if attr.Key == "class" && strings.Contains(attr.Val, "seedmed") {
-					currentTopic.Seeders = n.FirstChild.Data
-				}
-			}
-		}
-		if n.Type == html.ElementNode && n.Data == "span" {
-			for _, attr := range n.Attr {
-				if attr.Key == "class" && strings.Contains(attr.Val, "tor-icon tor-") {
-					currentTopic.Verified = n.FirstChild.Data
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+func getTopicText(p *message.Printer, topic *Topic) string {
+	return forumMirrors.rewrite(renderMessage(p, "topic", topic))
+}
+
+func getTopicReplyMarkup(p *message.Printer, topic *Topic) *tgbotapi.InlineKeyboardMarkup {
+	downloadCbData := fmt.Sprintf("init-%s", topic.ID)
+	topicURL := forumMirrors.current() + "/viewtopic.php?t=" + topic.ID
+	return &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+			tgbotapi.InlineKeyboardButton{
+				Text:         p.Sprintf("Download"),
+				CallbackData: &downloadCbData,
+			},
+			tgbotapi.InlineKeyboardButton{
+				Text: p.Sprintf("View topic"),
+				URL:  &topicURL,
+			},
+		}},
 	}
-	f(doc)
-	return topics, err
 }
 
-func getSectionInlineResults(query string, offset int) (results []interface{}, nextOffset string, err error) {
+// getSectionInlineResults searches the tracker for an inline query. With a
+// quality profile, the results are ranked: the best match comes first,
+// marked with a star, and the other releases of a work follow its best one,
+// marked with an arrow.
+func getSectionInlineResults(p *message.Printer, query string, offset int, profile *QualityProfile) (results []interface{}, nextOffset string, err error) {
 	nextOffset = strconv.Itoa(offset + 50)
-	topics, err := getTopics(query)
+	topics, err := searchTopics(query)
 	if err != nil {
 		return results, nextOffset, err
 	}
+	titles := make(map[*Topic]string, len(topics))
+	if profile != nil {
+		var ranked []*Topic
+		for i, group := range rankTopics(topics, profile) {
+			for j, topic := range group {
+				switch {
+				case i == 0 && j == 0:
+					titles[topic] = "★ " + topic.Title
+				case j > 0:
+					titles[topic] = "↳ " + topic.Title
+				}
+				ranked = append(ranked, topic)
+			}
+		}
+		topics = ranked
+	}
 	for _, topic := range topics {
+		title, ok := titles[topic]
+		if !ok {
+			title = topic.Title
+		}
 
-		var description string = topic.Size
+		var description string = localizeTopicSize(p, topic)
+		if topic.Release != nil {
+			if summary := topic.Release.Summary(); summary != "" {
+				description = summary + " : " + description
+			}
+		}
 		if topic.Seeders != "" {
 			description += " : " + topic.Seeders
 		}
@@ -373,441 +404,129 @@ func getSectionInlineResults(query string, offset int) (results []interface{}, n
 			description += " : " + topic.Verified
 		}
 
-		text := fmt.Sprintf("<b>%s</b>\n", topic.Title) + fmt.Sprintf("Size: %s\nSeeders: %s\nDownloads: %s", topic.Size, topic.Seeders, topic.Downloads) + "\n" //+ topic.Content.Breadcrumb + coverSuffix
 		inputMessageContent := &tgbotapi.InputTextMessageContent{
-			Text:                  text,
+			Text:                  getTopicText(p, topic),
 			ParseMode:             "HTML",
 			DisableWebPagePreview: false,
 		}
 
-		downloadCbData := fmt.Sprintf("init-%s", topic.ID)
-		topicURL := FORUM_URL + "/viewtopic.php?t=" + topic.ID
+		replyMarkup := getTopicReplyMarkup(p, topic)
+		replyMarkup.InlineKeyboard[0] = append(replyMarkup.InlineKeyboard[0], tgbotapi.InlineKeyboardButton{
+			Text:                         p.Sprintf("Back"),
+			SwitchInlineQueryCurrentChat: &query,
+		})
 		results = append(results, &tgbotapi.InlineQueryResultArticle{
 			Type:                "article",
 			ID:                  uuid.New().String(),
-			Title:               topic.Title,
+			Title:               title,
 			Description:         description,
 			InputMessageContent: inputMessageContent,
 			HideURL:             true,
-			ReplyMarkup: &tgbotapi.InlineKeyboardMarkup{
-				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
-					tgbotapi.InlineKeyboardButton{
-						Text:         "Download",
-						CallbackData: &downloadCbData,
-					},
-					tgbotapi.InlineKeyboardButton{
-						Text: "View topic",
-						URL:  &topicURL,
-					},
-					tgbotapi.InlineKeyboardButton{
-						Text:                         "Back",
-						SwitchInlineQueryCurrentChat: &query,
-					},
-				}},
-			},
+			ReplyMarkup:         replyMarkup,
 		})
 	}
 	log.Printf("Got %d results from tracker..\n", len(results))
 	return results, nextOffset, err
 }
 
-func process(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel) {
+func process(bot *tgbotapi.BotAPI, updates <-chan *incomingUpdate) {
 	for update := range updates {
-		if update.Message != nil && update.Message.Text != "" {
-			uri, err := url.ParseRequestURI(update.Message.Text)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			query := uri.Query()
-			t := query.Get("t")
-			if t == "" {
-				continue
-			}
-			_, body, err := getTorrentFile(t)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			torrentFile, err := gtp.Parse(bytes.NewReader(body))
-			if err != nil {
-				log.Println(err)
-			}
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf(
-				"%s: ready to start", torrentFile.Info.Name,
-			))
-			msg.ReplyToMessageID = update.Message.MessageID
-			startCbData := fmt.Sprintf("start-%s", t)
-			msg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
-				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
-					tgbotapi.InlineKeyboardButton{
-						Text:         "Start",
-						CallbackData: &startCbData,
-					},
-				}},
-			}
-			bot.Send(msg)
-		} else if update.CallbackQuery != nil {
-			var chatID int64
-			if update.CallbackQuery.Message != nil &&
-				update.CallbackQuery.Message.Chat != nil &&
-				update.CallbackQuery.Message.Chat.ID != 0 {
-				chatID = update.CallbackQuery.Message.Chat.ID
-			} else if update.CallbackQuery.From != nil {
-				chatID = int64(update.CallbackQuery.From.ID)
-			} else {
-				continue
-			}
-			var re *regexp.Regexp
-			re = regexp.MustCompile("^start-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				tm, err := getTransmissionRpc()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				fileName, _, err := getTorrentFile(t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrent, err := tm.TorrentAddFile(fileName)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				tm.TorrentStartIDs([]int64{*torrent.ID})
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						fmt.Sprintf("Started torrent: %s", *torrent.Name),
-					),
-				)
-				if err != nil {
-					log.Println(err)
-				}
-
-				msg, err := getUpdatedTorrentInfoMessage(tm, t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg.ChatID = chatID
-				msg.MessageID = update.CallbackQuery.Message.MessageID
-				_, err = bot.Send(msg)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-			re = regexp.MustCompile("^pause-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				tm, err := getTransmissionRpc()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				_, body, err := getTorrentFile(t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrentFile, err := gtp.Parse(bytes.NewReader(body))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				err = tm.TorrentStopHashes([]string{torrentFile.InfoHash})
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						fmt.Sprintf("Stopped torrent: %s", torrentFile.Info.Name),
-					),
-				)
-				if err != nil {
-					log.Println(err)
-				}
-
-				msg, err := getUpdatedTorrentInfoMessage(tm, t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg.ChatID = chatID
-				msg.MessageID = update.CallbackQuery.Message.MessageID
-				_, err = bot.Send(msg)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-			re = regexp.MustCompile("^refresh-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				tm, err := getTransmissionRpc()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg, err := getUpdatedTorrentInfoMessage(tm, t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg.ChatID = chatID
-				msg.MessageID = update.CallbackQuery.Message.MessageID
-				bot.Send(msg)
-
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						"",
-					),
-				)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-			re = regexp.MustCompile("^remove-yes-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				tm, err := getTransmissionRpc()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				_, body, err := getTorrentFile(t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrentFile, err := gtp.Parse(bytes.NewReader(body))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrents, err := tm.TorrentGetHashes(
-					[]string{"id"},
-					[]string{torrentFile.InfoHash},
-				)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				if len(torrents) < 1 {
-					continue
-				}
-				torrent := torrents[0]
-				err = tm.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
-					IDs:             []int64{*torrent.ID},
-					DeleteLocalData: true,
-				})
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						fmt.Sprintf("Removed torrent: %s", torrentFile.Info.Name),
-					),
-				)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg := tgbotapi.NewEditMessageText(
-					chatID,
-					update.CallbackQuery.Message.MessageID,
-					fmt.Sprintf("%s: removed", torrentFile.Info.Name),
-				)
-				startCbData := fmt.Sprintf("start-%s", t)
-				msg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
-					InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
-						tgbotapi.InlineKeyboardButton{
-							Text:         "Restart",
-							CallbackData: &startCbData,
-						},
-					}},
-				}
-				_, err = bot.Send(&msg)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				continue
-			}
-			re = regexp.MustCompile("^remove-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				_, body, err := getTorrentFile(t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrentFile, err := gtp.Parse(bytes.NewReader(body))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg := tgbotapi.NewEditMessageText(
-					chatID,
-					update.CallbackQuery.Message.MessageID,
-					fmt.Sprintf("Are you sure you want to remove torrent \"%s\" and all its contents?", torrentFile.Info.Name),
-				)
-				removeYesCbData := fmt.Sprintf("remove-yes-%s", t)
-				removeNoCbData := fmt.Sprintf("refresh-%s", t)
-				msg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
-					InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
-						tgbotapi.InlineKeyboardButton{
-							Text:         "Yes",
-							CallbackData: &removeYesCbData,
-						},
-						tgbotapi.InlineKeyboardButton{
-							Text:         "No",
-							CallbackData: &removeNoCbData,
-						},
-					}},
-				}
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				bot.Send(msg)
-
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						"",
-					),
-				)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-			re = regexp.MustCompile("^init-(.*?)$")
-			if re.MatchString(update.CallbackQuery.Data) {
-				parts := re.FindStringSubmatch(update.CallbackQuery.Data)
-				if len(parts) < 2 {
-					log.Println("Invalid callback query regexp match.")
-				}
-				t := parts[1]
-				tm, err := getTransmissionRpc()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				fileName, _, err := getTorrentFile(t)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				torrent, err := tm.TorrentAddFile(fileName)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				tm.TorrentStartIDs([]int64{*torrent.ID})
+		handleUpdate(bot, update)
+	}
+}
 
-				torrentName, torrentStatus, torrentPercent, err := getTransmissionTorrentInfo(tm, *torrent.HashString)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				msg := tgbotapi.NewMessage(
-					chatID,
-					fmt.Sprintf("%s: %s (%.1f%%)", torrentName, torrentStatus, torrentPercent*100),
-				)
-				msg.ChatID = chatID
-				msg.ReplyMarkup = getReplyMarkup(t)
-
-				_, err = bot.Send(msg)
-				if err != nil {
-					log.Println(err)
-				}
-				_, err = bot.AnswerCallbackQuery(
-					tgbotapi.NewCallback(
-						update.CallbackQuery.ID,
-						fmt.Sprintf("Started downloading torrent: %s", *torrent.Name),
-					),
-				)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		} else if update.InlineQuery != nil {
-			log.Println("Got an inline query", update.InlineQuery.Query)
-			inlineQueryAnswer := tgbotapi.InlineConfig{
-				InlineQueryID: update.InlineQuery.ID,
-				CacheTime:     0,
-				IsPersonal:    false,
-			}
-			if update.InlineQuery.Query == "" || update.InlineQuery.Query == " " {
-				inlineQueryAnswer.CacheTime = 0
-				_, err := bot.AnswerInlineQuery(inlineQueryAnswer)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-			} else {
-				var offset int
-				var err error
-				if update.InlineQuery.Offset != "" {
-					offset, _ = strconv.Atoi(update.InlineQuery.Offset)
-				}
-				inlineQueryAnswer.Results, _, err = getSectionInlineResults(update.InlineQuery.Query, offset)
-				if err != nil {
-					log.Println(err)
-				}
-				log.Println("Sending Inline Answer..")
-				bot.AnswerInlineQuery(inlineQueryAnswer)
-			}
-		}
+func handleUpdate(bot *tgbotapi.BotAPI, update *incomingUpdate) {
+	if update.Message != nil && !addressedToBot(bot, update.Message) {
+		return
+	}
+	if update.Message != nil && update.Message.IsCommand() {
+		handleCommand(bot, update.Message, update.ThreadID)
+	} else if update.Message != nil && update.Message.Text != "" {
+		handleMessage(bot, update.Message, update.ThreadID)
+	} else if update.CallbackQuery != nil {
+		handleCallback(bot, update.CallbackQuery)
+	} else if update.InlineQuery != nil {
+		handleInlineQuery(bot, update.InlineQuery)
 	}
 }
 
 func main() {
+	var err error
 	FORUM_URL = os.Getenv("FORUM_URL")
 	if FORUM_URL == "" {
 		panic("No Forum URL provided")
 	}
+	forumMirrors = newMirrorSet(parseMirrorList(FORUM_URL))
+	if forumRetries := os.Getenv("FORUM_RETRIES"); forumRetries != "" {
+		FORUM_RETRIES, err = strconv.Atoi(forumRetries)
+		if err != nil || FORUM_RETRIES < 1 {
+			panic("Invalid FORUM_RETRIES provided")
+		}
+	}
+	if forumTimeout := os.Getenv("FORUM_TIMEOUT"); forumTimeout != "" {
+		FORUM_TIMEOUT, err = time.ParseDuration(forumTimeout)
+		if err != nil {
+			panic(err)
+		}
+	}
 	BB_SESSION = os.Getenv("BB_SESSION")
 	if BB_SESSION == "" {
 		panic("No BB SESSION cookie provided")
 	}
+	if searchMinLength := os.Getenv("SEARCH_MIN_LENGTH"); searchMinLength != "" {
+		SEARCH_MIN_LENGTH, err = strconv.Atoi(searchMinLength)
+		if err != nil || SEARCH_MIN_LENGTH < 0 {
+			panic("Invalid SEARCH_MIN_LENGTH provided")
+		}
+	}
+	if searchCacheTTL := os.Getenv("SEARCH_CACHE_TTL"); searchCacheTTL != "" {
+		SEARCH_CACHE_TTL, err = time.ParseDuration(searchCacheTTL)
+		if err != nil {
+			panic(err)
+		}
+		searches = newSearchCache(searchCacheSize, SEARCH_CACHE_TTL)
+	}
+	if cookieFile := os.Getenv("COOKIE_FILE"); cookieFile != "" {
+		COOKIE_FILE = cookieFile
+	}
+	if userAgent := os.Getenv("FORUM_USER_AGENT"); userAgent != "" {
+		FORUM_USER_AGENT = userAgent
+	}
+	forumClient, err = newTrackerClient(parseMirrorList(FORUM_URL), BB_SESSION, COOKIE_FILE)
+	if err != nil {
+		panic(err)
+	}
 	TRANSMISSION_RPC_HOST = os.Getenv("TRANSMISSION_RPC_HOST")
-	if TRANSMISSION_RPC_HOST == "" {
-		panic("No TRANSMISSION_RPC_HOST provided")
+	TRANSMISSION_RPC_USER = os.Getenv("TRANSMISSION_RPC_USER")
+	TRANSMISSION_RPC_PASSWORD = os.Getenv("TRANSMISSION_RPC_PASSWORD")
+	if transmissionTimeout := os.Getenv("TRANSMISSION_TIMEOUT"); transmissionTimeout != "" {
+		TRANSMISSION_TIMEOUT, err = time.ParseDuration(transmissionTimeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	CONFIG_FILE = os.Getenv("CONFIG_FILE")
+	if CONFIG_FILE != "" {
+		config, err = loadConfig(CONFIG_FILE)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = setupInstances(config)
+	if err != nil {
+		panic(err)
+	}
+	err = setupTemplates(config)
+	if err != nil {
+		panic(err)
+	}
+	err = validateQuotas(config)
+	if err != nil {
+		panic(err)
+	}
+	err = validateQualityProfiles(config)
+	if err != nil {
+		panic(err)
 	}
 
 	telegramBotApiToken := os.Getenv("TELEGRAM_BOT_API_TOKEN")
@@ -817,6 +536,38 @@ func main() {
 
 	os.Mkdir("torrents", os.ModePerm)
 
+	if stateFile := os.Getenv("STATE_FILE"); stateFile != "" {
+		STATE_FILE = stateFile
+	}
+	state, err = loadState(STATE_FILE)
+	if err != nil {
+		panic(err)
+	}
+	if followInterval := os.Getenv("FOLLOW_INTERVAL"); followInterval != "" {
+		FOLLOW_INTERVAL, err = time.ParseDuration(followInterval)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if watchInterval := os.Getenv("WATCH_INTERVAL"); watchInterval != "" {
+		WATCH_INTERVAL, err = time.ParseDuration(watchInterval)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if reapInterval := os.Getenv("REAP_INTERVAL"); reapInterval != "" {
+		REAP_INTERVAL, err = time.ParseDuration(reapInterval)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if monitorInterval := os.Getenv("MONITOR_INTERVAL"); monitorInterval != "" {
+		MONITOR_INTERVAL, err = time.ParseDuration(monitorInterval)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	bot, err := tgbotapi.NewBotAPI(telegramBotApiToken)
 	if err != nil {
 		log.Panic(err)
@@ -830,24 +581,41 @@ func main() {
 	bot.Debug = debug
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
-	var updates tgbotapi.UpdatesChannel
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		// Serves the expvar variables, like outbox_depth, on /debug/vars.
+		go func() {
+			log.Println(http.ListenAndServe(metricsAddr, nil))
+		}()
+	}
+
+	TORZNAB_API_KEY = os.Getenv("TORZNAB_API_KEY")
+	if torznabAddr := os.Getenv("TORZNAB_ADDR"); torznabAddr != "" {
+		go serveTorznab(torznabAddr)
+	}
 
 	_, err = bot.RemoveWebhook()
 	if err != nil {
 		panic(err)
 	}
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates, err = bot.GetUpdatesChan(u)
+	// On SIGINT or SIGTERM, the bot stops receiving updates, finishes
+	// handling those received and saves the state before exiting.
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Received %s, stopping..", <-signals)
+		close(stop)
+	}()
+	updates := receiveUpdates(bot, 60, stop)
+
+	go runFollower(bot)
+	go runWatcher(bot)
+	go runReaper(bot)
+	go runMonitor(bot)
+
+	dispatch(bot, updates, runtime.NumCPU()+2)
+	err = state.flush()
 	if err != nil {
-		panic(err)
-	}
-
-	for w := 0; w < runtime.NumCPU()+2; w++ {
-		go process(bot, updates)
-	}
-
-	for {
-		time.Sleep(1 * time.Second)
+		log.Println(err)
 	}
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorBaseCooldown = 30 * time.Second
+	mirrorMaxCooldown  = 30 * time.Minute
+	retryBaseDelay     = 500 * time.Millisecond
+	retryMaxDelay      = 8 * time.Second
+)
+
+// FORUM_RETRIES is the number of attempts made for a single tracker request
+// across all mirrors before giving up.
+var FORUM_RETRIES int = 4
+
+var forumMirrors *mirrorSet
+
+// httpStatusError is returned by the request helpers when the tracker
+// answers with a non-2xx status code.
+type httpStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.URL, e.StatusCode)
+}
+
+// errInterstitial is returned when the tracker (or a proxy in front of it)
+// answers with an anti-bot challenge page instead of the requested content.
+var errInterstitial = errors.New("tracker returned an anti-bot interstitial page")
+
+var interstitialMarkers = [][]byte{
+	[]byte("cf-browser-verification"),
+	[]byte("challenge-platform"),
+	[]byte("<title>Just a moment...</title>"),
+	[]byte("DDoS-Guard"),
+}
+
+func isInterstitial(resp *http.Response, body []byte) bool {
+	if resp.Header.Get("cf-mitigated") != "" {
+		return true
+	}
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusOK {
+		return false
+	}
+	for _, marker := range interstitialMarkers {
+		if bytes.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient reports whether a failed tracker request is worth retrying,
+// possibly on another mirror.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errInterstitial) {
+		return true
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0),
+// growing exponentially and randomized with full jitter.
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+type mirror struct {
+	base          string
+	failures      int
+	cooldownUntil time.Time
+	latency       time.Duration
+}
+
+// mirrorSet holds the base URLs of a single tracker and tracks their health,
+// so that requests go to the mirror that has been answering best recently.
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+}
+
+func newMirrorSet(bases []string) *mirrorSet {
+	ms := &mirrorSet{}
+	for _, base := range bases {
+		base = strings.TrimRight(strings.TrimSpace(base), "/")
+		if base == "" {
+			continue
+		}
+		ms.mirrors = append(ms.mirrors, &mirror{base: base})
+	}
+	return ms
+}
+
+// parseMirrorList splits a comma-separated list of tracker base URLs.
+func parseMirrorList(s string) []string {
+	var bases []string
+	for _, base := range strings.Split(s, ",") {
+		base = strings.TrimRight(strings.TrimSpace(base), "/")
+		if base != "" {
+			bases = append(bases, base)
+		}
+	}
+	return bases
+}
+
+// pick returns the healthiest mirror: among the ones not cooling down after
+// a failure, the one with the fewest failures and the lowest latency, in
+// configuration order otherwise. When every mirror is cooling down, the one
+// that recovers first is returned.
+func (ms *mirrorSet) pick() *mirror {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	var best *mirror
+	for _, m := range ms.mirrors {
+		if now.Before(m.cooldownUntil) {
+			continue
+		}
+		if best == nil ||
+			m.failures < best.failures ||
+			(m.failures == best.failures && m.latency != 0 && best.latency != 0 && m.latency < best.latency) {
+			best = m
+		}
+	}
+	if best != nil {
+		return best
+	}
+	for _, m := range ms.mirrors {
+		if best == nil || m.cooldownUntil.Before(best.cooldownUntil) {
+			best = m
+		}
+	}
+	return best
+}
+
+// current returns the base URL of the mirror that would serve the next request.
+func (ms *mirrorSet) current() string {
+	m := ms.pick()
+	if m == nil {
+		return ""
+	}
+	return m.base
+}
+
+func (ms *mirrorSet) markSuccess(m *mirror, latency time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.failures = 0
+	m.cooldownUntil = time.Time{}
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = (m.latency*7 + latency) / 8
+	}
+}
+
+func (ms *mirrorSet) markFailure(m *mirror) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.failures++
+	cooldown := mirrorBaseCooldown << uint(m.failures-1)
+	if cooldown <= 0 || cooldown > mirrorMaxCooldown {
+		cooldown = mirrorMaxCooldown
+	}
+	m.cooldownUntil = time.Now().Add(cooldown)
+}
+
+// rewrite replaces links to any known mirror in s with the current one.
+func (ms *mirrorSet) rewrite(s string) string {
+	current := ms.current()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, m := range ms.mirrors {
+		if m.base != current {
+			s = strings.ReplaceAll(s, m.base, current)
+		}
+	}
+	return s
+}
+
+// do runs fn against the healthiest mirror, retrying transient failures
+// with exponential backoff and switching mirrors as they fail.
+func (ms *mirrorSet) do(fn func(base string) ([]byte, error)) ([]byte, error) {
+	var body []byte
+	var err error
+	for attempt := 0; attempt < FORUM_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt - 1))
+		}
+		m := ms.pick()
+		if m == nil {
+			return body, errors.New("no tracker mirrors configured")
+		}
+		start := time.Now()
+		body, err = fn(m.base)
+		if err == nil {
+			ms.markSuccess(m, time.Since(start))
+			return body, err
+		}
+		if !isTransient(err) {
+			return body, err
+		}
+		ms.markFailure(m)
+		log.Printf("Tracker mirror %s failed (attempt %d/%d): %v", m.base, attempt+1, FORUM_RETRIES, err)
+	}
+	return body, withKind(errTrackerUnavailable, err)
+}
+
+func doForumGETRequest(path string, query url.Values) ([]byte, error) {
+	return forumMirrors.do(func(base string) ([]byte, error) {
+		return doGETRequest(base+path, query)
+	})
+}
+
+func doForumPOSTRequest(path string, data url.Values) ([]byte, error) {
+	return forumMirrors.do(func(base string) ([]byte, error) {
+		return doPOSTRequest(base+path, data)
+	})
+}
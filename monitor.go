@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// MONITOR_INTERVAL is how often torrents are checked for stalls and errors.
+var MONITOR_INTERVAL time.Duration = 30 * time.Minute
+
+// defaultStallTime is how long a download may go without progress before
+// it is reported, unless the config says otherwise.
+const defaultStallTime = 24 * time.Hour
+
+// Problems found by the monitor.
+const (
+	problemStalled  = "stalled"
+	problemError    = "error"
+	problemTrackers = "trackers"
+)
+
+// StallRecord tracks the progress of an incomplete torrent and the problem
+// last reported about it, so that each problem is reported once.
+type StallRecord struct {
+	PercentDone float64   `json:"percent_done"`
+	ProgressAt  time.Time `json:"progress_at"`
+	Problem     string    `json:"problem,omitempty"`
+	// Retried is set once the problem was remedied automatically.
+	Retried bool `json:"retried,omitempty"`
+}
+
+// stallAlert is a problem to report about a torrent.
+type stallAlert struct {
+	instance *InstanceConfig
+	torrent  *TorrentInfo
+	record   *TorrentRecord
+	problem  string
+	stall    StallRecord
+}
+
+// stallView is the data of the stalled template.
+type stallView struct {
+	Torrent    *TorrentInfo
+	Problem    string
+	StalledFor time.Duration
+	Retried    bool
+}
+
+func monitorConfig() *MonitorConfig {
+	if config.Monitor != nil {
+		return config.Monitor
+	}
+	return &MonitorConfig{}
+}
+
+func (cfg *MonitorConfig) stallTime() time.Duration {
+	if cfg.StallTime > 0 {
+		return time.Duration(cfg.StallTime)
+	}
+	return defaultStallTime
+}
+
+// torrentProblem returns what is wrong with a torrent, if anything. Only
+// downloading torrents can stall: the time spent queued, checking or
+// paused does not count.
+func torrentProblem(torrent *TorrentInfo, stall *StallRecord, stallTime time.Duration, now time.Time) string {
+	switch {
+	case torrent.Error != "":
+		return problemError
+	case torrent.TrackersFailing:
+		return problemTrackers
+	case torrent.Status == "downloading" && now.Sub(stall.ProgressAt) >= stallTime:
+		return problemStalled
+	default:
+		return ""
+	}
+}
+
+// remedyTorrent retries a torrent in trouble: errored torrents have their
+// data verified, the others are reannounced. With refetch set, the topic's
+// .torrent is downloaded again in case it was re-registered.
+func remedyTorrent(instance *InstanceConfig, c Client, torrent *TorrentInfo, record *TorrentRecord, problem string, refetch bool) error {
+	if refetch && record != nil {
+		replaced, err := replaceTorrent(c, record.T, torrent.Hash)
+		if err != nil {
+			return err
+		}
+		if replaced != nil {
+			log.Printf("Replaced stalled torrent %s with a fresh one from topic %s", torrent.Name, record.T)
+			return nil
+		}
+	}
+	repairer, ok := c.(torrentRepairer)
+	if !ok {
+		return fmt.Errorf("instance %s cannot repair torrents", instance.Name)
+	}
+	if problem == problemError {
+		return repairer.Verify(torrent.Hash)
+	}
+	return repairer.Reannounce(torrent.Hash)
+}
+
+// monitorInstance checks the torrents of an instance and returns the new
+// problems to report. Unless already tried, problems are first remedied
+// automatically when the config allows it. The stall records of the
+// torrents are set in stalls, to nil for those that cannot stall.
+func monitorInstance(instance *InstanceConfig, stalls map[string]*StallRecord) ([]*stallAlert, error) {
+	c, err := instance.client()
+	if err != nil {
+		return nil, err
+	}
+	torrents, err := c.Status()
+	if err != nil {
+		return nil, err
+	}
+	cfg := monitorConfig()
+	now := time.Now()
+	var alerts []*stallAlert
+	for _, torrent := range torrents {
+		var stall StallRecord
+		var record *TorrentRecord
+		var known bool
+		state.view(func(s *State) {
+			if r, ok := s.Stalls[torrent.Hash]; ok {
+				stall, known = *r, true
+			}
+			if r, ok := s.Torrents[torrent.Hash]; ok {
+				copied := *r
+				record = &copied
+			}
+		})
+		// Transmission stops the torrents it has a local error with.
+		if torrent.Error == "" && (torrent.Status == "stopped" || torrent.PercentDone >= 1) {
+			stalls[torrent.Hash] = nil
+			continue
+		}
+		if !known || torrent.PercentDone > stall.PercentDone || torrent.Status != "downloading" {
+			stall.PercentDone = torrent.PercentDone
+			stall.ProgressAt = now
+		}
+		problem := torrentProblem(torrent, &stall, cfg.stallTime(), now)
+		switch {
+		case problem == "":
+			stall.Problem = ""
+			stall.Retried = false
+		case problem == stall.Problem:
+			// Already reported.
+		case cfg.AutoRetry && !stall.Retried:
+			err = remedyTorrent(instance, c, torrent, record, problem, cfg.Refetch)
+			if err != nil {
+				log.Printf("Could not retry torrent %s: %v", torrent.Name, err)
+			}
+			stall.Retried = true
+			stall.ProgressAt = now
+		default:
+			stall.Problem = problem
+			alerts = append(alerts, &stallAlert{
+				instance: instance,
+				torrent:  torrent,
+				record:   record,
+				problem:  problem,
+				stall:    stall,
+			})
+		}
+		copied := stall
+		stalls[torrent.Hash] = &copied
+	}
+	return alerts, nil
+}
+
+// sendStallAlert reports a problem to the chat that added the torrent, or
+// to the admins for torrents added outside of the bot.
+func sendStallAlert(bot *tgbotapi.BotAPI, alert *stallAlert) {
+	view := &stallView{
+		Torrent:    alert.torrent,
+		Problem:    alert.problem,
+		StalledFor: time.Since(alert.stall.ProgressAt).Truncate(time.Minute),
+		Retried:    alert.stall.Retried,
+	}
+	chatIDs := config.Admins
+	if alert.record != nil && alert.record.ChatID != 0 {
+		chatIDs = []int64{alert.record.ChatID}
+	}
+	for _, chatID := range chatIDs {
+		p := chatPrinter(chatID)
+		text := renderMessage(p, "stalled", view)
+		if alert.record == nil {
+			text = fmt.Sprintf("[%s] %s", alert.instance.Name, text)
+		}
+		msg := tgbotapi.NewMessage(chatID, text)
+		if alert.record != nil {
+			ref := torrentRef(alert.record.T, alert.instance.Name)
+			reannounceCbData := fmt.Sprintf("reannounce-%s", ref)
+			verifyCbData := fmt.Sprintf("verify-%s", ref)
+			removeCbData := fmt.Sprintf("remove-%s", ref)
+			msg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
+				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{{
+					tgbotapi.InlineKeyboardButton{
+						Text:         p.Sprintf("Reannounce"),
+						CallbackData: &reannounceCbData,
+					},
+					tgbotapi.InlineKeyboardButton{
+						Text:         p.Sprintf("Verify"),
+						CallbackData: &verifyCbData,
+					},
+					tgbotapi.InlineKeyboardButton{
+						Text:         p.Sprintf("Remove"),
+						CallbackData: &removeCbData,
+					},
+				}},
+			}
+		}
+		_, err := send(bot, msg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// monitorTorrents checks every instance and reports the new problems. The
+// stall records are saved at once at the end of the pass.
+func monitorTorrents(bot *tgbotapi.BotAPI) {
+	stalls := make(map[string]*StallRecord)
+	complete := true
+	for _, instance := range instances {
+		alerts, err := monitorInstance(instance, stalls)
+		if err != nil {
+			log.Printf("Could not monitor torrents on %s: %v", instance.Name, err)
+			complete = false
+			continue
+		}
+		for _, alert := range alerts {
+			sendStallAlert(bot, alert)
+		}
+	}
+	err := state.update(func(s *State) {
+		for hash, stall := range stalls {
+			if stall == nil {
+				delete(s.Stalls, hash)
+			} else {
+				s.Stalls[hash] = stall
+			}
+		}
+		if !complete {
+			return
+		}
+		// Forget the torrents removed from every instance.
+		for hash := range s.Stalls {
+			if _, ok := stalls[hash]; !ok {
+				delete(s.Stalls, hash)
+			}
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func runMonitor(bot *tgbotapi.BotAPI) {
+	ticker := time.NewTicker(MONITOR_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		monitorTorrents(bot)
+	}
+}
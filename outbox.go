@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Telegram allows bots about 30 messages per second overall.
+const outboxInterval = time.Second / 30
+
+// maxOutboxAttempts is how many times a message is tried when Telegram
+// asks to slow down.
+const maxOutboxAttempts = 5
+
+var outgoing = newOutbox()
+
+var outboxRetries = expvar.NewInt("outbox_retries")
+
+func init() {
+	expvar.Publish("outbox_depth", expvar.Func(func() interface{} {
+		return outgoing.depth()
+	}))
+}
+
+// outbox sends the bot's messages and edits one at a time per chat, spaced
+// out to stay within the flood limits. Edits of a message still waiting are
+// coalesced into the latest one.
+type outbox struct {
+	mu      sync.Mutex
+	queues  map[string][]*outboxItem
+	pending int
+	// last is when the latest request was sent, guarded by throttleMu.
+	throttleMu sync.Mutex
+	last       time.Time
+	sleep      func(time.Duration)
+}
+
+type outboxItem struct {
+	// edit identifies the edited message, if any.
+	edit    string
+	send    func() (tgbotapi.Message, error)
+	waiters []chan outboxResult
+}
+
+type outboxResult struct {
+	message tgbotapi.Message
+	err     error
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		queues: make(map[string][]*outboxItem),
+		sleep:  time.Sleep,
+	}
+}
+
+// depth returns the number of messages waiting to be sent.
+func (o *outbox) depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending
+}
+
+// enqueue queues send in the queue of chat and waits for its result. A
+// queued edit with the same non-empty edit key is replaced by this one.
+func (o *outbox) enqueue(chat string, edit string, send func() (tgbotapi.Message, error)) (tgbotapi.Message, error) {
+	done := make(chan outboxResult, 1)
+	o.mu.Lock()
+	queue, running := o.queues[chat]
+	coalesced := false
+	if edit != "" {
+		for _, item := range queue {
+			if item.edit == edit {
+				item.send = send
+				item.waiters = append(item.waiters, done)
+				coalesced = true
+				break
+			}
+		}
+	}
+	if !coalesced {
+		o.queues[chat] = append(queue, &outboxItem{edit: edit, send: send, waiters: []chan outboxResult{done}})
+		o.pending++
+	}
+	o.mu.Unlock()
+	if !running {
+		go o.run(chat)
+	}
+	result := <-done
+	return result.message, result.err
+}
+
+// run sends the messages of a chat until its queue is empty.
+func (o *outbox) run(chat string) {
+	for {
+		o.mu.Lock()
+		queue := o.queues[chat]
+		if len(queue) == 0 {
+			delete(o.queues, chat)
+			o.mu.Unlock()
+			return
+		}
+		item := queue[0]
+		// The item stays queued while it is sent so that no goroutine
+		// is started for the chat meanwhile, but can no longer be
+		// coalesced.
+		item.edit = ""
+		o.mu.Unlock()
+
+		message, err := o.deliver(item.send)
+
+		o.mu.Lock()
+		o.queues[chat] = o.queues[chat][1:]
+		o.pending--
+		waiters := item.waiters
+		o.mu.Unlock()
+		for _, done := range waiters {
+			done <- outboxResult{message, err}
+		}
+	}
+}
+
+// deliver sends a message, waiting as long as Telegram asks when it
+// answers 429 Too Many Requests. Edits that change nothing succeed.
+func (o *outbox) deliver(send func() (tgbotapi.Message, error)) (tgbotapi.Message, error) {
+	for attempt := 1; ; attempt++ {
+		o.throttle()
+		message, err := send()
+		var apiErr tgbotapi.Error
+		switch {
+		case err == nil:
+			return message, nil
+		case strings.Contains(err.Error(), "message is not modified"):
+			return message, nil
+		case errors.As(err, &apiErr) && apiErr.RetryAfter > 0 && attempt < maxOutboxAttempts:
+			outboxRetries.Add(1)
+			log.Printf("Telegram asks to retry after %ds", apiErr.RetryAfter)
+			o.sleep(time.Duration(apiErr.RetryAfter) * time.Second)
+		default:
+			return message, err
+		}
+	}
+}
+
+// throttle spaces out the requests of every chat.
+func (o *outbox) throttle() {
+	o.throttleMu.Lock()
+	defer o.throttleMu.Unlock()
+	if wait := outboxInterval - time.Since(o.last); wait > 0 {
+		o.sleep(wait)
+	}
+	o.last = time.Now()
+}
+
+// send sends a message or an edit through the outbox.
+func send(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var chat, edit string
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		chat = strconv.FormatInt(c.ChatID, 10)
+	case tgbotapi.EditMessageTextConfig:
+		chat, edit = editKeys("text", c.BaseEdit)
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		chat, edit = editKeys("markup", c.BaseEdit)
+	}
+	return outgoing.enqueue(chat, edit, func() (tgbotapi.Message, error) {
+		return bot.Send(c)
+	})
+}
+
+// editKeys returns the queue of an edited message, the chat's or its own
+// for messages sent via inline mode, and the key its edits of a kind are
+// coalesced by.
+func editKeys(kind string, edit tgbotapi.BaseEdit) (string, string) {
+	if edit.InlineMessageID != "" {
+		return edit.InlineMessageID, kind + ":" + edit.InlineMessageID
+	}
+	chat := strconv.FormatInt(edit.ChatID, 10)
+	return chat, fmt.Sprintf("%s:%s:%d", kind, chat, edit.MessageID)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func newTestOutbox() (*outbox, *[]time.Duration) {
+	o := newOutbox()
+	var sleeps []time.Duration
+	var mu sync.Mutex
+	o.sleep = func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d >= time.Second {
+			sleeps = append(sleeps, d)
+		}
+	}
+	return o, &sleeps
+}
+
+func TestOutboxCoalescesEdits(t *testing.T) {
+	o, _ := newTestOutbox()
+	release := make(chan struct{})
+	var sent []string
+	var mu sync.Mutex
+	sender := func(text string) func() (tgbotapi.Message, error) {
+		return func() (tgbotapi.Message, error) {
+			if text == "first" {
+				<-release
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, text)
+			return tgbotapi.Message{Text: text}, nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 3)
+	enqueue := func(i int, edit string, text string) {
+		defer wg.Done()
+		message, err := o.enqueue("1", edit, sender(text))
+		if err != nil {
+			t.Error(err)
+		}
+		results[i] = message.Text
+	}
+	wg.Add(1)
+	go enqueue(0, "", "first")
+	for o.depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(2)
+	go enqueue(1, "text:1:5", "edit 1")
+	for o.depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	go enqueue(2, "text:1:5", "edit 2")
+	time.Sleep(10 * time.Millisecond)
+	if depth := o.depth(); depth != 2 {
+		t.Errorf("depth = %d, want 2", depth)
+	}
+	close(release)
+	wg.Wait()
+
+	if len(sent) != 2 || sent[0] != "first" || sent[1] != "edit 2" {
+		t.Errorf("sent = %q", sent)
+	}
+	if results[1] != "edit 2" || results[2] != "edit 2" {
+		t.Errorf("results = %q", results)
+	}
+	if depth := o.depth(); depth != 0 {
+		t.Errorf("depth after sending = %d", depth)
+	}
+}
+
+func TestOutboxRetriesTooManyRequests(t *testing.T) {
+	o, sleeps := newTestOutbox()
+	attempts := 0
+	_, err := o.enqueue("1", "", func() (tgbotapi.Message, error) {
+		attempts++
+		if attempts < 3 {
+			return tgbotapi.Message{}, tgbotapi.Error{
+				Message:            "Too Many Requests: retry after 7",
+				ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7},
+			}
+		}
+		return tgbotapi.Message{}, nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("err = %v after %d attempts", err, attempts)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != 7*time.Second {
+		t.Errorf("sleeps = %v", *sleeps)
+	}
+}
+
+func TestOutboxErrors(t *testing.T) {
+	o, _ := newTestOutbox()
+	_, err := o.enqueue("1", "text:1:5", func() (tgbotapi.Message, error) {
+		return tgbotapi.Message{}, tgbotapi.Error{Message: "Bad Request: message is not modified: specified new message content and reply markup are exactly the same"}
+	})
+	if err != nil {
+		t.Errorf("unmodified edit failed: %v", err)
+	}
+	failure := errors.New("Bad Request: chat not found")
+	_, err = o.enqueue("1", "", func() (tgbotapi.Message, error) {
+		return tgbotapi.Message{}, failure
+	})
+	if err != failure {
+		t.Errorf("err = %v, want %v", err, failure)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var errNoMagnetLink = errors.New("no magnet link found on the topic page")
+
+var errNoForum = errors.New("no forum found on the topic page")
+
+// errNotLoggedIn is returned when the tracker serves its login form instead
+// of the requested page, typically because BB_SESSION has expired.
+var errNotLoggedIn = errors.New("not logged in to the tracker, check BB_SESSION")
+
+// newPageReader decodes a tracker page to UTF-8. The tracker serves
+// Windows-1251 but mirrors and saved pages may declare another charset, so
+// the declared one is used when there is one.
+func newPageReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	peek, err := br.Peek(1024)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	enc, _, certain := charset.DetermineEncoding(peek, "")
+	if !certain {
+		if utf8.Valid(peek) {
+			return br, nil
+		}
+		enc = charmap.Windows1251
+	}
+	return enc.NewDecoder().Reader(br), nil
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == "class" && strings.Contains(attr.Val, class) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// isLoginForm reports whether n is the tracker's login form field.
+func isLoginForm(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.Data != "input" {
+		return false
+	}
+	for _, attr := range n.Attr {
+		if attr.Key == "name" && attr.Val == "login_username" {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoginPage reports whether the tracker answered with its login form, for
+// responses that are not parsed as pages, like .torrent downloads.
+func isLoginPage(body []byte) bool {
+	return bytes.Contains(body, []byte(`name="login_username"`))
+}
+
+// parseTopics parses the search results of a tracker.php page.
+func parseTopics(r io.Reader) ([]*Topic, error) {
+	r, err := newPageReader(r)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []*Topic
+	var currentTopic *Topic
+	var loginForm bool
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if isLoginForm(n) {
+			loginForm = true
+		}
+		if n.Type == html.ElementNode && n.Data == "tr" {
+			for _, attr := range n.Attr {
+				if attr.Key == "id" && strings.HasPrefix(attr.Val, "trs-tr-") {
+					currentTopic = &Topic{
+						ID: strings.TrimPrefix(attr.Val, "trs-tr-"),
+					}
+					topics = append(topics, currentTopic)
+				}
+			}
+		}
+		if currentTopic != nil && n.Type == html.ElementNode && n.Data == "td" {
+			for _, attr := range n.Attr {
+				if attr.Key == "class" && strings.Contains(attr.Val, "f-name-col") {
+					currentTopic.Forum = parseNodeText(n)
+				}
+				if attr.Key == "class" && strings.Contains(attr.Val, "t-title-col") {
+					currentTopic.TitleSections = cleanTextNodes(extractChildrenTextNodes(n))
+					currentTopic.Title = parseNodeText(n)
+					currentTopic.Release = parseRelease(currentTopic.Title)
+				}
+				if attr.Key == "class" && strings.Contains(attr.Val, "u-name-col") {
+					currentTopic.Author = parseNodeText(n)
+				}
+				if attr.Key == "class" && strings.Contains(attr.Val, "tor-size") {
+					currentTopic.Size = strings.TrimSpace(strings.TrimSuffix(parseNodeText(n), "↓"))
+					currentTopic.SizeBytes = parseTopicSize(n, currentTopic.Size)
+				}
+				if attr.Key == "class" && strings.Contains(attr.Val, "row4 leechmed bold") {
+					currentTopic.Leechers = parseNodeText(n)
+					currentTopic.LeechersCount, _ = parseCount(currentTopic.Leechers)
+				}
+				if attr.Key == "class" && strings.Contains(attr.Val, "row4 small number-format") {
+					currentTopic.Downloads = parseNodeText(n)
+					currentTopic.DownloadsCount, _ = parseCount(currentTopic.Downloads)
+				}
+				// The date column sorts by the unix time of the topic.
+				if attr.Key == "class" && strings.Contains(attr.Val, "small nowrap") && !strings.Contains(attr.Val, "tor-size") {
+					if ts, err := strconv.ParseInt(nodeAttr(n, "data-ts_text"), 10, 64); err == nil {
+						currentTopic.CreatedAt = time.Unix(ts, 0).UTC()
+					}
+				}
+			}
+		}
+		if currentTopic != nil && n.Type == html.ElementNode && n.Data == "b" && hasClass(n, "seedmed") {
+			currentTopic.Seeders = parseNodeText(n)
+			currentTopic.SeedersCount, _ = parseCount(currentTopic.Seeders)
+		}
+		if currentTopic != nil && n.Type == html.ElementNode && n.Data == "span" && hasClass(n, "tor-icon tor-") {
+			currentTopic.Verified = parseNodeText(n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	if len(topics) == 0 && loginForm {
+		return nil, errNotLoggedIn
+	}
+	return topics, nil
+}
+
+// parseTopicSize returns the size of a topic in bytes, which the size
+// column sorts by, or parses its text otherwise.
+func parseTopicSize(n *html.Node, text string) int64 {
+	if size, err := strconv.ParseInt(nodeAttr(n, "data-ts_text"), 10, 64); err == nil {
+		return size
+	}
+	size, _ := parseSize(text)
+	return size
+}
+
+// parseTopicInfoHash extracts the info hash of the topic's current torrent
+// from the magnet link of a viewtopic.php page.
+func parseTopicInfoHash(r io.Reader) (string, error) {
+	r, err := newPageReader(r)
+	if err != nil {
+		return "", err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	var loginForm bool
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if hash != "" {
+			return
+		}
+		if isLoginForm(n) {
+			loginForm = true
+		}
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for _, attr := range n.Attr {
+				if attr.Key == "href" && strings.HasPrefix(attr.Val, "magnet:") {
+					magnet, err := url.Parse(attr.Val)
+					if err != nil {
+						continue
+					}
+					xt := magnet.Query().Get("xt")
+					if strings.HasPrefix(xt, "urn:btih:") {
+						hash = strings.ToLower(strings.TrimPrefix(xt, "urn:btih:"))
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	if hash == "" && loginForm {
+		return "", errNotLoggedIn
+	}
+	if hash == "" {
+		return "", errNoMagnetLink
+	}
+	return hash, nil
+}
+
+// parseTopicForum extracts the forum of a topic, the last one of the
+// breadcrumb of a viewtopic.php page.
+func parseTopicForum(r io.Reader) (string, error) {
+	r, err := newPageReader(r)
+	if err != nil {
+		return "", err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	var forum string
+	var loginForm bool
+	var f func(n *html.Node, breadcrumb bool)
+	f = func(n *html.Node, breadcrumb bool) {
+		if isLoginForm(n) {
+			loginForm = true
+		}
+		if n.Type == html.ElementNode && hasClass(n, "t-breadcrumb-top") {
+			breadcrumb = true
+		}
+		if breadcrumb && n.Type == html.ElementNode && n.Data == "a" && strings.Contains(nodeAttr(n, "href"), "viewforum.php") {
+			forum = parseNodeText(n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c, breadcrumb)
+		}
+	}
+	f(doc, false)
+	if forum == "" && loginForm {
+		return "", errNotLoggedIn
+	}
+	if forum == "" {
+		return "", errNoForum
+	}
+	return forum, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares got, as JSON, with testdata/<name>.golden.json.
+func checkGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+	body, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = append(body, '\n')
+	goldenFile := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		err = ioutil.WriteFile(goldenFile, body, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, want) {
+		t.Errorf("%s does not match %s:\n%s", name, goldenFile, body)
+	}
+}
+
+func openTestPage(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseTopics(t *testing.T) {
+	for _, name := range []string{"tracker", "tracker_empty"} {
+		t.Run(name, func(t *testing.T) {
+			topics, err := parseTopics(openTestPage(t, name+".html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, name, topics)
+		})
+	}
+}
+
+func TestParseTopicsLoggedOut(t *testing.T) {
+	_, err := parseTopics(openTestPage(t, "tracker_logged_out.html"))
+	if err != errNotLoggedIn {
+		t.Errorf("parseTopics() error = %v, want %v", err, errNotLoggedIn)
+	}
+}
+
+// Pages without a charset declaration are Windows-1251, unless they are
+// valid UTF-8.
+func TestParseTopicsCharset(t *testing.T) {
+	page, err := ioutil.ReadFile(filepath.Join("testdata", "tracker.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page = bytes.Replace(page, []byte(`<meta charset="Windows-1251">`), nil, 1)
+	utf8Page, err := charmap.Windows1251.NewDecoder().Bytes(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string][]byte{"cp1251": page, "utf8": utf8Page} {
+		topics, err := parseTopics(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(topics) == 0 || !strings.HasPrefix(topics[0].Title, "Дюна / Dune") {
+			t.Errorf("%s: parseTopics() = %+v", name, topics)
+		}
+	}
+}
+
+func TestParseSizesAndCounts(t *testing.T) {
+	for text, want := range map[string]int64{
+		"4.37 GB":     4692251770,
+		"4,37 ГБ":     4692251770,
+		"700\u00a0MB": 700 << 20,
+		"1.5 тб":      3 << 39,
+		"512 Б":       512,
+	} {
+		if got, err := parseSize(text); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", text, got, err, want)
+		}
+	}
+	for text, want := range map[string]int{
+		"312":        312,
+		"10 843":     10843,
+		"10,843":     10843,
+		"1\u00a0041": 1041,
+	} {
+		if got, err := parseCount(text); err != nil || got != want {
+			t.Errorf("parseCount(%q) = %d, %v, want %d", text, got, err, want)
+		}
+	}
+	if _, err := parseCount("-"); err == nil {
+		t.Error("parseCount(\"-\") succeeded")
+	}
+}
+
+func TestParseTopicInfoHash(t *testing.T) {
+	hash, err := parseTopicInfoHash(openTestPage(t, "viewtopic.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "3f8d1a6c0b5e2d4f9a7c6b5a4d3e2f1a0b9c8d7e" {
+		t.Errorf("parseTopicInfoHash() = %q", hash)
+	}
+
+	_, err = parseTopicInfoHash(openTestPage(t, "viewtopic_logged_out.html"))
+	if err != errNotLoggedIn {
+		t.Errorf("parseTopicInfoHash() error = %v, want %v", err, errNotLoggedIn)
+	}
+	_, err = parseTopicInfoHash(openTestPage(t, "tracker.html"))
+	if err != errNoMagnetLink {
+		t.Errorf("parseTopicInfoHash() error = %v, want %v", err, errNoMagnetLink)
+	}
+}
+
+func TestParseTopicForum(t *testing.T) {
+	forum, err := parseTopicForum(openTestPage(t, "viewtopic.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forum != "Фильмы 2021 (HD Video)" {
+		t.Errorf("parseTopicForum() = %q", forum)
+	}
+
+	_, err = parseTopicForum(openTestPage(t, "viewtopic_logged_out.html"))
+	if err != errNotLoggedIn {
+		t.Errorf("parseTopicForum() error = %v, want %v", err, errNotLoggedIn)
+	}
+	_, err = parseTopicForum(openTestPage(t, "tracker.html"))
+	if err != errNoForum {
+		t.Errorf("parseTopicForum() error = %v, want %v", err, errNoForum)
+	}
+}
+
+// addPageSeeds adds the saved pages to the fuzzing corpus, along with
+// markup that used to make the parsers panic.
+func addPageSeeds(f *testing.F) {
+	pages, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, page := range pages {
+		body, err := ioutil.ReadFile(page)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte(`<table><tr id="trs-tr-1"><td><b class="seedmed"></b><span class="tor-icon tor-approved"></span></td></tr></table>`))
+	f.Add([]byte(`<td class="t-title-col">orphan cell</td><b class="seedmed">1</b>`))
+	f.Add([]byte(`<tr id="trs-tr-"><a href="magnet:?xt=urn:btih:">x</a><a href="magnet:%zz">y</a></tr>`))
+}
+
+func FuzzParseTopics(f *testing.F) {
+	addPageSeeds(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		parseTopics(bytes.NewReader(body))
+	})
+}
+
+func FuzzParseTopicInfoHash(f *testing.F) {
+	addPageSeeds(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		parseTopicInfoHash(bytes.NewReader(body))
+	})
+}
+
+func FuzzParseTopicForum(f *testing.F) {
+	addPageSeeds(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		parseTopicForum(bytes.NewReader(body))
+	})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+// REAP_INTERVAL is how often completed torrents are checked against their
+// seed policy.
+var REAP_INTERVAL time.Duration = 10 * time.Minute
+
+const seedUsage = "Usage: /seed <topic link or id> [ratio=2] [seed_time=72h] [idle_time=24h] [action=stop|remove|remove-data]"
+
+// seedReason is the limit of a policy a torrent reached, as a message key
+// and its argument.
+type seedReason struct {
+	format string
+	value  interface{}
+}
+
+func (reason *seedReason) text(p *message.Printer) string {
+	if d, ok := reason.value.(time.Duration); ok {
+		return p.Sprintf(reason.format, localizeDuration(p, d))
+	}
+	return p.Sprintf(reason.format, reason.value)
+}
+
+// reapedTorrent is a torrent cleaned up by its seed policy, to be reported.
+type reapedTorrent struct {
+	instance string
+	name     string
+	done     string
+	reason   *seedReason
+	// unowned torrents are reported to the admins, with their instance.
+	unowned bool
+}
+
+// reached returns why a completed torrent is done seeding under the policy,
+// or nil if it should keep seeding.
+func (policy *SeedPolicy) reached(torrent *TorrentInfo) *seedReason {
+	if policy.Ratio > 0 && torrent.Ratio >= policy.Ratio {
+		return &seedReason{"ratio %.2f", torrent.Ratio}
+	}
+	if policy.SeedTime > 0 && torrent.SeedingTime >= time.Duration(policy.SeedTime) {
+		return &seedReason{"seeded for %s", torrent.SeedingTime.Truncate(time.Minute)}
+	}
+	if policy.IdleTime > 0 && !torrent.LastActivity.IsZero() {
+		idle := time.Since(torrent.LastActivity)
+		if idle >= time.Duration(policy.IdleTime) {
+			return &seedReason{"idle for %s", idle.Truncate(time.Minute)}
+		}
+	}
+	return nil
+}
+
+func (policy *SeedPolicy) String() string {
+	var limits []string
+	if policy.Ratio > 0 {
+		limits = append(limits, fmt.Sprintf("ratio=%g", policy.Ratio))
+	}
+	if policy.SeedTime > 0 {
+		limits = append(limits, fmt.Sprintf("seed_time=%s", time.Duration(policy.SeedTime)))
+	}
+	if policy.IdleTime > 0 {
+		limits = append(limits, fmt.Sprintf("idle_time=%s", time.Duration(policy.IdleTime)))
+	}
+	action := policy.Action
+	if action == "" {
+		action = "stop"
+	}
+	limits = append(limits, "action="+action)
+	return strings.Join(limits, " ")
+}
+
+// parseSeedPolicy parses the arguments of the /seed command following the
+// topic.
+func parseSeedPolicy(args []string) (*SeedPolicy, error) {
+	policy := &SeedPolicy{}
+	for _, arg := range args {
+		parts := strings.SplitN(strings.ToLower(arg), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid limit %q", arg)
+		}
+		var duration time.Duration
+		var err error
+		switch parts[0] {
+		case "ratio":
+			policy.Ratio, err = strconv.ParseFloat(parts[1], 64)
+		case "seed_time":
+			duration, err = time.ParseDuration(parts[1])
+			policy.SeedTime = Duration(duration)
+		case "idle_time":
+			duration, err = time.ParseDuration(parts[1])
+			policy.IdleTime = Duration(duration)
+		case "action":
+			switch parts[1] {
+			case "stop", "remove", "remove-data":
+				policy.Action = parts[1]
+			default:
+				err = fmt.Errorf("unknown action")
+			}
+		default:
+			err = fmt.Errorf("unknown limit")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q", arg)
+		}
+	}
+	if policy.Ratio <= 0 && policy.SeedTime <= 0 && policy.IdleTime <= 0 {
+		return nil, fmt.Errorf("no limit given")
+	}
+	return policy, nil
+}
+
+// effectiveSeedPolicy returns the policy of a torrent: its own if it has
+// one, else the most specific destination policy, else the global one.
+// A nil policy means the torrent seeds forever.
+func effectiveSeedPolicy(instance string, downloadDir string, record *TorrentRecord) *SeedPolicy {
+	if record != nil && record.SeedPolicy != nil {
+		return record.SeedPolicy
+	}
+	var best *DestinationPolicy
+	for _, dest := range config.DestinationPolicies {
+		if dest.Instance != "" && dest.Instance != instance {
+			continue
+		}
+		if dest.DownloadDir != "" && !isSubdir(dest.DownloadDir, downloadDir) {
+			continue
+		}
+		if best == nil || len(dest.DownloadDir) > len(best.DownloadDir) ||
+			(len(dest.DownloadDir) == len(best.DownloadDir) && dest.Instance != "") {
+			best = dest
+		}
+	}
+	if best != nil {
+		return &best.SeedPolicy
+	}
+	return config.SeedPolicy
+}
+
+func isSubdir(dir string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// applySeedLimits passes the ratio and idle limits of the torrent's policy
+// to clients that enforce them natively. The reaper still checks the seed
+// time and carries out the removal actions.
+func applySeedLimits(instance *InstanceConfig, c Client, hash string, record *TorrentRecord) error {
+	limiter, ok := c.(seedLimiter)
+	if !ok {
+		return nil
+	}
+	torrents, err := c.Status(hash)
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return errTorrentNotFound
+	}
+	policy := effectiveSeedPolicy(instance.Name, torrents[0].DownloadDir, record)
+	if policy == nil {
+		return nil
+	}
+	return limiter.SetSeedLimits(hash, policy.Ratio, time.Duration(policy.IdleTime))
+}
+
+// recordTorrent remembers who added a torrent, accounts it to their monthly
+// usage and applies its seed limits. A torrent added again, as when Start
+// is pressed, keeps its owner and is no longer marked as stopped by its
+// policy.
+func recordTorrent(instance *InstanceConfig, c Client, torrent *TorrentInfo, record *TorrentRecord) error {
+	record.Instance = instance.Name
+	record.AddedAt = time.Now()
+	err := state.update(func(s *State) {
+		if old, ok := s.Torrents[torrent.Hash]; ok {
+			record.SeedPolicy = old.SeedPolicy
+			if old.UserID != 0 {
+				record.UserID = old.UserID
+			}
+		} else if record.UserID != 0 {
+			chargeUsage(s, record.UserID, record.Size)
+		}
+		s.Torrents[torrent.Hash] = record
+		delete(s.Reaped, torrent.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	return applySeedLimits(instance, c, torrent.Hash, record)
+}
+
+// forgetTorrent drops the record of a removed torrent and unfollows it.
+func forgetTorrent(hash string) error {
+	return state.update(func(s *State) {
+		delete(s.Torrents, hash)
+		delete(s.Reaped, hash)
+		delete(s.Stalls, hash)
+		// A removed torrent is not followed anymore.
+		for ref, sub := range s.Subscriptions {
+			if sub.Hash == hash {
+				delete(s.Subscriptions, ref)
+			}
+		}
+	})
+}
+
+// moveTorrentRecord carries the record of a torrent, and the subscription
+// following it, over to the one replacing it.
+func moveTorrentRecord(oldHash string, newHash string) error {
+	return state.update(func(s *State) {
+		for _, sub := range s.Subscriptions {
+			if sub.Hash == oldHash {
+				sub.Hash = newHash
+			}
+		}
+		record, ok := s.Torrents[oldHash]
+		if !ok {
+			return
+		}
+		delete(s.Torrents, oldHash)
+		delete(s.Reaped, oldHash)
+		delete(s.Stalls, oldHash)
+		s.Torrents[newHash] = record
+	})
+}
+
+// setSeedPolicy handles the /seed command, overriding the policy of the
+// chat's torrents of a topic.
+func setSeedPolicy(p *message.Printer, chatID int64, args string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return p.Sprintf(seedUsage)
+	}
+	t := fields[0]
+	uri, err := url.ParseRequestURI(t)
+	if err == nil {
+		t = uri.Query().Get("t")
+	}
+	if _, err := strconv.Atoi(t); err != nil {
+		return p.Sprintf("Invalid topic. %s", p.Sprintf(seedUsage))
+	}
+	policy, err := parseSeedPolicy(fields[1:])
+	if err != nil {
+		return fmt.Sprintf("%s.\n%s", err, p.Sprintf(seedUsage))
+	}
+	var hashes []string
+	records := make(map[string]*TorrentRecord)
+	err = state.update(func(s *State) {
+		for hash, record := range s.Torrents {
+			if record.T == t && record.ChatID == chatID {
+				record.SeedPolicy = policy
+				delete(s.Reaped, hash)
+				hashes = append(hashes, hash)
+				copied := *record
+				records[hash] = &copied
+			}
+		}
+	})
+	if err != nil {
+		return p.Sprintf("Could not save the policy: %s", reportError(p, "seed "+args, err))
+	}
+	if len(hashes) == 0 {
+		return p.Sprintf("No torrent of this topic was added from this chat.")
+	}
+	for _, hash := range hashes {
+		instance, err := getInstance(records[hash].Instance)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c, err := instance.client()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		err = applySeedLimits(instance, c, hash, records[hash])
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return p.Sprintf("Seed policy of topic %s: %s", t, policy)
+}
+
+// reapInstance applies the seed policies to the completed torrents of an
+// instance and returns what was cleaned up by chat to notify. The torrents
+// of the instance are added to seen.
+func reapInstance(instance *InstanceConfig, seen map[string]bool) (map[int64][]*reapedTorrent, error) {
+	c, err := instance.client()
+	if err != nil {
+		return nil, err
+	}
+	torrents, err := c.Status()
+	if err != nil {
+		return nil, err
+	}
+	for _, torrent := range torrents {
+		seen[torrent.Hash] = true
+	}
+	var records map[string]TorrentRecord
+	var reaped map[string]bool
+	state.view(func(s *State) {
+		records = make(map[string]TorrentRecord, len(s.Torrents))
+		for hash, record := range s.Torrents {
+			records[hash] = *record
+		}
+		reaped = make(map[string]bool, len(s.Reaped))
+		for hash := range s.Reaped {
+			reaped[hash] = true
+		}
+	})
+	summary := make(map[int64][]*reapedTorrent)
+	for _, torrent := range torrents {
+		if torrent.PercentDone < 1 {
+			continue
+		}
+		var record *TorrentRecord
+		if r, ok := records[torrent.Hash]; ok {
+			record = &r
+		}
+		policy := effectiveSeedPolicy(instance.Name, torrent.DownloadDir, record)
+		if policy == nil {
+			continue
+		}
+		reason := policy.reached(torrent)
+		if reason == nil {
+			continue
+		}
+		action := policy.Action
+		if record == nil && !config.ReapUnowned && action != "stop" {
+			// Torrents added outside of the bot are not removed unless
+			// the config says so.
+			action = "stop"
+		}
+		var done string
+		switch action {
+		case "remove", "remove-data":
+			err = c.Remove(torrent.Hash, action == "remove-data")
+			if err == nil {
+				err = forgetTorrent(torrent.Hash)
+			}
+			done = "removed"
+			if action == "remove-data" {
+				done = "removed with data"
+			}
+		default:
+			if reaped[torrent.Hash] {
+				continue
+			}
+			// The client may already have stopped it on its own limits.
+			if torrent.Status != "stopped" {
+				err = c.Stop(torrent.Hash)
+			}
+			if err == nil {
+				err = state.update(func(s *State) {
+					s.Reaped[torrent.Hash] = time.Now()
+				})
+			}
+			done = "stopped"
+		}
+		if err != nil {
+			log.Printf("Could not apply seed policy to %s: %v", torrent.Name, err)
+			continue
+		}
+		reaped := &reapedTorrent{instance: instance.Name, name: torrent.Name, done: done, reason: reason}
+		if record != nil && record.ChatID != 0 {
+			summary[record.ChatID] = append(summary[record.ChatID], reaped)
+			continue
+		}
+		reaped.unowned = true
+		for _, admin := range config.Admins {
+			summary[admin] = append(summary[admin], reaped)
+		}
+	}
+	return summary, nil
+}
+
+// reapTorrents applies the seed policies on every instance and sends each
+// chat a summary of what was cleaned up.
+func reapTorrents(bot *tgbotapi.BotAPI) {
+	summary := make(map[int64][]*reapedTorrent)
+	seen := make(map[string]bool)
+	complete := true
+	for _, instance := range instances {
+		reaped, err := reapInstance(instance, seen)
+		if err != nil {
+			log.Printf("Could not apply seed policies on %s: %v", instance.Name, err)
+			complete = false
+			continue
+		}
+		for chatID, chatReaped := range reaped {
+			summary[chatID] = append(summary[chatID], chatReaped...)
+		}
+	}
+	if complete {
+		forgetReaped(seen)
+	}
+	for chatID, reaped := range summary {
+		p := chatPrinter(chatID)
+		text := renderMessage(p, "seeding_finished", newSeedingFinishedView(p, reaped))
+		_, err := send(bot, tgbotapi.NewMessage(chatID, truncateMessage(text)))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// forgetReaped drops the marks of the torrents stopped by their policy that
+// no instance has anymore.
+func forgetReaped(seen map[string]bool) {
+	var gone bool
+	state.view(func(s *State) {
+		for hash := range s.Reaped {
+			if !seen[hash] {
+				gone = true
+				break
+			}
+		}
+	})
+	if !gone {
+		return
+	}
+	err := state.update(func(s *State) {
+		for hash := range s.Reaped {
+			if !seen[hash] {
+				delete(s.Reaped, hash)
+			}
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func runReaper(bot *tgbotapi.BotAPI) {
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapTorrents(bot)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+// Quota limits what a user may download. MaxActive caps the downloads in
+// progress, MonthlySize the size of the torrents added in a calendar month
+// and MaxSize the size of a single torrent. Sizes are like "50 GB"; zero
+// values disable a limit.
+type Quota struct {
+	MaxActive   int    `json:"max_active"`
+	MonthlySize string `json:"monthly_size"`
+	MaxSize     string `json:"max_size"`
+}
+
+// Usage is the size of the torrents a user added during a month.
+type Usage struct {
+	Month string `json:"month"`
+	Size  int64  `json:"size"`
+}
+
+// usageMonth is the month usage is currently accounted to.
+func usageMonth(now time.Time) string {
+	return now.Format("2006-01")
+}
+
+// isAdmin reports whether a user is one of the admins in the config.
+// Without admins, nobody is: torrents added outside of the bot are then
+// managed by no one.
+func isAdmin(userID int64) bool {
+	for _, admin := range config.Admins {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// owner returns the user who added the torrent. Records made before users
+// were tracked fall back to the chat, which is the user's own in private.
+func (record *TorrentRecord) owner() int64 {
+	if record.UserID != 0 {
+		return record.UserID
+	}
+	return record.ChatID
+}
+
+// canManage reports whether a user may see and act on a torrent. Torrents
+// added outside of the bot are only managed by the admins.
+func canManage(userID int64, record *TorrentRecord) bool {
+	if isAdmin(userID) {
+		return true
+	}
+	return record != nil && record.owner() == userID
+}
+
+func getTorrentRecord(hash string) *TorrentRecord {
+	var record *TorrentRecord
+	state.view(func(s *State) {
+		if r, ok := s.Torrents[hash]; ok {
+			copied := *r
+			record = &copied
+		}
+	})
+	return record
+}
+
+// authorizeCallback refuses button presses on the torrents of other users.
+// Anyone may add a torrent nobody added yet.
+func authorizeCallback(p *message.Printer, user *tgbotapi.User, prefix string, ref string) error {
+	if user == nil {
+		return &refusal{p.Sprintf("You can only manage your own torrents")}
+	}
+	if isAdmin(int64(user.ID)) {
+		return nil
+	}
+	t, _ := parseTorrentRef(ref)
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return err
+	}
+	record := getTorrentRecord(torrentFile.InfoHash)
+	if record == nil && (prefix == "init-" || prefix == "start-") {
+		return nil
+	}
+	if !canManage(int64(user.ID), record) {
+		return &refusal{p.Sprintf("You can only manage your own torrents")}
+	}
+	return nil
+}
+
+func userQuota(userID int64) *Quota {
+	if quota, ok := config.UserQuotas[userID]; ok {
+		return quota
+	}
+	return config.Quota
+}
+
+// validateQuotas checks the sizes of the quotas in the config.
+func validateQuotas(cfg *Config) error {
+	quotas := []*Quota{cfg.Quota}
+	for _, quota := range cfg.UserQuotas {
+		quotas = append(quotas, quota)
+	}
+	for _, quota := range quotas {
+		if quota == nil {
+			continue
+		}
+		for _, size := range []string{quota.MonthlySize, quota.MaxSize} {
+			if size == "" {
+				continue
+			}
+			if _, err := parseSize(size); err != nil {
+				return fmt.Errorf("invalid quota: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// countActiveDownloads counts the incomplete, running torrents of a user,
+// leaving out the one with the given hash. Unreachable instances count none.
+func countActiveDownloads(userID int64, except string) int {
+	var records map[string]TorrentRecord
+	state.view(func(s *State) {
+		records = make(map[string]TorrentRecord, len(s.Torrents))
+		for hash, record := range s.Torrents {
+			records[hash] = *record
+		}
+	})
+	var active int
+	for _, instance := range instances {
+		c, err := instance.client()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		torrents, err := c.Status()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, torrent := range torrents {
+			record, ok := records[torrent.Hash]
+			if !ok || record.owner() != userID || torrent.Hash == except {
+				continue
+			}
+			if torrent.PercentDone < 1 && torrent.Status != "stopped" {
+				active++
+			}
+		}
+	}
+	return active
+}
+
+// checkQuota refuses to add or start a torrent beyond the quota of the
+// user. Restarting a torrent the user already added only counts against
+// the active downloads. Admins have no quota, nor does a zero userID, which
+// stands for a chat.
+func checkQuota(p *message.Printer, userID int64, t string) error {
+	if userID == 0 {
+		return nil
+	}
+	quota := userQuota(userID)
+	if quota == nil || isAdmin(userID) {
+		return nil
+	}
+	torrentFile, err := parseTorrentFile(t)
+	if err != nil {
+		return err
+	}
+	record := getTorrentRecord(torrentFile.InfoHash)
+	if record == nil {
+		size := torrentFileSize(torrentFile)
+		if quota.MaxSize != "" {
+			maxSize, _ := parseSize(quota.MaxSize)
+			if size > maxSize {
+				return &refusal{p.Sprintf("%s is larger than your limit of %s per torrent", localizeSize(p, size), localizeSize(p, maxSize))}
+			}
+		}
+		if quota.MonthlySize != "" {
+			monthlySize, _ := parseSize(quota.MonthlySize)
+			var used int64
+			state.view(func(s *State) {
+				if usage, ok := s.Usage[userID]; ok && usage.Month == usageMonth(time.Now()) {
+					used = usage.Size
+				}
+			})
+			if used+size > monthlySize {
+				return &refusal{p.Sprintf("This torrent of %s would exceed your monthly limit: %s of %s used", localizeSize(p, size), localizeSize(p, used), localizeSize(p, monthlySize))}
+			}
+		}
+	}
+	if quota.MaxActive > 0 {
+		active := countActiveDownloads(userID, torrentFile.InfoHash)
+		if active >= quota.MaxActive {
+			return &refusal{p.Sprintf("Too many active downloads: %d of %d allowed", active, quota.MaxActive)}
+		}
+	}
+	return nil
+}
+
+// chargeUsage accounts a new torrent to the monthly usage of a user.
+func chargeUsage(s *State, userID int64, size int64) {
+	month := usageMonth(time.Now())
+	usage, ok := s.Usage[userID]
+	if !ok || usage.Month != month {
+		usage = &Usage{Month: month}
+		s.Usage[userID] = usage
+	}
+	usage.Size += size
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+// QualityProfile ranks search results by release quality. Resolution is
+// the preferred number of lines, the highest if zero, Sources the preferred
+// sources, best first, and MaxSizePerHour the largest size per hour of
+// video worth downloading, like "2 GB".
+type QualityProfile struct {
+	Resolution     int      `json:"resolution"`
+	Sources        []string `json:"sources"`
+	HDR            bool     `json:"hdr"`
+	MaxSizePerHour string   `json:"max_size_per_hour"`
+}
+
+// qualityOff keeps search results in tracker order.
+const qualityOff = "off"
+
+// defaultQualityProfiles are the built-in profiles, which the config may
+// override or add to.
+var defaultQualityProfiles = map[string]*QualityProfile{
+	"best":    {HDR: true},
+	"1080p":   {Resolution: 1080, Sources: []string{"WEB-DL", "BDRip", "Remux"}},
+	"compact": {Resolution: 720, MaxSizePerHour: "2 GB"},
+}
+
+// sourceScores rate the sources of releases, unknown ones scoring 0.
+var sourceScores = map[string]float64{
+	"Remux":     30,
+	"Blu-ray":   28,
+	"BDRip":     25,
+	"WEB-DL":    22,
+	"WEBRip":    18,
+	"WEB-DLRip": 16,
+	"HDTV":      14,
+	"HDTVRip":   12,
+	"HDRip":     10,
+	"DVD":       10,
+	"DVDRip":    8,
+	"SATRip":    6,
+	"TVRip":     6,
+	"CAMRip":    -30,
+	"TS":        -30,
+}
+
+// qualityProfiles returns the profiles users may choose from.
+func qualityProfiles() map[string]*QualityProfile {
+	profiles := make(map[string]*QualityProfile, len(defaultQualityProfiles)+len(config.QualityProfiles))
+	for name, profile := range defaultQualityProfiles {
+		profiles[name] = profile
+	}
+	for name, profile := range config.QualityProfiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+func qualityProfileNames() []string {
+	var names []string
+	for name := range qualityProfiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateQualityProfiles checks the quality profiles of the config.
+func validateQualityProfiles(cfg *Config) error {
+	for name, profile := range cfg.QualityProfiles {
+		if name == qualityOff || profile == nil {
+			return fmt.Errorf("invalid quality profile %q", name)
+		}
+		if profile.MaxSizePerHour != "" {
+			if _, err := parseSize(profile.MaxSizePerHour); err != nil {
+				return fmt.Errorf("invalid quality profile %q: %v", name, err)
+			}
+		}
+	}
+	if cfg.DefaultQuality != "" && cfg.DefaultQuality != qualityOff {
+		if _, ok := defaultQualityProfiles[cfg.DefaultQuality]; !ok && cfg.QualityProfiles[cfg.DefaultQuality] == nil {
+			return fmt.Errorf("unknown default quality profile %q", cfg.DefaultQuality)
+		}
+	}
+	return nil
+}
+
+// userQualityProfile returns the name of the profile a user chose, or the
+// default one, and the profile itself, nil to keep the tracker order.
+func userQualityProfile(userID int64) (string, *QualityProfile) {
+	name := config.DefaultQuality
+	state.view(func(s *State) {
+		if chosen, ok := s.Quality[userID]; ok {
+			name = chosen
+		}
+	})
+	profile := qualityProfiles()[name]
+	if profile == nil {
+		return qualityOff, nil
+	}
+	return name, profile
+}
+
+// setQuality handles the /quality command, showing or choosing how the
+// search results of a user are ranked.
+func setQuality(p *message.Printer, user *tgbotapi.User, args string) string {
+	names := qualityProfileNames()
+	usage := p.Sprintf("Usage: /quality [%s]", strings.Join(append(names, qualityOff), "|"))
+	if args == "" {
+		name, profile := userQualityProfile(int64(user.ID))
+		if profile == nil {
+			return p.Sprintf("Search results are in tracker order.\n%s", usage)
+		}
+		return p.Sprintf("Search results are ranked by the %s quality profile.\n%s", name, usage)
+	}
+	name := strings.ToLower(args)
+	if name != qualityOff && qualityProfiles()[name] == nil {
+		return usage
+	}
+	err := state.update(func(s *State) {
+		s.Quality[int64(user.ID)] = name
+	})
+	if err != nil {
+		return p.Sprintf("Could not save the quality profile: %s", reportError(p, "quality "+args, err))
+	}
+	if name == qualityOff {
+		return p.Sprintf("Search results are in tracker order.")
+	}
+	return p.Sprintf("Search results are ranked by the %s quality profile.", name)
+}
+
+// releaseHours estimates the length of the video of a release: 45 minutes
+// an episode, or 2 hours for a film.
+func releaseHours(release *Release) float64 {
+	if release.FirstEpisode > 0 && release.LastEpisode >= release.FirstEpisode {
+		return float64(release.LastEpisode-release.FirstEpisode+1) * 0.75
+	}
+	return 2
+}
+
+// scoreTopic rates a search result for a profile, the higher the better:
+// by resolution, source and HDR as the profile prefers, by seeders, by the
+// verification of the release on the tracker and by its size per hour.
+func scoreTopic(topic *Topic, profile *QualityProfile) float64 {
+	var score float64
+	release := topic.Release
+	if release == nil {
+		release = &Release{}
+	}
+	if height := release.Height(); height > 0 {
+		if profile.Resolution > 0 {
+			// Each step away from the preferred resolution, e.g. from
+			// 1080p to 720p or to 2160p, costs 20 points.
+			score += 40 - 20*math.Abs(math.Log2(float64(height)/float64(profile.Resolution)))
+		} else {
+			score += 40 * float64(height) / 2160
+		}
+	}
+	score += sourceScores[release.Source]
+	for i, source := range profile.Sources {
+		if strings.EqualFold(source, release.Source) {
+			score += 10 - 2*float64(i)
+			break
+		}
+	}
+	if profile.HDR && len(release.HDR) > 0 {
+		score += 5
+	}
+	if topic.SeedersCount == 0 {
+		score -= 20
+	} else {
+		score += math.Min(10*math.Log10(1+float64(topic.SeedersCount)), 30)
+	}
+	switch topic.Verified {
+	case "√":
+		score += 5
+	case "x", "D", "∑":
+		// Closed, duplicate and absorbed releases.
+		score -= 15
+	}
+	if profile.MaxSizePerHour != "" && topic.SizeBytes > 0 {
+		maxSizePerHour, _ := parseSize(profile.MaxSizePerHour)
+		if float64(topic.SizeBytes)/releaseHours(release) > float64(maxSizePerHour) {
+			score -= 25
+		}
+	}
+	return score
+}
+
+// workKey identifies the work of a release, so that its variants are
+// grouped together: its original name, year and season.
+func workKey(topic *Topic) string {
+	release := topic.Release
+	if release == nil || len(release.Names) == 0 {
+		return "#" + topic.ID
+	}
+	return strings.Join([]string{
+		normalizeQuery(release.OriginalName()),
+		strconv.Itoa(release.Year),
+		strconv.Itoa(release.Season),
+	}, "|")
+}
+
+// rankTopics groups search results by work and sorts them by score for a
+// profile: the groups by their best release and the releases of a group
+// best first. Ties keep the tracker order.
+func rankTopics(topics []*Topic, profile *QualityProfile) [][]*Topic {
+	scores := make(map[*Topic]float64, len(topics))
+	var keys []string
+	groups := make(map[string][]*Topic)
+	for _, topic := range topics {
+		scores[topic] = scoreTopic(topic, profile)
+		key := workKey(topic)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], topic)
+	}
+	var ranked [][]*Topic
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			return scores[group[i]] > scores[group[j]]
+		})
+		ranked = append(ranked, group)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i][0]] > scores[ranked[j][0]]
+	})
+	return ranked
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestRankTopics(t *testing.T) {
+	topics, err := parseTopics(openTestPage(t, "tracker.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		profile string
+		want    [][]string
+	}{
+		// Dune in 2160p with HDR is the best, and its camera rip follows.
+		{"best", [][]string{{"6119871", "6121002"}, {"6120455"}}},
+		{"1080p", [][]string{{"6120455"}, {"6119871", "6121002"}}},
+	} {
+		ranked := rankTopics(topics, defaultQualityProfiles[tt.profile])
+		var got [][]string
+		for _, group := range ranked {
+			var ids []string
+			for _, topic := range group {
+				ids = append(ids, topic.ID)
+			}
+			got = append(got, ids)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: rankTopics() = %v, want %v", tt.profile, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if len(got[i]) != len(tt.want[i]) || got[i][0] != tt.want[i][0] {
+				t.Errorf("%s: rankTopics() = %v, want %v", tt.profile, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkKeyIgnoresEpisodes(t *testing.T) {
+	first := &Topic{ID: "1", Release: parseRelease("The Expanse S06E01-03 (2021) WEBRip 720p [VO]")}
+	second := &Topic{ID: "2", Release: parseRelease("The Expanse S06E04-06 (2021) WEB-DL 1080p [VO]")}
+	if workKey(first) != workKey(second) {
+		t.Errorf("episodes of a season are different works: %q and %q", workKey(first), workKey(second))
+	}
+}
+
+func TestScoreTopicSizePerHour(t *testing.T) {
+	profile := defaultQualityProfiles["compact"]
+	small := &Topic{SizeBytes: 3 << 30, SeedersCount: 10, Release: parseRelease("Film (2020) WEB-DL 720p")}
+	large := &Topic{SizeBytes: 12 << 30, SeedersCount: 10, Release: parseRelease("Film (2020) WEB-DL 720p")}
+	if scoreTopic(small, profile) <= scoreTopic(large, profile) {
+		t.Error("a release over the size per hour of the profile is not ranked lower")
+	}
+	// Six episodes of 45 minutes take 4.5 hours.
+	series := &Topic{SizeBytes: 8 << 30, SeedersCount: 10, Release: parseRelease("Series / Серии: 1-6 из 6 (2020) WEB-DL 720p")}
+	if scoreTopic(series, profile) != scoreTopic(small, profile) {
+		t.Error("the size per hour of a series does not count its episodes")
+	}
+}
+
+func TestValidateQualityProfiles(t *testing.T) {
+	for _, cfg := range []*Config{
+		{QualityProfiles: map[string]*QualityProfile{"tiny": {MaxSizePerHour: "big"}}},
+		{QualityProfiles: map[string]*QualityProfile{"off": {}}},
+		{DefaultQuality: "unknown"},
+	} {
+		if err := validateQualityProfiles(cfg); err == nil {
+			t.Errorf("validateQualityProfiles(%+v) succeeded", cfg)
+		}
+	}
+	cfg := &Config{QualityProfiles: map[string]*QualityProfile{"tiny": {MaxSizePerHour: "1 GB"}}, DefaultQuality: "tiny"}
+	if err := validateQualityProfiles(cfg); err != nil {
+		t.Error(err)
+	}
+}
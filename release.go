@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Release is what a tracker title tells about a release, e.g.
+// "Матрица / The Matrix (1999) BDRip 1080p [DUB, AVO] | Серии: 1-8 из 10".
+// Fields are empty when the title does not say.
+type Release struct {
+	// Names are the names of the work, localized first and original last.
+	Names      []string
+	Year       int
+	Source     string
+	Resolution string
+	HDR        []string
+	Codec      string
+	// Translations are the dubbing and voice-over tags, e.g. "DUB", "AVO",
+	// "Original" and "Sub", and Audio the audio formats.
+	Translations []string
+	Audio        []string
+	Season       int
+	// FirstEpisode to LastEpisode are the episodes of the release, out of
+	// TotalEpisodes.
+	FirstEpisode  int
+	LastEpisode   int
+	TotalEpisodes int
+}
+
+// releaseTag is a tag found in titles, normalized to name.
+type releaseTag struct {
+	pattern *regexp.Regexp
+	name    string
+}
+
+// releaseTags makes the tags of pattern and name pairs. Patterns match
+// whole words.
+func releaseTags(pairs ...string) []releaseTag {
+	var tags []releaseTag
+	for i := 0; i < len(pairs); i += 2 {
+		tags = append(tags, releaseTag{
+			pattern: regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}])(` + pairs[i] + `)($|[^\p{L}\p{N}+])`),
+			name:    pairs[i+1],
+		})
+	}
+	return tags
+}
+
+// Sources are matched in order, so the more specific ones come first.
+var releaseSources = releaseTags(
+	`BD-?Remux|Remux`, "Remux",
+	`WEB-DLRip`, "WEB-DLRip",
+	`WEB-?DL`, "WEB-DL",
+	`WEB-?Rip`, "WEBRip",
+	`BD-?Rip|BR-?Rip`, "BDRip",
+	`Blu-?Ray|BDMV|BD50|BD25`, "Blu-ray",
+	`HDTV-?Rip`, "HDTVRip",
+	`HDTV`, "HDTV",
+	`HD-?Rip`, "HDRip",
+	`DVD-?Rip`, "DVDRip",
+	`DVD[59]|DVD`, "DVD",
+	`SAT-?Rip`, "SATRip",
+	`TV-?Rip`, "TVRip",
+	`CAM-?Rip|CAM`, "CAMRip",
+	`TS|Telesync`, "TS",
+)
+
+var releaseResolutions = releaseTags(
+	`2160[pi]|4K|UHD`, "2160p",
+	`1440[pi]`, "1440p",
+	`1080[pi]`, "1080p",
+	`720[pi]`, "720p",
+	`576[pi]`, "576p",
+	`480[pi]`, "480p",
+)
+
+var releaseHDR = releaseTags(
+	`HDR10\+`, "HDR10+",
+	`HDR10`, "HDR10",
+	`Dolby Vision|DoVi|DV`, "Dolby Vision",
+	`HDR`, "HDR",
+	`HLG`, "HLG",
+)
+
+var releaseCodecs = releaseTags(
+	`HEVC|[xh]\.?265`, "HEVC",
+	`AVC|[xh]\.?264`, "AVC",
+	`AV1`, "AV1",
+	`VP9`, "VP9",
+	`XviD|DivX`, "XviD",
+)
+
+var releaseTranslations = releaseTags(
+	`Dub|Дубляж`, "DUB",
+	`MVO`, "MVO",
+	`DVO`, "DVO",
+	`AVO`, "AVO",
+	`VO`, "VO",
+	`Original|Оригинал`, "Original",
+	`Sub|Subs|Субтитры`, "Sub",
+)
+
+var releaseAudio = releaseTags(
+	`TrueHD`, "TrueHD",
+	`Atmos`, "Atmos",
+	`DTS-HD(?: MA)?`, "DTS-HD",
+	`DTS`, "DTS",
+	`E-?AC-?3|DD\+`, "EAC3",
+	`AC-?3|DD5\.1`, "AC3",
+	`AAC`, "AAC",
+	`FLAC`, "FLAC",
+)
+
+var (
+	releaseYear     = regexp.MustCompile(`(^|[^\d])((?:19|20)\d{2})($|[^\d])`)
+	releaseSeason   = regexp.MustCompile(`(?i)(?:Сезон[ыа]?|Seasons?)\s*:?\s*(\d+)`)
+	releaseEpisodes = regexp.MustCompile(`(?i)(?:Серии|Серия|Эпизоды|Episodes?)\s*:?\s*(\d+)(?:\s*-\s*(\d+))?(?:\s*(?:из|of)\s*(\d+))?`)
+	releaseSxxExx   = regexp.MustCompile(`(?i)\bS(\d{1,2})E(\d{1,3})(?:-E?(\d{1,3}))?\b`)
+	releaseNameEnd  = regexp.MustCompile(`[(\[|]`)
+)
+
+// parseRelease parses a tracker title.
+func parseRelease(title string) *Release {
+	release := &Release{}
+	rest := title
+	if i := releaseNameEnd.FindStringIndex(title); i != nil {
+		rest = title[i[0]:]
+		title = title[:i[0]]
+	} else {
+		rest = ""
+	}
+	for _, name := range strings.Split(title, "/") {
+		// Seasons and episodes are not part of the name, e.g. in
+		// "The Expanse S06E01-03" or "Сезон: 1".
+		for _, pattern := range []*regexp.Regexp{releaseSxxExx, releaseSeason, releaseEpisodes} {
+			name = pattern.ReplaceAllString(name, "")
+		}
+		name = strings.Trim(name, " ,.:-")
+		if name == "" {
+			continue
+		}
+		release.Names = append(release.Names, name)
+	}
+	full := title + " " + rest
+
+	if m := releaseYear.FindStringSubmatch(rest); m != nil {
+		release.Year, _ = strconv.Atoi(m[2])
+	}
+	release.Source = firstTag(releaseSources, rest)
+	release.Resolution = firstTag(releaseResolutions, rest)
+	release.HDR = allTags(releaseHDR, rest)
+	release.Codec = firstTag(releaseCodecs, rest)
+	release.Translations = allTags(releaseTranslations, rest)
+	release.Audio = allTags(releaseAudio, rest)
+
+	if m := releaseSeason.FindStringSubmatch(full); m != nil {
+		release.Season, _ = strconv.Atoi(m[1])
+	}
+	if m := releaseEpisodes.FindStringSubmatch(full); m != nil {
+		release.FirstEpisode, _ = strconv.Atoi(m[1])
+		release.LastEpisode = release.FirstEpisode
+		if m[2] != "" {
+			release.LastEpisode, _ = strconv.Atoi(m[2])
+		}
+		release.TotalEpisodes, _ = strconv.Atoi(m[3])
+	} else if m := releaseSxxExx.FindStringSubmatch(full); m != nil {
+		release.Season, _ = strconv.Atoi(m[1])
+		release.FirstEpisode, _ = strconv.Atoi(m[2])
+		release.LastEpisode = release.FirstEpisode
+		if m[3] != "" {
+			release.LastEpisode, _ = strconv.Atoi(m[3])
+		}
+	}
+	return release
+}
+
+func firstTag(tags []releaseTag, s string) string {
+	for _, tag := range tags {
+		if tag.pattern.MatchString(s) {
+			return tag.name
+		}
+	}
+	return ""
+}
+
+// allTags returns the names of the tags found in s, in the order of tags.
+// A tag found inside a longer one, like HDR in HDR10, is not counted.
+func allTags(tags []releaseTag, s string) []string {
+	var names []string
+	for _, tag := range tags {
+		for _, m := range tag.pattern.FindAllStringSubmatchIndex(s, -1) {
+			// Blank the match so that shorter tags do not find it again.
+			s = s[:m[4]] + strings.Repeat(" ", m[5]-m[4]) + s[m[5]:]
+			if !containsString(names, tag.name) {
+				names = append(names, tag.name)
+			}
+		}
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Height returns the number of lines of the resolution, 0 if unknown.
+func (release *Release) Height() int {
+	height, _ := strconv.Atoi(strings.TrimSuffix(release.Resolution, "p"))
+	return height
+}
+
+// Name returns the localized name of the work.
+func (release *Release) Name() string {
+	if len(release.Names) == 0 {
+		return ""
+	}
+	return release.Names[0]
+}
+
+// OriginalName returns the original name of the work.
+func (release *Release) OriginalName() string {
+	if len(release.Names) == 0 {
+		return ""
+	}
+	return release.Names[len(release.Names)-1]
+}
+
+// Episodes describes the episodes of a release, e.g. "S01E01-06/10".
+func (release *Release) Episodes() string {
+	if release.FirstEpisode == 0 {
+		return ""
+	}
+	var episodes string
+	if release.Season > 0 {
+		episodes = fmt.Sprintf("S%02d", release.Season)
+	}
+	episodes += fmt.Sprintf("E%02d", release.FirstEpisode)
+	if release.LastEpisode > release.FirstEpisode {
+		episodes += fmt.Sprintf("-%02d", release.LastEpisode)
+	}
+	if release.TotalEpisodes > 0 {
+		episodes += fmt.Sprintf("/%d", release.TotalEpisodes)
+	}
+	return episodes
+}
+
+// Summary describes the quality of a release in a few words, e.g.
+// "2160p WEB-DL HDR10 DUB".
+func (release *Release) Summary() string {
+	var parts []string
+	for _, part := range []string{release.Episodes(), release.Resolution, release.Source, release.Codec} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	parts = append(parts, release.HDR...)
+	parts = append(parts, release.Translations...)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	for _, tt := range []struct {
+		title string
+		want  Release
+	}{
+		{
+			"Матрица / The Matrix (1999) BDRip 1080p [DUB, AVO] | Серии: 1-8 из 10",
+			Release{
+				Names: []string{"Матрица", "The Matrix"}, Year: 1999, Source: "BDRip", Resolution: "1080p",
+				Translations: []string{"DUB", "AVO"}, FirstEpisode: 1, LastEpisode: 8, TotalEpisodes: 10,
+			},
+		},
+		{
+			"Дюна / Dune (Дени Вильнёв / Denis Villeneuve) [2021, США, фантастика, WEB-DL 2160p, HDR10, Dolby Vision] Dub + Original + Sub (Rus, Eng)",
+			Release{
+				Names: []string{"Дюна", "Dune"}, Year: 2021, Source: "WEB-DL", Resolution: "2160p",
+				HDR: []string{"HDR10", "Dolby Vision"}, Translations: []string{"DUB", "Original", "Sub"},
+			},
+		},
+		{
+			"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 (Руперт Сандерс) [2021, США, фантастика, WEB-DL 1080p] MVO (LostFilm) + Original",
+			Release{
+				Names: []string{"Основание", "Foundation"}, Year: 2021, Source: "WEB-DL", Resolution: "1080p",
+				Translations: []string{"MVO", "Original"}, Season: 1, FirstEpisode: 1, LastEpisode: 6, TotalEpisodes: 10,
+			},
+		},
+		{
+			"Бегущий по лезвию 2049 / Blade Runner 2049 (2017) BD-Remux 2160p HEVC HDR10+ DTS-HD MA, TrueHD Atmos [MVO, DVO, Sub]",
+			Release{
+				Names: []string{"Бегущий по лезвию 2049", "Blade Runner 2049"}, Year: 2017, Source: "Remux", Resolution: "2160p",
+				HDR: []string{"HDR10+"}, Codec: "HEVC", Translations: []string{"MVO", "DVO", "Sub"},
+				Audio: []string{"TrueHD", "Atmos", "DTS-HD"},
+			},
+		},
+		{
+			"The Expanse S06E01-03 (2021) WEBRip 720p x264 [VO]",
+			Release{
+				Names: []string{"The Expanse"}, Year: 2021, Source: "WEBRip", Resolution: "720p",
+				Codec: "AVC", Translations: []string{"VO"}, Season: 6, FirstEpisode: 1, LastEpisode: 3,
+			},
+		},
+		{"Сборник", Release{Names: []string{"Сборник"}}},
+	} {
+		got := parseRelease(tt.title)
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("parseRelease(%q) = %+v, want %+v", tt.title, *got, tt.want)
+		}
+	}
+}
+
+func TestReleaseSummary(t *testing.T) {
+	release := parseRelease("Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p, HEVC, HDR10] MVO")
+	if got := release.Summary(); got != "S01E01-06/10 1080p WEB-DL HEVC HDR10 MVO" {
+		t.Errorf("Summary() = %q", got)
+	}
+	if got := release.Height(); got != 1080 {
+		t.Errorf("Height() = %d", got)
+	}
+	if release.Name() != "Основание" || release.OriginalName() != "Foundation" {
+		t.Errorf("names = %q, %q", release.Name(), release.OriginalName())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SEARCH_MIN_LENGTH is the length inline queries must reach before the
+// tracker is searched, so that the first letters typed are not searched.
+var SEARCH_MIN_LENGTH int = 3
+
+// SEARCH_CACHE_TTL is how long search results are reused.
+var SEARCH_CACHE_TTL time.Duration = 2 * time.Minute
+
+// searchCacheSize is how many searches are cached.
+const searchCacheSize = 256
+
+var searches = newSearchCache(searchCacheSize, SEARCH_CACHE_TTL)
+
+// normalizeQuery returns the form of a query searches are cached by.
+func normalizeQuery(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// searchTopics searches the tracker, reusing the results of the same
+// search made recently or running at the same time. Queries shorter than
+// SEARCH_MIN_LENGTH find nothing.
+func searchTopics(query string) ([]*Topic, error) {
+	query = normalizeQuery(query)
+	if len([]rune(query)) < SEARCH_MIN_LENGTH {
+		return nil, nil
+	}
+	return searches.get(query, func() ([]*Topic, error) {
+		return getTopics(query)
+	})
+}
+
+// searchCache is a least recently used cache of search results. Searches
+// missing from the cache are made once however many callers wait for them;
+// failed searches are not cached.
+type searchCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	calls   map[string]*searchCall
+}
+
+type searchEntry struct {
+	key     string
+	topics  []*Topic
+	expires time.Time
+}
+
+// searchCall is a search in progress.
+type searchCall struct {
+	done   chan struct{}
+	topics []*Topic
+	err    error
+}
+
+func newSearchCache(size int, ttl time.Duration) *searchCache {
+	return &searchCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		calls:   make(map[string]*searchCall),
+	}
+}
+
+// get returns the cached results for key, or those of fetch.
+func (c *searchCache) get(key string, fetch func() ([]*Topic, error)) ([]*Topic, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*searchEntry)
+		if c.now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.mu.Unlock()
+			return entry.topics, nil
+		}
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.topics, call.err
+	}
+	call := &searchCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.topics, call.err = fetch()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.entries[key] = c.order.PushFront(&searchEntry{
+			key:     key,
+			topics:  call.topics,
+			expires: c.now().Add(c.ttl),
+		})
+		for c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*searchEntry).key)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.topics, call.err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSearchCacheExpiresAndEvicts(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newSearchCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	fetches := make(map[string]int)
+	get := func(key string) {
+		_, err := c.get(key, func() ([]*Topic, error) {
+			fetches[key]++
+			return []*Topic{{ID: key}}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("dune")
+	get("dune")
+	get("alien")
+	get("dune")
+	// Alien is the least recently used.
+	get("matrix")
+	get("dune")
+	get("alien")
+	if fetches["dune"] != 1 || fetches["alien"] != 2 || fetches["matrix"] != 1 {
+		t.Errorf("fetches = %v, want dune once and alien twice", fetches)
+	}
+
+	now = now.Add(time.Minute)
+	get("dune")
+	if fetches["dune"] != 2 {
+		t.Errorf("dune fetched %d times, want again once expired", fetches["dune"])
+	}
+
+	_, err := c.get("error", func() ([]*Topic, error) {
+		return nil, errTrackerUnavailable
+	})
+	if !errors.Is(err, errTrackerUnavailable) {
+		t.Errorf("err = %v", err)
+	}
+	topics, err := c.get("error", func() ([]*Topic, error) {
+		return []*Topic{{ID: "1"}}, nil
+	})
+	if err != nil || len(topics) != 1 {
+		t.Errorf("failed search cached: %v, %v", topics, err)
+	}
+}
+
+func TestSearchCacheCoalesces(t *testing.T) {
+	c := newSearchCache(2, time.Minute)
+	release := make(chan struct{})
+	var fetches int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			topics, err := c.get("dune", func() ([]*Topic, error) {
+				atomic.AddInt32(&fetches, 1)
+				<-release
+				return []*Topic{{ID: "6119871"}}, nil
+			})
+			if err != nil || len(topics) != 1 {
+				t.Errorf("get() = %v, %v", topics, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("searched %d times, want once", fetches)
+	}
+}
+
+func TestSearchTopicsSkipsShortQueries(t *testing.T) {
+	topics, err := searchTopics("  du ")
+	if err != nil || topics != nil {
+		t.Errorf("searchTopics() = %v, %v, want nothing", topics, err)
+	}
+	if got := normalizeQuery("  Dune   2021 "); got != "dune 2021" {
+		t.Errorf("normalizeQuery() = %q", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// STATE_FILE is where the bot persists what it has to remember across
+// restarts.
+var STATE_FILE string = "state.json"
+
+var state *stateStore
+
+// State is everything the bot persists. It is only accessed through
+// stateStore.view and stateStore.update.
+type State struct {
+	Subscriptions map[string]*Subscription `json:"subscriptions"`
+	Watches       map[string]*Watch        `json:"watches"`
+	NextWatchID   int                      `json:"next_watch_id"`
+	// Torrents added through the bot, by info hash.
+	Torrents map[string]*TorrentRecord `json:"torrents"`
+	// Reaped are the torrents stopped by their seed policy, by info hash.
+	Reaped map[string]time.Time `json:"reaped"`
+	// Stalls track the progress of incomplete torrents, by info hash.
+	Stalls map[string]*StallRecord `json:"stalls"`
+	// Usage of the users this month, by user ID.
+	Usage map[int64]*Usage `json:"usage"`
+	// Chats are the settings of the chats, by chat ID.
+	Chats map[int64]*ChatSettings `json:"chats"`
+	// UpdateOffset is the Bot API update to resume polling from, and
+	// HandledUpdates the latest updates handled.
+	UpdateOffset   int   `json:"update_offset"`
+	HandledUpdates []int `json:"handled_updates"`
+	// Quality is the quality profile chosen by the users, by user ID.
+	Quality map[int64]string `json:"quality"`
+	// Languages of the users, by user ID.
+	Languages map[int64]*LanguagePreference `json:"languages"`
+}
+
+// TorrentRecord remembers where a torrent added through the bot comes from.
+type TorrentRecord struct {
+	T        string `json:"t"`
+	Instance string `json:"instance"`
+	ChatID   int64  `json:"chat_id"`
+	// UserID is the user who added the torrent, see owner.
+	UserID     int64       `json:"user_id,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	AddedAt    time.Time   `json:"added_at"`
+	SeedPolicy *SeedPolicy `json:"seed_policy,omitempty"`
+}
+
+type stateStore struct {
+	mu       sync.Mutex
+	fileName string
+	state    State
+	// dirty is set when the state has changes not saved yet.
+	dirty bool
+}
+
+func loadState(fileName string) (*stateStore, error) {
+	s := &stateStore{fileName: fileName}
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &s.state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.state.Subscriptions == nil {
+		s.state.Subscriptions = make(map[string]*Subscription)
+	}
+	if s.state.Watches == nil {
+		s.state.Watches = make(map[string]*Watch)
+	}
+	if s.state.Torrents == nil {
+		s.state.Torrents = make(map[string]*TorrentRecord)
+	}
+	if s.state.Reaped == nil {
+		s.state.Reaped = make(map[string]time.Time)
+	}
+	if s.state.Stalls == nil {
+		s.state.Stalls = make(map[string]*StallRecord)
+	}
+	if s.state.Usage == nil {
+		s.state.Usage = make(map[int64]*Usage)
+	}
+	if s.state.Chats == nil {
+		s.state.Chats = make(map[int64]*ChatSettings)
+	}
+	if s.state.Quality == nil {
+		s.state.Quality = make(map[int64]string)
+	}
+	if s.state.Languages == nil {
+		s.state.Languages = make(map[int64]*LanguagePreference)
+	}
+	return s, nil
+}
+
+// view runs fn with read access to the state.
+func (s *stateStore) view(fn func(*State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+}
+
+// update runs fn with write access to the state and saves it to disk.
+func (s *stateStore) update(fn func(*State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	return s.save()
+}
+
+// change runs fn with write access to the state without saving it, for
+// frequent changes that may be lost: they are saved by the next update or
+// flush.
+func (s *stateStore) change(fn func(*State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	s.dirty = true
+}
+
+// flush saves the changes made since the state was last saved, if any.
+func (s *stateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// save atomically writes the state to disk. The caller must hold s.mu.
+func (s *stateStore) save() error {
+	body, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFileName := s.fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFileName, body, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileName, s.fileName)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// maxHandledUpdates is how many handled update IDs are remembered, to skip
+// the updates Telegram sends again after a restart.
+const maxHandledUpdates = 1000
+
+// incomingUpdate is an update along with the forum topic thread of its
+// message, which the Bot API library does not know about.
+type incomingUpdate struct {
+	tgbotapi.Update
+	ThreadID int
+}
+
+// updateThread picks the thread of a message out of a raw update.
+type updateThread struct {
+	Message *struct {
+		MessageThreadID int `json:"message_thread_id"`
+	} `json:"message"`
+}
+
+// updateTracker records the updates received. An update is recorded as
+// handled, and the offset moved past it, before it is handed over to be
+// handled: an update being handled when the bot stops is not handled again,
+// rather than twice, and a slow update does not hold back the others.
+type updateTracker struct {
+	// next is the offset to poll with.
+	next int
+}
+
+func newUpdateTracker() *updateTracker {
+	t := &updateTracker{}
+	state.view(func(s *State) {
+		t.next = s.UpdateOffset
+	})
+	return t
+}
+
+// receive records the updates not handled yet as handled, and returns them.
+// The record is saved right away, unless the updates are all inline queries:
+// answering one again changes nothing, so they are saved with the next
+// change.
+func (t *updateTracker) receive(updates []*incomingUpdate) []*incomingUpdate {
+	var fresh []*incomingUpdate
+	save := false
+	record := func(s *State) {
+		for _, update := range updates {
+			if update.UpdateID >= t.next {
+				t.next = update.UpdateID + 1
+			}
+			if isHandled(s, update.UpdateID) {
+				continue
+			}
+			s.HandledUpdates = append(s.HandledUpdates, update.UpdateID)
+			fresh = append(fresh, update)
+			if update.InlineQuery == nil {
+				save = true
+			}
+		}
+		if len(s.HandledUpdates) > maxHandledUpdates {
+			s.HandledUpdates = s.HandledUpdates[len(s.HandledUpdates)-maxHandledUpdates:]
+		}
+		s.UpdateOffset = t.next
+	}
+	state.change(record)
+	if save {
+		err := state.flush()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return fresh
+}
+
+// isHandled reports whether an update is among the latest handled.
+func isHandled(s *State, id int) bool {
+	for _, handledID := range s.HandledUpdates {
+		if handledID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// polledUpdates is the result of a getUpdates call.
+type polledUpdates struct {
+	updates []*incomingUpdate
+	err     error
+}
+
+// receiveUpdates long-polls the Bot API for updates until stop is closed,
+// resuming from the offset saved in the state. Each update is received once,
+// even if Telegram sends it again. The channel is closed once stop is
+// closed and the updates received are all handed over.
+func receiveUpdates(bot *tgbotapi.BotAPI, timeout int, stop <-chan struct{}) <-chan *incomingUpdate {
+	ch := make(chan *incomingUpdate, bot.Buffer)
+	tracker := newUpdateTracker()
+	go func() {
+		defer close(ch)
+		for {
+			// The updates of a poll cut short by stop are not
+			// recorded, so Telegram sends them again after a restart.
+			polled := make(chan polledUpdates, 1)
+			go func(offset int) {
+				updates, err := getUpdates(bot, offset, timeout)
+				polled <- polledUpdates{updates, err}
+			}(tracker.next)
+			var result polledUpdates
+			select {
+			case <-stop:
+				return
+			case result = <-polled:
+			}
+			if result.err != nil {
+				log.Println(result.err)
+				log.Println("Failed to get updates, retrying in 3 seconds...")
+				select {
+				case <-stop:
+					return
+				case <-time.After(3 * time.Second):
+				}
+				continue
+			}
+			// The updates are recorded as handled: they are handed
+			// over even if stop is closed meanwhile.
+			for _, update := range tracker.receive(result.updates) {
+				ch <- update
+			}
+		}
+	}()
+	return ch
+}
+
+func getUpdates(bot *tgbotapi.BotAPI, offset int, timeout int) ([]*incomingUpdate, error) {
+	v := url.Values{}
+	if offset != 0 {
+		v.Add("offset", strconv.Itoa(offset))
+	}
+	if timeout > 0 {
+		v.Add("timeout", strconv.Itoa(timeout))
+	}
+	resp, err := bot.MakeRequest("getUpdates", v)
+	if err != nil {
+		return nil, err
+	}
+	var raws []json.RawMessage
+	err = json.Unmarshal(resp.Result, &raws)
+	if err != nil {
+		return nil, err
+	}
+	var updates []*incomingUpdate
+	for _, raw := range raws {
+		update := &incomingUpdate{}
+		err = json.Unmarshal(raw, &update.Update)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		var thread updateThread
+		err = json.Unmarshal(raw, &thread)
+		if err == nil && thread.Message != nil {
+			update.ThreadID = thread.Message.MessageThreadID
+		}
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
+
+// sendMessage sends a message through the outbox, to a forum topic thread
+// unless threadID is zero.
+func sendMessage(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig, threadID int) (tgbotapi.Message, error) {
+	if threadID == 0 {
+		return send(bot, msg)
+	}
+	return outgoing.enqueue(strconv.FormatInt(msg.ChatID, 10), "", func() (tgbotapi.Message, error) {
+		return sendToThread(bot, msg, threadID)
+	})
+}
+
+// sendToThread sends a message to a forum topic thread. The library cannot
+// send to threads, so the request is built by hand.
+func sendToThread(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig, threadID int) (tgbotapi.Message, error) {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(msg.ChatID, 10))
+	v.Add("message_thread_id", strconv.Itoa(threadID))
+	v.Add("text", msg.Text)
+	v.Add("disable_web_page_preview", strconv.FormatBool(msg.DisableWebPagePreview))
+	v.Add("disable_notification", strconv.FormatBool(msg.DisableNotification))
+	if msg.ParseMode != "" {
+		v.Add("parse_mode", msg.ParseMode)
+	}
+	if msg.ReplyToMessageID != 0 {
+		v.Add("reply_to_message_id", strconv.Itoa(msg.ReplyToMessageID))
+	}
+	if msg.ReplyMarkup != nil {
+		markup, err := json.Marshal(msg.ReplyMarkup)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		v.Add("reply_markup", string(markup))
+	}
+	resp, err := bot.MakeRequest("sendMessage", v)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var message tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &message)
+	return message, err
+}
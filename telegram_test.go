@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestReceiveUpdatesResumes(t *testing.T) {
+	telegram, server := newFakeTelegram(t, "test-token")
+	savedState := state
+	t.Cleanup(func() { state = savedState })
+	var err error
+	fileName := filepath.Join(t.TempDir(), "state.json")
+	state, err = loadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Update 1 was confirmed before the restart and 3 handled, out of order.
+	err = state.update(func(s *State) {
+		s.UpdateOffset = 2
+		s.HandledUpdates = []int{3}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		telegram.push(tgbotapi.Update{Message: &tgbotapi.Message{Text: "hello"}})
+	}
+	telegramURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot, err := tgbotapi.NewBotAPIWithClient("test-token", &http.Client{
+		Transport: &redirectTransport{target: telegramURL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	updates := receiveUpdates(bot, 0, stop)
+
+	var received []*incomingUpdate
+	for len(received) < 2 {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d updates, want 2", len(received))
+		}
+	}
+	if received[0].UpdateID != 2 || received[1].UpdateID != 4 {
+		t.Fatalf("received updates %d and %d, want 2 and 4", received[0].UpdateID, received[1].UpdateID)
+	}
+	// The updates are saved as handled before they are handled.
+	saved, err := loadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.state.UpdateOffset != 5 || len(saved.state.HandledUpdates) != 3 {
+		t.Errorf("saved offset %d and handled updates %v, want 5 and 3, 2 and 4", saved.state.UpdateOffset, saved.state.HandledUpdates)
+	}
+
+	// Restart while the updates are being handled: they are not received
+	// again.
+	close(stop)
+	for update := range updates {
+		t.Errorf("update %d received while stopping", update.UpdateID)
+	}
+	state = saved
+	telegram.push(tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "5", Query: "dune"}})
+	stop = make(chan struct{})
+	defer close(stop)
+	updates = receiveUpdates(bot, 0, stop)
+	select {
+	case update := <-updates:
+		if update.UpdateID != 5 {
+			t.Errorf("update %d received again after a restart", update.UpdateID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update 5 not received")
+	}
+	select {
+	case update := <-updates:
+		t.Errorf("update %d received again after a restart", update.UpdateID)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Inline queries are saved with the next change.
+	saved, err = loadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.state.UpdateOffset != 5 {
+		t.Errorf("saved offset %d before a flush, want 5", saved.state.UpdateOffset)
+	}
+	err = state.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err = loadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.state.UpdateOffset != 6 {
+		t.Errorf("saved offset %d after a flush, want 6", saved.state.UpdateOffset)
+	}
+}
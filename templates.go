@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// defaultTemplates are the built-in message templates, by name. Messages
+// sent in HTML mode use html/template so that tracker data is escaped.
+// Texts are translated with tr, see templateFuncs for the other helpers.
+var defaultTemplates = map[string]string{
+	// Search results and saved search matches, in HTML mode, with a Topic.
+	"topic": `<b>{{.Title}}</b>
+{{tr "Size: %s\nSeeders: %s\nDownloads: %s" (size .Size) .Seeders .Downloads}}
+{{- if not .CreatedAt.IsZero}}
+{{tr "Added: %s" (ago .CreatedAt)}}
+{{- end}}
+`,
+	// /list lines, with a TorrentInfo.
+	"status": `{{.Name}}: {{tr .Status}} ({{percent .PercentDone}})`,
+	// Status cards, with a TorrentInfo.
+	"status_card": `{{.Name}}: {{tr .Status}} ({{percent .PercentDone}})
+{{progress .PercentDone 20}}
+{{tr "Size: %s of %s" (size .DoneSize) (size .SizeWhenDone)}}
+{{tr "Speed: ↓ %s/s ↑ %s/s" (size .DownloadRate) (size .UploadRate)}}
+{{- if ge .ETA 0}}
+{{tr "ETA: %s" (duration .ETA)}}
+{{- end}}
+{{tr "Peers: %d, seeds: %d" .PeersConnected .SeedsConnected}}
+{{tr "Ratio: %.2f, uploaded %s" .Ratio (size .Uploaded)}}
+{{- if not .AddedAt.IsZero}}
+{{tr "Added: %s" (date .AddedAt)}}
+{{- end}}
+{{- if .Error}}
+{{tr "Error: %s" .Error}}
+{{- end}}
+{{- if .TrackerError}}
+{{tr "Tracker error: %s" .TrackerError}}
+{{- end}}`,
+	// The trackers and peers of a torrent, with a detailsView.
+	"details": `{{.Torrent.Name}}
+{{tr "Trackers:"}}
+{{- range .Trackers}}
+{{.Host}}: {{tr "%d seeders, %d leechers, %d downloads" .Seeders .Leechers .Downloads}}
+{{- if not .Succeeded}}{{if .LastResult}}
+  {{tr "Announce failed: %s" .LastResult}}{{end}}{{end}}
+{{- else}}
+{{tr "none"}}
+{{- end}}
+{{tr "Peers: %d connected, %d downloading from, %d uploading to, %d encrypted" .Peers.Connected .Peers.Downloading .Peers.Uploading .Peers.Encrypted}}
+{{- range .Peers.Clients}}
+{{.Name}}: {{.Count}}
+{{- end}}`,
+	// The alert about a stalled or failing torrent, with a stallView.
+	"stalled": `{{if eq .Problem "error"}}{{tr "%s: error: %s" .Torrent.Name .Torrent.Error}}
+{{- else if eq .Problem "trackers"}}{{tr "%s: every tracker is failing: %s" .Torrent.Name .Torrent.TrackerError}}
+{{- else}}{{tr "%s: no progress for %s at %s" .Torrent.Name (duration .StalledFor) (percent .Torrent.PercentDone)}}
+{{- end}}
+{{- if .Retried}}
+{{tr "Retrying automatically did not help."}}
+{{- end}}`,
+	// The confirmation asked before removing a torrent, with a TorrentInfo.
+	"remove_confirm": `{{tr "Are you sure you want to remove torrent \"%s\" and all its contents?" .Name}}`,
+	// The card of a removed torrent, with a TorrentInfo.
+	"removed": `{{tr "%s: removed" .Name}}`,
+	// The notice of a followed topic updated on the tracker, with a
+	// TorrentInfo.
+	"topic_updated": `{{tr "%s: updated on the tracker, downloading new files" .Name}}`,
+	// The summary of the torrents done seeding, with a seedingFinishedView.
+	"seeding_finished": `{{tr "Seeding finished for %d torrents:" (len .Torrents)}}
+{{- range .Torrents}}
+{{if .Instance}}[{{.Instance}}] {{end}}{{.Name}}: {{tr .Done}} ({{.Reason}})
+{{- end}}`,
+}
+
+var htmlTemplates = map[string]bool{
+	"topic": true,
+}
+
+// messageTemplate is a parsed template, executed with the helpers bound to
+// the printer of the recipient.
+type messageTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var messageTemplates = mustParseTemplates(nil)
+
+// templateFuncs returns the helpers available to templates.
+func templateFuncs(p *message.Printer) map[string]interface{} {
+	return map[string]interface{}{
+		"tr": func(key string, args ...interface{}) string {
+			return p.Sprintf(key, args...)
+		},
+		"size": func(size interface{}) string {
+			switch size := size.(type) {
+			case int64:
+				return localizeSize(p, size)
+			case string:
+				bytes, err := parseSize(size)
+				if err != nil {
+					return size
+				}
+				return localizeSize(p, bytes)
+			default:
+				return fmt.Sprint(size)
+			}
+		},
+		"duration": func(d time.Duration) string {
+			return localizeDuration(p, d)
+		},
+		"percent": func(fraction float64) string {
+			return p.Sprintf("%.1f%%", fraction*100)
+		},
+		"progress": progressBar,
+		"date": func(t time.Time) string {
+			return t.Local().Format("2006-01-02 15:04")
+		},
+		"ago": func(t time.Time) string {
+			return localizeAge(p, time.Since(t))
+		},
+	}
+}
+
+// progressBar draws a fraction between 0 and 1 as a bar of width blocks.
+func progressBar(fraction float64, width int) string {
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	done := int(fraction*float64(width) + 0.5)
+	return strings.Repeat("█", done) + strings.Repeat("░", width-done)
+}
+
+// localizeDuration renders a duration with its two most significant units,
+// e.g. "2d 5h".
+func localizeDuration(p *message.Printer, d time.Duration) string {
+	d = d.Round(time.Second)
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	seconds := int(d % time.Minute / time.Second)
+	switch {
+	case days > 0:
+		return p.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return p.Sprintf("%dh %dm", hours, minutes)
+	case minutes > 0:
+		return p.Sprintf("%dm %ds", minutes, seconds)
+	default:
+		return p.Sprintf("%ds", seconds)
+	}
+}
+
+// localizeAge renders how long ago something happened in its most
+// significant unit, e.g. "2 days ago".
+func localizeAge(p *message.Printer, d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d < time.Minute:
+		return p.Sprintf("just now")
+	case d < time.Hour:
+		return p.Sprintf("%d minutes ago", int(d/time.Minute))
+	case d < day:
+		return p.Sprintf("%d hours ago", int(d/time.Hour))
+	case d < 30*day:
+		return p.Sprintf("%d days ago", int(d/day))
+	case d < 365*day:
+		return p.Sprintf("%d months ago", int(d/(30*day)))
+	default:
+		return p.Sprintf("%d years ago", int(d/(365*day)))
+	}
+}
+
+// parseTemplates parses the built-in templates along with the overrides
+// from the config.
+func parseTemplates(overrides map[string]string) (map[string]*messageTemplate, error) {
+	funcs := templateFuncs(newPrinter(language.English))
+	templates := make(map[string]*messageTemplate, len(defaultTemplates))
+	for name, text := range defaultTemplates {
+		if override, ok := overrides[name]; ok {
+			text = override
+		}
+		var err error
+		mt := &messageTemplate{}
+		if htmlTemplates[name] {
+			mt.html, err = htmltemplate.New(name).Funcs(funcs).Parse(text)
+		} else {
+			mt.text, err = texttemplate.New(name).Funcs(funcs).Parse(text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %v", name, err)
+		}
+		templates[name] = mt
+	}
+	for name := range overrides {
+		if _, ok := defaultTemplates[name]; !ok {
+			return nil, fmt.Errorf("unknown template %q", name)
+		}
+	}
+	return templates, nil
+}
+
+func mustParseTemplates(overrides map[string]string) map[string]*messageTemplate {
+	templates, err := parseTemplates(overrides)
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// setupTemplates applies the template overrides of the config.
+func setupTemplates(cfg *Config) error {
+	templates, err := parseTemplates(cfg.Templates)
+	if err != nil {
+		return err
+	}
+	messageTemplates = templates
+	return nil
+}
+
+func (mt *messageTemplate) execute(p *message.Printer, data interface{}) (string, error) {
+	var b strings.Builder
+	if mt.html != nil {
+		tmpl, err := mt.html.Clone()
+		if err != nil {
+			return "", err
+		}
+		err = tmpl.Funcs(templateFuncs(p)).Execute(&b, data)
+		return b.String(), err
+	}
+	tmpl, err := mt.text.Clone()
+	if err != nil {
+		return "", err
+	}
+	err = tmpl.Funcs(templateFuncs(p)).Execute(&b, data)
+	return b.String(), err
+}
+
+// renderMessage executes the named template for the recipient of p. An
+// overridden template that fails falls back to the built-in one.
+func renderMessage(p *message.Printer, name string, data interface{}) string {
+	text, err := messageTemplates[name].execute(p, data)
+	if err == nil {
+		return text
+	}
+	log.Printf("Could not render template %q: %v", name, err)
+	mt := mustParseTemplates(nil)[name]
+	text, err = mt.execute(p, data)
+	if err != nil {
+		log.Printf("Could not render built-in template %q: %v", name, err)
+	}
+	return text
+}
+
+// detailsView is the data of the details template.
+type detailsView struct {
+	Torrent  *TorrentInfo
+	Trackers []*TrackerInfo
+	Peers    *peerSummary
+}
+
+// peerSummary counts the connected peers, along with the most common
+// clients among them.
+type peerSummary struct {
+	Connected   int
+	Downloading int
+	Uploading   int
+	Encrypted   int
+	Clients     []*clientCount
+}
+
+type clientCount struct {
+	Name  string
+	Count int
+}
+
+// maxPeerClients is how many clients a peer summary lists.
+const maxPeerClients = 5
+
+func newDetailsView(torrent *TorrentInfo, details *TorrentDetails) *detailsView {
+	summary := &peerSummary{Connected: len(details.Peers)}
+	counts := make(map[string]*clientCount)
+	for _, peer := range details.Peers {
+		if peer.DownloadRate > 0 {
+			summary.Downloading++
+		}
+		if peer.UploadRate > 0 {
+			summary.Uploading++
+		}
+		if peer.Encrypted {
+			summary.Encrypted++
+		}
+		name := peer.Client
+		if name == "" {
+			name = "?"
+		}
+		if counts[name] == nil {
+			counts[name] = &clientCount{Name: name}
+			summary.Clients = append(summary.Clients, counts[name])
+		}
+		counts[name].Count++
+	}
+	sort.SliceStable(summary.Clients, func(i, j int) bool {
+		return summary.Clients[i].Count > summary.Clients[j].Count
+	})
+	if len(summary.Clients) > maxPeerClients {
+		summary.Clients = summary.Clients[:maxPeerClients]
+	}
+	return &detailsView{Torrent: torrent, Trackers: details.Trackers, Peers: summary}
+}
+
+// seedingFinishedView is the data of the seeding_finished template.
+type seedingFinishedView struct {
+	Torrents []*reapedTorrentView
+}
+
+type reapedTorrentView struct {
+	// Instance is only set for torrents added outside of the bot.
+	Instance string
+	Name     string
+	Done     string
+	Reason   string
+}
+
+func newSeedingFinishedView(p *message.Printer, reaped []*reapedTorrent) *seedingFinishedView {
+	view := &seedingFinishedView{}
+	for _, r := range reaped {
+		torrent := &reapedTorrentView{Name: r.name, Done: r.done, Reason: r.reason.text(p)}
+		if r.unowned {
+			torrent.Instance = r.instance
+		}
+		view.Torrents = append(view.Torrents, torrent)
+	}
+	sort.Slice(view.Torrents, func(i, j int) bool {
+		a, b := view.Torrents[i], view.Torrents[j]
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		return a.Name < b.Name
+	})
+	return view
+}
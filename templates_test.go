@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+func TestTopicTemplateEscapesTrackerData(t *testing.T) {
+	p := newPrinter(language.English)
+	topic := &Topic{Title: `Tom & Jerry <b>"Remastered"</b>`, Size: "4.37 GB", Seeders: "12", Downloads: "<i>3</i>"}
+	text := renderMessage(p, "topic", topic)
+	want := "<b>Tom &amp; Jerry &lt;b&gt;&#34;Remastered&#34;&lt;/b&gt;</b>\nSize: 4.37 GB\nSeeders: 12\nDownloads: &lt;i&gt;3&lt;/i&gt;\n"
+	if text != want {
+		t.Errorf("topic = %q, want %q", text, want)
+	}
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	saved := messageTemplates
+	t.Cleanup(func() { messageTemplates = saved })
+
+	err := setupTemplates(&Config{Templates: map[string]string{
+		"status": `{{.Name}} {{progress .PercentDone 10}} {{percent .PercentDone}} {{size .TotalSize}}`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := &TorrentInfo{Name: "Dune", PercentDone: 0.42, TotalSize: 3 << 30}
+	text := renderMessage(newPrinter(language.Russian), "status", torrent)
+	if text != "Dune ████░░░░░░ 42,0% 3,00 ГБ" {
+		t.Errorf("status = %q", text)
+	}
+
+	err = setupTemplates(&Config{Templates: map[string]string{"status": `{{.Missing}}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failing override falls back to the built-in template.
+	if text := renderMessage(newPrinter(language.English), "status", torrent); text != "Dune:  (42.0%)" {
+		t.Errorf("status with a failing override = %q", text)
+	}
+
+	for _, templates := range []map[string]string{
+		{"unknown": "text"},
+		{"status": "{{.Name"},
+	} {
+		if err := setupTemplates(&Config{Templates: templates}); err == nil {
+			t.Errorf("setupTemplates(%v) succeeded", templates)
+		}
+	}
+}
+
+func TestLocalizeDuration(t *testing.T) {
+	en, ru := newPrinter(language.English), newPrinter(language.Russian)
+	for _, tt := range []struct {
+		d      time.Duration
+		en, ru string
+	}{
+		{42 * time.Second, "42s", "42с"},
+		{5*time.Minute + 3*time.Second, "5m 3s", "5м 3с"},
+		{2*time.Hour + 30*time.Minute, "2h 30m", "2ч 30м"},
+		{50 * time.Hour, "2d 2h", "2д 2ч"},
+	} {
+		if got := localizeDuration(en, tt.d); got != tt.en {
+			t.Errorf("localizeDuration(en, %s) = %q, want %q", tt.d, got, tt.en)
+		}
+		if got := localizeDuration(ru, tt.d); got != tt.ru {
+			t.Errorf("localizeDuration(ru, %s) = %q, want %q", tt.d, got, tt.ru)
+		}
+	}
+}
+
+func TestSeedingFinishedTemplate(t *testing.T) {
+	p := newPrinter(language.English)
+	text := renderMessage(p, "seeding_finished", newSeedingFinishedView(p, []*reapedTorrent{
+		{instance: "home", name: "Foundation", done: "stopped", reason: &seedReason{"ratio %.2f", 2.5}},
+		{instance: "seedbox", name: "Dune", done: "removed", reason: &seedReason{"idle for %s", 24 * time.Hour}, unowned: true},
+	}))
+	want := strings.Join([]string{
+		"Seeding finished for 2 torrents:",
+		"Foundation: stopped (ratio 2.50)",
+		"[seedbox] Dune: removed (idle for 1d 0h)",
+	}, "\n")
+	if text != want {
+		t.Errorf("summary = %q, want %q", text, want)
+	}
+}
+
+func TestLocalizeAge(t *testing.T) {
+	en, ru := newPrinter(language.English), newPrinter(language.Russian)
+	for _, tt := range []struct {
+		d      time.Duration
+		en, ru string
+	}{
+		{30 * time.Second, "just now", "только что"},
+		{time.Minute, "1 minute ago", "1 минуту назад"},
+		{3 * time.Hour, "3 hours ago", "3 часа назад"},
+		{50 * time.Hour, "2 days ago", "2 дня назад"},
+		{21 * 24 * time.Hour, "21 days ago", "21 день назад"},
+		{100 * 24 * time.Hour, "3 months ago", "3 месяца назад"},
+		{5 * 365 * 24 * time.Hour, "5 years ago", "5 лет назад"},
+	} {
+		if got := localizeAge(en, tt.d); got != tt.en {
+			t.Errorf("localizeAge(en, %s) = %q, want %q", tt.d, got, tt.en)
+		}
+		if got := localizeAge(ru, tt.d); got != tt.ru {
+			t.Errorf("localizeAge(ru, %s) = %q, want %q", tt.d, got, tt.ru)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TORZNAB_API_KEY is the key Torznab clients must send as apikey, none if
+// empty.
+var TORZNAB_API_KEY string
+
+const (
+	torznabDefaultLimit = 50
+	torznabMaxLimit     = 100
+)
+
+// Torznab error codes.
+const (
+	torznabBadCredentials   = 100
+	torznabMissingParameter = 200
+	torznabBadParameter     = 201
+	torznabNoSuchFunction   = 202
+	torznabUnknownError     = 900
+)
+
+// newznabCategory is a category of the Newznab standard, as listed by caps.
+type newznabCategory struct {
+	ID      int               `xml:"id,attr"`
+	Name    string            `xml:"name,attr"`
+	Subcats []newznabCategory `xml:"subcat,omitempty"`
+}
+
+var newznabCategories = []newznabCategory{
+	{ID: 2000, Name: "Movies", Subcats: []newznabCategory{
+		{ID: 2030, Name: "Movies/SD"},
+		{ID: 2040, Name: "Movies/HD"},
+		{ID: 2045, Name: "Movies/UHD"},
+		{ID: 2070, Name: "Movies/DVD"},
+	}},
+	{ID: 3000, Name: "Audio", Subcats: []newznabCategory{
+		{ID: 3010, Name: "Audio/MP3"},
+		{ID: 3030, Name: "Audio/Audiobook"},
+		{ID: 3040, Name: "Audio/Lossless"},
+	}},
+	{ID: 4000, Name: "PC", Subcats: []newznabCategory{
+		{ID: 4050, Name: "PC/Games"},
+	}},
+	{ID: 5000, Name: "TV", Subcats: []newznabCategory{
+		{ID: 5030, Name: "TV/SD"},
+		{ID: 5040, Name: "TV/HD"},
+		{ID: 5045, Name: "TV/UHD"},
+		{ID: 5060, Name: "TV/Sport"},
+		{ID: 5070, Name: "TV/Anime"},
+		{ID: 5080, Name: "TV/Documentary"},
+	}},
+	{ID: 7000, Name: "Books", Subcats: []newznabCategory{
+		{ID: 7020, Name: "Books/EBook"},
+	}},
+	{ID: 8000, Name: "Other"},
+}
+
+// forumCategories map tracker forums to Newznab categories: a forum is in
+// the category of the first entry whose words are all in its name.
+var forumCategories = []struct {
+	words    []string
+	category int
+}{
+	{[]string{"аудиокниг"}, 3030},
+	{[]string{"аниме"}, 5070},
+	{[]string{"документальн"}, 5080},
+	{[]string{"спорт"}, 5060},
+	{[]string{"сериал", "uhd"}, 5045},
+	{[]string{"сериал", "hd"}, 5040},
+	{[]string{"сериал"}, 5030},
+	{[]string{"uhd"}, 2045},
+	{[]string{"фильм", "hd"}, 2040},
+	{[]string{"кино", "hd"}, 2040},
+	{[]string{"фильм", "dvd"}, 2070},
+	{[]string{"кино", "dvd"}, 2070},
+	{[]string{"фильм"}, 2030},
+	{[]string{"кино"}, 2030},
+	{[]string{"lossless"}, 3040},
+	{[]string{"музык"}, 3010},
+	{[]string{"mp3"}, 3010},
+	{[]string{"игр"}, 4050},
+	{[]string{"программ"}, 4000},
+	{[]string{"книг"}, 7020},
+	{[]string{"журнал"}, 7020},
+}
+
+// forumCategory returns the Newznab category of a tracker forum.
+func forumCategory(forum string) int {
+	forum = strings.ToLower(forum)
+	for _, entry := range forumCategories {
+		matches := true
+		for _, word := range entry.words {
+			if !strings.Contains(forum, word) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return entry.category
+		}
+	}
+	return 8000
+}
+
+// parentCategory returns the top level category of a category.
+func parentCategory(category int) int {
+	return category / 1000 * 1000
+}
+
+type torznabCaps struct {
+	XMLName xml.Name `xml:"caps"`
+	Server  struct {
+		Title string `xml:"title,attr"`
+	} `xml:"server"`
+	Limits struct {
+		Max     int `xml:"max,attr"`
+		Default int `xml:"default,attr"`
+	} `xml:"limits"`
+	Searching struct {
+		Search      torznabSearching `xml:"search"`
+		TVSearch    torznabSearching `xml:"tv-search"`
+		MovieSearch torznabSearching `xml:"movie-search"`
+	} `xml:"searching"`
+	Categories []newznabCategory `xml:"categories>category"`
+}
+
+// torznabSearching is a search function and the parameters it supports.
+type torznabSearching struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type torznabFeed struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	Torznab string         `xml:"xmlns:torznab,attr"`
+	Channel torznabChannel `xml:"channel"`
+}
+
+type torznabChannel struct {
+	Title       string        `xml:"title"`
+	Description string        `xml:"description"`
+	Link        string        `xml:"link"`
+	Items       []torznabItem `xml:"item"`
+}
+
+type torznabItem struct {
+	Title      string `xml:"title"`
+	GUID       string `xml:"guid"`
+	Link       string `xml:"link"`
+	Comments   string `xml:"comments"`
+	PubDate    string `xml:"pubDate,omitempty"`
+	Size       int64  `xml:"size"`
+	Categories []int  `xml:"category"`
+	Enclosure  struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	Attrs []torznabAttr `xml:"torznab:attr"`
+}
+
+type torznabAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type torznabError struct {
+	XMLName     xml.Name `xml:"error"`
+	Code        int      `xml:"code,attr"`
+	Description string   `xml:"description,attr"`
+}
+
+// serveTorznab serves the Torznab API on addr: searches of the tracker for
+// Sonarr, Radarr and the like on /api, and the .torrent files of the
+// results, fetched with the bot's session, on /download/.
+func serveTorznab(addr string) {
+	log.Println(http.ListenAndServe(addr, newTorznabHandler()))
+}
+
+func newTorznabHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", handleTorznabAPI)
+	mux.HandleFunc("/download/", handleTorznabDownload)
+	return mux
+}
+
+func torznabAuthorized(r *http.Request) bool {
+	if TORZNAB_API_KEY == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.FormValue("apikey")), []byte(TORZNAB_API_KEY)) == 1
+}
+
+func handleTorznabAPI(w http.ResponseWriter, r *http.Request) {
+	if !torznabAuthorized(r) {
+		writeTorznabError(w, torznabBadCredentials, "Incorrect user credentials")
+		return
+	}
+	switch function := r.FormValue("t"); function {
+	case "caps":
+		writeTorznabXML(w, newTorznabCaps())
+	case "search", "tvsearch", "movie":
+		feed, code, err := torznabSearch(r, function)
+		if err != nil {
+			if code == torznabUnknownError {
+				log.Println(err)
+			}
+			writeTorznabError(w, code, err.Error())
+			return
+		}
+		writeTorznabXML(w, feed)
+	case "":
+		writeTorznabError(w, torznabMissingParameter, "Missing parameter (t)")
+	default:
+		writeTorznabError(w, torznabNoSuchFunction, "No such function ("+function+")")
+	}
+}
+
+func newTorznabCaps() *torznabCaps {
+	caps := &torznabCaps{Categories: newznabCategories}
+	caps.Searching.Search = torznabSearching{Available: "yes", SupportedParams: "q"}
+	caps.Searching.TVSearch = torznabSearching{Available: "yes", SupportedParams: "q,season,ep"}
+	caps.Searching.MovieSearch = torznabSearching{Available: "yes", SupportedParams: "q"}
+	caps.Server.Title = "transmission-bot"
+	caps.Limits.Max = torznabMaxLimit
+	caps.Limits.Default = torznabDefaultLimit
+	return caps
+}
+
+// torznabParameterError is an invalid parameter of a search.
+type torznabParameterError struct {
+	name string
+}
+
+func (e *torznabParameterError) Error() string {
+	return "Incorrect parameter (" + e.name + ")"
+}
+
+// intParameter returns the integer parameter name of the request, or def
+// if it is missing.
+func intParameter(r *http.Request, name string, def int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, &torznabParameterError{name}
+	}
+	return n, nil
+}
+
+// torznabSearch searches the tracker for a Torznab search function and
+// returns the results, or the Torznab error code of the failure.
+func torznabSearch(r *http.Request, function string) (*torznabFeed, int, error) {
+	var season, episode int
+	var err error
+	if function == "tvsearch" {
+		season, err = intParameter(r, "season", 0)
+		if err != nil {
+			return nil, torznabBadParameter, err
+		}
+		episode, err = intParameter(r, "ep", 0)
+		if err != nil {
+			return nil, torznabBadParameter, err
+		}
+	}
+	offset, err := intParameter(r, "offset", 0)
+	if err != nil {
+		return nil, torznabBadParameter, err
+	}
+	limit, err := intParameter(r, "limit", torznabDefaultLimit)
+	if err != nil {
+		return nil, torznabBadParameter, err
+	}
+	if limit == 0 || limit > torznabMaxLimit {
+		limit = torznabMaxLimit
+	}
+	categories := make(map[int]bool)
+	for _, field := range strings.Split(r.FormValue("cat"), ",") {
+		if field == "" {
+			continue
+		}
+		category, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, torznabBadParameter, &torznabParameterError{"cat"}
+		}
+		categories[category] = true
+	}
+
+	// Unlike inline queries, empty and short queries are searched: clients
+	// ask for the latest releases with an empty one.
+	query := normalizeQuery(r.FormValue("q"))
+	topics, err := searches.get(query, func() ([]*Topic, error) {
+		return getTopics(query)
+	})
+	if err != nil {
+		return nil, torznabUnknownError, err
+	}
+
+	feed := &torznabFeed{
+		Version: "2.0",
+		Torznab: "http://torznab.com/schemas/2015/feed",
+	}
+	feed.Channel.Title = "transmission-bot"
+	feed.Channel.Description = "Search results of " + forumMirrors.current()
+	feed.Channel.Link = forumMirrors.current()
+	var matched []*Topic
+	for _, topic := range topics {
+		category := forumCategory(topic.Forum)
+		if len(categories) > 0 && !categories[category] && !categories[parentCategory(category)] {
+			continue
+		}
+		if !matchesEpisode(topic.Release, season, episode) {
+			continue
+		}
+		matched = append(matched, topic)
+	}
+	if offset < len(matched) {
+		matched = matched[offset:]
+	} else {
+		matched = nil
+	}
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	for _, topic := range matched {
+		feed.Channel.Items = append(feed.Channel.Items, newTorznabItem(r, topic))
+	}
+	return feed, 0, nil
+}
+
+// matchesEpisode reports whether a release may hold an episode of a season,
+// any if zero. Releases not telling their season or episodes match.
+func matchesEpisode(release *Release, season int, episode int) bool {
+	if release == nil {
+		return true
+	}
+	if season > 0 && release.Season > 0 && release.Season != season {
+		return false
+	}
+	if episode > 0 && release.FirstEpisode > 0 && (episode < release.FirstEpisode || episode > release.LastEpisode) {
+		return false
+	}
+	return true
+}
+
+func newTorznabItem(r *http.Request, topic *Topic) torznabItem {
+	topicURL := forumMirrors.current() + "/viewtopic.php?t=" + topic.ID
+	category := forumCategory(topic.Forum)
+	item := torznabItem{
+		Title:      topic.Title,
+		GUID:       topicURL,
+		Link:       torznabDownloadURL(r, topic.ID),
+		Comments:   topicURL,
+		Size:       topic.SizeBytes,
+		Categories: []int{category},
+	}
+	if parent := parentCategory(category); parent != category {
+		item.Categories = append(item.Categories, parent)
+	}
+	if !topic.CreatedAt.IsZero() {
+		item.PubDate = topic.CreatedAt.Format(time.RFC1123Z)
+	}
+	item.Enclosure.URL = item.Link
+	item.Enclosure.Length = topic.SizeBytes
+	item.Enclosure.Type = "application/x-bittorrent"
+	for _, category := range item.Categories {
+		item.Attrs = append(item.Attrs, torznabAttr{"category", strconv.Itoa(category)})
+	}
+	item.Attrs = append(item.Attrs,
+		torznabAttr{"size", strconv.FormatInt(topic.SizeBytes, 10)},
+		torznabAttr{"seeders", strconv.Itoa(topic.SeedersCount)},
+		torznabAttr{"peers", strconv.Itoa(topic.SeedersCount + topic.LeechersCount)},
+		torznabAttr{"grabs", strconv.Itoa(topic.DownloadsCount)},
+		torznabAttr{"downloadvolumefactor", "1"},
+		torznabAttr{"uploadvolumefactor", "1"},
+	)
+	return item
+}
+
+// torznabDownloadURL returns the link clients download the .torrent of a
+// topic from, on the host they reached the API at.
+func torznabDownloadURL(r *http.Request, t string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	u := &url.URL{Scheme: scheme, Host: r.Host, Path: "/download/" + t + ".torrent"}
+	if TORZNAB_API_KEY != "" {
+		u.RawQuery = url.Values{"apikey": {TORZNAB_API_KEY}}.Encode()
+	}
+	return u.String()
+}
+
+func handleTorznabDownload(w http.ResponseWriter, r *http.Request) {
+	if !torznabAuthorized(r) {
+		http.Error(w, "Incorrect user credentials", http.StatusUnauthorized)
+		return
+	}
+	t := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/download/"), ".torrent")
+	if _, err := strconv.Atoi(t); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	_, body, err := getTorrentFile(t)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not download the torrent", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+t+`.torrent"`)
+	w.Write(body)
+}
+
+func writeTorznabXML(w http.ResponseWriter, v interface{}) {
+	body, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeTorznabError(w http.ResponseWriter, code int, description string) {
+	writeTorznabXML(w, &torznabError{Code: code, Description: description})
+}
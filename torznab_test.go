@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestForumCategory(t *testing.T) {
+	for forum, want := range map[string]int{
+		"Фильмы UHD Video":                      2045,
+		"Фильмы 2021 (HD Video)":                2040,
+		"Зарубежное кино (DVD Video)":           2070,
+		"Зарубежные сериалы (HD Video)":         5040,
+		"Русские сериалы":                       5030,
+		"Аниме (HD Video)":                      5070,
+		"Документальные фильмы (HD Video)":      5080,
+		"Аудиокниги: фантастика":                3030,
+		"Классическая музыка (lossless)":        3040,
+		"Горячие новинки (игры для Windows)":    4050,
+		"Something the tracker added yesterday": 8000,
+	} {
+		if got := forumCategory(forum); got != want {
+			t.Errorf("forumCategory(%q) = %d, want %d", forum, got, want)
+		}
+	}
+}
+
+func TestMatchesEpisode(t *testing.T) {
+	for _, tt := range []struct {
+		title           string
+		season, episode int
+		want            bool
+	}{
+		{"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p]", 0, 0, true},
+		{"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p]", 1, 0, true},
+		{"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p]", 2, 0, false},
+		{"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p]", 1, 6, true},
+		{"Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10 [2021, WEB-DL 1080p]", 1, 7, false},
+		{"The Expanse S06E01-03 (2021) WEBRip 720p", 6, 2, true},
+		{"The Expanse S06E01-03 (2021) WEBRip 720p", 5, 2, false},
+		// Releases not telling their season or episodes match any.
+		{"Основание / Foundation [2021, WEB-DL 1080p]", 3, 4, true},
+	} {
+		if got := matchesEpisode(parseRelease(tt.title), tt.season, tt.episode); got != tt.want {
+			t.Errorf("matchesEpisode(%q, %d, %d) = %v, want %v", tt.title, tt.season, tt.episode, got, tt.want)
+		}
+	}
+	if !matchesEpisode(nil, 1, 1) {
+		t.Error("topic without a release does not match")
+	}
+}
+
+func TestTorznabSearch(t *testing.T) {
+	savedMirrors, savedSearches := forumMirrors, searches
+	t.Cleanup(func() { forumMirrors, searches = savedMirrors, savedSearches })
+	forumMirrors = newMirrorSet([]string{"https://rutracker.org/forum"})
+	searches = newSearchCache(searchCacheSize, SEARCH_CACHE_TTL)
+	var topics []*Topic
+	for i := 0; i < 150; i++ {
+		topics = append(topics, &Topic{
+			ID:      strconv.Itoa(i),
+			Forum:   "Фильмы 2021 (HD Video)",
+			Title:   "Дюна / Dune",
+			Release: parseRelease("Дюна / Dune"),
+		})
+	}
+	topics = append(topics,
+		&Topic{ID: "tv1", Forum: "Зарубежные сериалы (HD Video)", Release: parseRelease("Основание / Foundation / Сезон: 1 / Серии: 1-6 из 10")},
+		&Topic{ID: "tv2", Forum: "Зарубежные сериалы (HD Video)", Release: parseRelease("Основание / Foundation / Сезон: 2 / Серии: 1-10 из 10")},
+		&Topic{ID: "uhd", Forum: "Фильмы UHD Video", Release: parseRelease("Дюна / Dune")},
+	)
+	// Every query finds the same topics.
+	for _, query := range []string{"dune", "foundation"} {
+		searches.get(query, func() ([]*Topic, error) { return topics, nil })
+	}
+
+	for _, tt := range []struct {
+		function string
+		query    string
+		// ids are the first and last results, code the Torznab error.
+		count int
+		ids   [2]string
+		code  int
+	}{
+		{function: "search", query: "q=Dune", count: torznabDefaultLimit, ids: [2]string{"0", "49"}},
+		{function: "search", query: "q=Dune&offset=140&limit=5", count: 5, ids: [2]string{"140", "144"}},
+		{function: "search", query: "q=Dune&limit=500", count: torznabMaxLimit, ids: [2]string{"0", "99"}},
+		{function: "search", query: "q=Dune&offset=1000", count: 0},
+		{function: "movie", query: "q=Dune&cat=2045", count: 1, ids: [2]string{"uhd", "uhd"}},
+		// Subcategories are in their parent category.
+		{function: "movie", query: "q=Dune&cat=2000&offset=150", count: 1, ids: [2]string{"uhd", "uhd"}},
+		{function: "tvsearch", query: "q=Foundation&cat=5000", count: 2, ids: [2]string{"tv1", "tv2"}},
+		{function: "tvsearch", query: "q=Foundation&cat=5040&season=2", count: 1, ids: [2]string{"tv2", "tv2"}},
+		{function: "tvsearch", query: "q=Foundation&cat=5040&season=1&ep=7", count: 0},
+		{function: "tvsearch", query: "q=Foundation&season=one", code: torznabBadParameter},
+		{function: "tvsearch", query: "q=Foundation&ep=-1", code: torznabBadParameter},
+		{function: "search", query: "q=Dune&cat=movies", code: torznabBadParameter},
+		{function: "search", query: "q=Dune&limit=x", code: torznabBadParameter},
+	} {
+		r := httptest.NewRequest("GET", "/api?t="+tt.function+"&"+tt.query, nil)
+		feed, code, err := torznabSearch(r, tt.function)
+		if code != tt.code || (err != nil) != (tt.code != 0) {
+			t.Errorf("%s %s: code %d, error %v, want code %d", tt.function, tt.query, code, err, tt.code)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		items := feed.Channel.Items
+		if len(items) != tt.count {
+			t.Errorf("%s %s: %d results, want %d", tt.function, tt.query, len(items), tt.count)
+			continue
+		}
+		if len(items) == 0 {
+			continue
+		}
+		ids := [2]string{items[0].GUID, items[len(items)-1].GUID}
+		for i, id := range tt.ids {
+			if want := "https://rutracker.org/forum/viewtopic.php?t=" + id; ids[i] != want {
+				t.Errorf("%s %s: result %d is %s, want %s", tt.function, tt.query, i, ids[i], want)
+			}
+		}
+	}
+}
+
+func TestTorznabDownloadURL(t *testing.T) {
+	savedKey := TORZNAB_API_KEY
+	t.Cleanup(func() { TORZNAB_API_KEY = savedKey })
+	for _, tt := range []struct {
+		key     string
+		headers map[string]string
+		want    string
+	}{
+		{want: "http://bot.local:9117/download/6119871.torrent"},
+		{key: "s3cr&t", want: "http://bot.local:9117/download/6119871.torrent?apikey=" + url.QueryEscape("s3cr&t")},
+		{headers: map[string]string{"X-Forwarded-Proto": "https"}, want: "https://bot.local:9117/download/6119871.torrent"},
+	} {
+		TORZNAB_API_KEY = tt.key
+		r := httptest.NewRequest("GET", "http://bot.local:9117/api?t=search", nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := torznabDownloadURL(r, "6119871"); got != tt.want {
+			t.Errorf("torznabDownloadURL() with key %q = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// COOKIE_FILE is where the cookies set by the tracker are kept across
+// restarts.
+var COOKIE_FILE string = "cookies.json"
+
+// FORUM_USER_AGENT is the User-Agent of the tracker requests.
+var FORUM_USER_AGENT string = "Mozilla/5.0 (X11; Linux x86_64; rv:102.0) Gecko/20100101 Firefox/102.0"
+
+var forumClient *trackerClient
+
+// trackerClient makes the requests to a tracker over a pool of kept-alive
+// connections, shared by its mirrors. The responses are requested gzipped
+// and decompressed by the transport.
+type trackerClient struct {
+	http *http.Client
+	jar  *persistentJar
+}
+
+// newTrackerClient returns the client of a tracker logged in with the
+// bb_session cookie on each of its mirrors. The cookies the tracker sets
+// later, e.g. a refreshed session, are saved in fileName and used again
+// after a restart as long as session does not change.
+func newTrackerClient(bases []string, session string, fileName string) (*trackerClient, error) {
+	jar, err := loadCookieJar(fileName, session)
+	if err != nil {
+		return nil, err
+	}
+	for _, base := range bases {
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		if !jar.has(u, "bb_session") {
+			jar.SetCookies(u, []*http.Cookie{{Name: "bb_session", Value: session, Path: "/"}})
+		}
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &trackerClient{
+		http: &http.Client{
+			Jar:       jar,
+			Transport: transport,
+			Timeout:   FORUM_TIMEOUT,
+		},
+		jar: jar,
+	}, nil
+}
+
+// do sends a request with the User-Agent of the client and returns the
+// body of the response.
+func (c *trackerClient) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("User-Agent", FORUM_USER_AGENT)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return body, err
+	}
+	return body, checkResponse(resp, body)
+}
+
+// savedCookie is a cookie as kept in the cookie file.
+type savedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Path     string    `json:"path,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+// cookieFile is the content of the cookie file: the cookies by the URL
+// they were set for, and the BB_SESSION they were set after.
+type cookieFile struct {
+	Session string                             `json:"session"`
+	Cookies map[string]map[string]*savedCookie `json:"cookies"`
+}
+
+// persistentJar is a cookie jar saving the cookies it is given to a file.
+type persistentJar struct {
+	*cookiejar.Jar
+	fileName string
+
+	mu    sync.Mutex
+	saved cookieFile
+}
+
+func loadCookieJar(fileName string, session string) (*persistentJar, error) {
+	inner, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	jar := &persistentJar{Jar: inner, fileName: fileName}
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &jar.saved)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if jar.saved.Session != session {
+		// Cookies from another login are stale.
+		jar.saved = cookieFile{Session: session}
+	}
+	if jar.saved.Cookies == nil {
+		jar.saved.Cookies = make(map[string]map[string]*savedCookie)
+	}
+	for rawURL, cookies := range jar.saved.Cookies {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		var restored []*http.Cookie
+		for _, cookie := range cookies {
+			restored = append(restored, &http.Cookie{
+				Name:     cookie.Name,
+				Value:    cookie.Value,
+				Path:     cookie.Path,
+				Domain:   cookie.Domain,
+				Expires:  cookie.Expires,
+				Secure:   cookie.Secure,
+				HttpOnly: cookie.HttpOnly,
+			})
+		}
+		inner.SetCookies(u, restored)
+	}
+	return jar, nil
+}
+
+// has reports whether the jar holds a cookie for u.
+func (jar *persistentJar) has(u *url.URL, name string) bool {
+	for _, cookie := range jar.Cookies(u) {
+		if cookie.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCookies stores the cookies set by a response and saves them.
+func (jar *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.Jar.SetCookies(u, cookies)
+	key := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	saved, ok := jar.saved.Cookies[key]
+	if !ok {
+		saved = make(map[string]*savedCookie)
+		jar.saved.Cookies[key] = saved
+	}
+	now := time.Now()
+	for _, cookie := range cookies {
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(now)) {
+			delete(saved, cookie.Name)
+			continue
+		}
+		expires := cookie.Expires
+		if cookie.MaxAge > 0 {
+			expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+		saved[cookie.Name] = &savedCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			Expires:  expires,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+		}
+	}
+	err := jar.save()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// save atomically writes the cookies to disk. The caller must hold jar.mu.
+func (jar *persistentJar) save() error {
+	body, err := json.MarshalIndent(&jar.saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFileName := jar.fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFileName, body, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, jar.fileName)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTrackerClientKeepsCookies(t *testing.T) {
+	var mu sync.Mutex
+	var sessions, userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cookie, err := r.Cookie("bb_session"); err == nil {
+			sessions = append(sessions, cookie.Value)
+		}
+		userAgents = append(userAgents, r.UserAgent())
+		if r.URL.Path == "/forum/refresh.php" {
+			http.SetCookie(w, &http.Cookie{Name: "bb_session", Value: "refreshed", Path: "/"})
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("ok"))
+		gz.Close()
+	}))
+	defer server.Close()
+	base := server.URL + "/forum"
+	fileName := filepath.Join(t.TempDir(), "cookies.json")
+	savedClient := forumClient
+	defer func() { forumClient = savedClient }()
+
+	var err error
+	forumClient, err = newTrackerClient([]string{base}, "initial", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/index.php", "/refresh.php", "/index.php"} {
+		body, err := doGETRequest(base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "ok" {
+			t.Errorf("body = %q, want the decompressed response", body)
+		}
+	}
+	// The client is made again as after a restart.
+	forumClient, err = newTrackerClient([]string{base}, "initial", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = doGETRequest(base+"/index.php", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new BB_SESSION replaces the saved cookies.
+	forumClient, err = newTrackerClient([]string{base}, "new", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = doGETRequest(base+"/index.php", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"initial", "initial", "refreshed", "refreshed", "new"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != len(want) {
+		t.Fatalf("sessions = %v, want %v", sessions, want)
+	}
+	for i := range want {
+		if sessions[i] != want[i] {
+			t.Errorf("sessions = %v, want %v", sessions, want)
+			break
+		}
+	}
+	for _, userAgent := range userAgents {
+		if userAgent != FORUM_USER_AGENT {
+			t.Errorf("User-Agent = %q, want %q", userAgent, FORUM_USER_AGENT)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+// localSizeUnits are the units of the tracker in Russian.
+var localSizeUnits = strings.NewReplacer("ПБ", "PB", "ТБ", "TB", "ГБ", "GB", "МБ", "MB", "КБ", "KB", "Б", "B")
+
+// parseSize parses human-readable sizes like "4.37 GB", "700MB" or
+// "4,37 ГБ" into bytes, using binary multiples as the tracker does.
+func parseSize(s string) (int64, error) {
+	s = strings.ReplaceAll(s, "\u00a0", " ")
+	s = localSizeUnits.Replace(strings.ToUpper(strings.TrimSpace(s)))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != ','
+	})
+	number, unit := s, "B"
+	if i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(number, ",", "."), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	for exp, u := range sizeUnits {
+		if unit == u || (exp > 0 && unit == u[:1]) {
+			for ; exp > 0; exp-- {
+				value *= 1024
+			}
+			return int64(value), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size unit %q", unit)
+}
+
+// parseCount parses a count like the tracker's seeders or downloads,
+// which may have thousands separators, e.g. "10 843" or "10,843".
+func parseCount(s string) (int, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\u00a0', '\u202f', ',', '.', '\'':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+	count, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	return count, nil
+}
+
+// formatSize renders a number of bytes the way the tracker does, e.g. "4.37 GB".
+func formatSize(size int64) string {
+	value := float64(size)
+	exp := 0
+	for value >= 1024 && exp < len(sizeUnits)-1 {
+		value /= 1024
+		exp++
+	}
+	if exp == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.2f %s", value, sizeUnits[exp])
+}
+
+// localizeSize renders a number of bytes like formatSize, in the language
+// of the printer.
+func localizeSize(p *message.Printer, size int64) string {
+	value := float64(size)
+	exp := 0
+	for value >= 1024 && exp < len(sizeUnits)-1 {
+		value /= 1024
+		exp++
+	}
+	if exp == 0 {
+		return p.Sprintf("%d bytes", size)
+	}
+	return p.Sprintf("%.2f "+sizeUnits[exp], value)
+}
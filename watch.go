@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/text/message"
+)
+
+// WATCH_INTERVAL is how often saved searches are run.
+var WATCH_INTERVAL time.Duration = 30 * time.Minute
+
+const watchUsage = "Usage: /watch <query> [seeders>=N] [size>=10GB] [size<=40GB] [res>=1080p] [auto]"
+
+// maxSeenTopics is how many topic IDs a watch remembers having seen.
+const maxSeenTopics = 1000
+
+// Watch is a saved search: new topics matching it are reported to the chat,
+// and with Auto set the first of them is downloaded right away.
+type Watch struct {
+	ID     string `json:"id"`
+	ChatID int64  `json:"chat_id"`
+	// UserID is the user who saved the search, whose quota the torrents
+	// downloaded automatically count against.
+	UserID     int64  `json:"user_id,omitempty"`
+	Query      string `json:"query"`
+	MinSeeders int    `json:"min_seeders"`
+	MinSize    int64  `json:"min_size"`
+	MaxSize    int64  `json:"max_size"`
+	// MinHeight is the lowest resolution, in lines, e.g. 1080.
+	MinHeight int        `json:"min_height,omitempty"`
+	Auto      bool       `json:"auto"`
+	Seen      seenTopics `json:"seen"`
+	CheckedAt time.Time  `json:"checked_at"`
+}
+
+// seenTopics are the IDs of the latest topics a watch has seen, the most
+// recently seen last.
+type seenTopics []string
+
+// UnmarshalJSON also reads the set of IDs the seen topics used to be saved
+// as, oldest topics first.
+func (seen *seenTopics) UnmarshalJSON(data []byte) error {
+	var ids []string
+	err := json.Unmarshal(data, &ids)
+	if err == nil {
+		*seen = ids
+		return nil
+	}
+	var set map[string]bool
+	if json.Unmarshal(data, &set) != nil {
+		return err
+	}
+	ids = make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	*seen = ids
+	return nil
+}
+
+// see marks topics as seen, forgetting the topics seen the longest ago
+// beyond maxSeenTopics. It returns the topics not seen before.
+func (seen *seenTopics) see(topics []*Topic) []*Topic {
+	ids := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		ids[topic.ID] = true
+	}
+	kept := make(seenTopics, 0, len(*seen)+len(topics))
+	for _, id := range *seen {
+		if ids[id] {
+			delete(ids, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	var fresh []*Topic
+	for _, topic := range topics {
+		if ids[topic.ID] {
+			fresh = append(fresh, topic)
+		}
+		kept = append(kept, topic.ID)
+	}
+	if len(kept) > maxSeenTopics {
+		kept = kept[len(kept)-maxSeenTopics:]
+	}
+	*seen = kept
+	return fresh
+}
+
+// parseWatch parses the arguments of the /watch command: filter tokens
+// anywhere in the text, everything else being the tracker query.
+func parseWatch(p *message.Printer, args string) (*Watch, error) {
+	watch := &Watch{}
+	var query []string
+	for _, token := range strings.Fields(args) {
+		lower := strings.ToLower(token)
+		var err error
+		switch {
+		case lower == "auto":
+			watch.Auto = true
+		case strings.HasPrefix(lower, "seeders>="):
+			watch.MinSeeders, err = strconv.Atoi(lower[len("seeders>="):])
+		case strings.HasPrefix(lower, "seeders>"):
+			watch.MinSeeders, err = strconv.Atoi(lower[len("seeders>"):])
+			watch.MinSeeders++
+		case strings.HasPrefix(lower, "size>="):
+			watch.MinSize, err = parseSize(lower[len("size>="):])
+		case strings.HasPrefix(lower, "size>"):
+			watch.MinSize, err = parseSize(lower[len("size>"):])
+		case strings.HasPrefix(lower, "size<="):
+			watch.MaxSize, err = parseSize(lower[len("size<="):])
+		case strings.HasPrefix(lower, "size<"):
+			watch.MaxSize, err = parseSize(lower[len("size<"):])
+		case strings.HasPrefix(lower, "res>="):
+			watch.MinHeight, err = parseHeight(lower[len("res>="):])
+		default:
+			query = append(query, token)
+		}
+		if err != nil {
+			return nil, &refusal{p.Sprintf("Invalid filter %s", token)}
+		}
+	}
+	if len(query) == 0 {
+		return nil, &refusal{p.Sprintf("Empty query")}
+	}
+	watch.Query = strings.Join(query, " ")
+	return watch, nil
+}
+
+// matches reports whether a topic passes the watch's filters.
+func (watch *Watch) matches(topic *Topic) bool {
+	if watch.MinSeeders > 0 && topic.SeedersCount < watch.MinSeeders {
+		return false
+	}
+	if watch.MinSize > 0 || watch.MaxSize > 0 {
+		if topic.SizeBytes == 0 {
+			return false
+		}
+		if watch.MinSize > 0 && topic.SizeBytes < watch.MinSize {
+			return false
+		}
+		if watch.MaxSize > 0 && topic.SizeBytes > watch.MaxSize {
+			return false
+		}
+	}
+	if watch.MinHeight > 0 && (topic.Release == nil || topic.Release.Height() < watch.MinHeight) {
+		return false
+	}
+	return true
+}
+
+// parseHeight parses a resolution like "1080p" or "4k" into lines.
+func parseHeight(s string) (int, error) {
+	height := (&Release{Resolution: firstTag(releaseResolutions, s)}).Height()
+	if height == 0 {
+		return 0, fmt.Errorf("invalid resolution %q", s)
+	}
+	return height, nil
+}
+
+func (watch *Watch) String() string {
+	var filters []string
+	if watch.MinSeeders > 0 {
+		filters = append(filters, fmt.Sprintf("seeders>=%d", watch.MinSeeders))
+	}
+	if watch.MinSize > 0 {
+		filters = append(filters, fmt.Sprintf("size>=%s", formatSize(watch.MinSize)))
+	}
+	if watch.MaxSize > 0 {
+		filters = append(filters, fmt.Sprintf("size<=%s", formatSize(watch.MaxSize)))
+	}
+	if watch.MinHeight > 0 {
+		filters = append(filters, fmt.Sprintf("res>=%dp", watch.MinHeight))
+	}
+	if watch.Auto {
+		filters = append(filters, "auto")
+	}
+	if len(filters) == 0 {
+		return fmt.Sprintf("#%s %s", watch.ID, watch.Query)
+	}
+	return fmt.Sprintf("#%s %s (%s)", watch.ID, watch.Query, strings.Join(filters, ", "))
+}
+
+// addWatch saves a search of a user for the chat. Topics already matching
+// it are marked as seen, so that only new releases are reported.
+func addWatch(p *message.Printer, chatID int64, user *tgbotapi.User, args string) string {
+	watch, err := parseWatch(p, args)
+	if err != nil {
+		return fmt.Sprintf("%s.\n%s", err, p.Sprintf(watchUsage))
+	}
+	topics, err := getTopics(watch.Query)
+	if err != nil {
+		return p.Sprintf("Could not search the tracker: %s", reportError(p, "watch "+args, err))
+	}
+	watch.Seen.see(topics)
+	watch.ChatID = chatID
+	if user != nil {
+		watch.UserID = int64(user.ID)
+	}
+	watch.CheckedAt = time.Now()
+	err = state.update(func(s *State) {
+		s.NextWatchID++
+		watch.ID = strconv.Itoa(s.NextWatchID)
+		s.Watches[watch.ID] = watch
+	})
+	if err != nil {
+		return p.Sprintf("Could not save the search: %s", reportError(p, "watch "+args, err))
+	}
+	return p.Sprintf("Watching %s\n%d current results will not be reported.", watch, len(topics))
+}
+
+func removeWatch(p *message.Printer, chatID int64, args string) string {
+	id := strings.TrimPrefix(strings.TrimSpace(args), "#")
+	var found bool
+	err := state.update(func(s *State) {
+		watch, ok := s.Watches[id]
+		if ok && watch.ChatID == chatID {
+			delete(s.Watches, id)
+			found = true
+		}
+	})
+	if err != nil {
+		return p.Sprintf("Could not remove the search: %s", reportError(p, "unwatch "+args, err))
+	}
+	if !found {
+		return p.Sprintf("No such search. Usage: /unwatch <id>")
+	}
+	return p.Sprintf("Stopped watching #%s", id)
+}
+
+func getWatchListMessage(p *message.Printer, chatID int64) string {
+	var lines []string
+	state.view(func(s *State) {
+		for _, watch := range s.Watches {
+			if watch.ChatID == chatID {
+				lines = append(lines, watch.String())
+			}
+		}
+	})
+	if len(lines) == 0 {
+		return p.Sprintf("No saved searches. %s", p.Sprintf(watchUsage))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// runWatch searches the tracker for a watch and returns the new matching
+// topics, marking every new topic as seen.
+func runWatch(watch *Watch) ([]*Topic, error) {
+	topics, err := getTopics(watch.Query)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Topic
+	for _, topic := range watch.Seen.see(topics) {
+		if watch.matches(topic) {
+			matches = append(matches, topic)
+		}
+	}
+	return matches, nil
+}
+
+// notifyWatchMatches reports new matches of a watch to its chat, and
+// downloads the first one if the watch asks for it.
+func notifyWatchMatches(bot *tgbotapi.BotAPI, watch *Watch, matches []*Topic) {
+	p := chatPrinter(watch.ChatID)
+	for i, topic := range matches {
+		msg := tgbotapi.NewMessage(watch.ChatID, p.Sprintf("New result for #%s %s:\n", watch.ID, html.EscapeString(watch.Query))+getTopicText(p, topic))
+		msg.ParseMode = "HTML"
+		msg.ReplyMarkup = getTopicReplyMarkup(p, topic)
+		_, err := send(bot, msg)
+		if err != nil {
+			log.Println(err)
+		}
+		if i > 0 || !watch.Auto {
+			continue
+		}
+		err = autoDownload(bot, p, watch, topic)
+		if err != nil {
+			msg = tgbotapi.NewMessage(watch.ChatID, p.Sprintf("Could not download it: %s", describeError(p, "watch #"+watch.ID, err)))
+			_, err = send(bot, msg)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// autoDownload downloads a match of a watch on behalf of the user who saved
+// it, within their quota, and sends its status card to the chat.
+func autoDownload(bot *tgbotapi.BotAPI, p *message.Printer, watch *Watch, topic *Topic) error {
+	err := checkQuota(p, watch.UserID, topic.ID)
+	if err != nil {
+		return err
+	}
+	instance, c, torrent, err := addTorrent(topic.ID, "", watch.ChatID, watch.UserID)
+	if err != nil {
+		return err
+	}
+	if instance == nil {
+		// Without a matching route the user picks the instance with Download.
+		return nil
+	}
+	info, err := getTorrentInfo(c, torrent.Hash)
+	if err != nil {
+		return err
+	}
+	msg := tgbotapi.NewMessage(watch.ChatID, renderMessage(p, "status_card", info))
+	msg.ReplyMarkup = getReplyMarkup(p, topic.ID, instance.Name)
+	_, err = send(bot, msg)
+	if err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// checkWatches runs every saved search that is due.
+func checkWatches(bot *tgbotapi.BotAPI) {
+	var watches []*Watch
+	state.view(func(s *State) {
+		for _, watch := range s.Watches {
+			if time.Since(watch.CheckedAt) >= WATCH_INTERVAL {
+				copied := *watch
+				copied.Seen = append(seenTopics(nil), watch.Seen...)
+				watches = append(watches, &copied)
+			}
+		}
+	})
+	for _, watch := range watches {
+		matches, err := runWatch(watch)
+		if err != nil {
+			log.Printf("Could not run saved search #%s: %v", watch.ID, err)
+		}
+		watch.CheckedAt = time.Now()
+		err = state.update(func(s *State) {
+			if current, ok := s.Watches[watch.ID]; ok {
+				current.Seen = watch.Seen
+				current.CheckedAt = watch.CheckedAt
+			}
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		notifyWatchMatches(bot, watch, matches)
+	}
+}
+
+func runWatcher(bot *tgbotapi.BotAPI) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkWatches(bot)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestParseWatch(t *testing.T) {
+	p := newPrinter(language.English)
+	watch, err := parseWatch(p, "Матрица 2160p seeders>=5 size>=20GB SIZE<=80gb res>=4K auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watch.Query != "Матрица 2160p" || watch.MinSeeders != 5 || !watch.Auto {
+		t.Errorf("parseWatch() = %+v", watch)
+	}
+	if watch.MinHeight != 2160 {
+		t.Errorf("parseWatch() resolution = %d", watch.MinHeight)
+	}
+	if watch.MinSize != 20<<30 || watch.MaxSize != 80<<30 {
+		t.Errorf("parseWatch() sizes = %d, %d", watch.MinSize, watch.MaxSize)
+	}
+
+	for _, args := range []string{"", "seeders>=5", "matrix seeders>=many", "matrix size<big", "matrix res>=hd"} {
+		_, err = parseWatch(p, args)
+		if err == nil {
+			t.Errorf("parseWatch(%q) succeeded", args)
+		}
+	}
+	_, err = parseWatch(newPrinter(language.Russian), "matrix size<big")
+	if err == nil || err.Error() != "Неверный фильтр size<big" {
+		t.Errorf("parseWatch() error = %v, want it translated", err)
+	}
+}
+
+func TestSeenTopics(t *testing.T) {
+	var seen seenTopics
+	err := json.Unmarshal([]byte(`{"12": true, "9": true, "100": true}`), &seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 || seen[0] != "9" || seen[2] != "100" {
+		t.Errorf("seen topics from a set = %v, want 9, 12 and 100", seen)
+	}
+
+	fresh := seen.see([]*Topic{{ID: "9"}, {ID: "101"}})
+	if len(fresh) != 1 || fresh[0].ID != "101" {
+		t.Errorf("see() = %v, want topic 101", fresh)
+	}
+	if len(seen) != 4 || seen[len(seen)-2] != "9" {
+		t.Errorf("seen topics = %v, want 9 seen again last but one", seen)
+	}
+
+	var topics []*Topic
+	for i := 0; i < maxSeenTopics; i++ {
+		topics = append(topics, &Topic{ID: strconv.Itoa(1000 + i)})
+	}
+	seen.see(topics)
+	if len(seen) != maxSeenTopics || seen[0] != "1000" {
+		t.Errorf("%d seen topics from %s, want the latest %d", len(seen), seen[0], maxSeenTopics)
+	}
+}
+
+func TestWatchMatches(t *testing.T) {
+	watch := &Watch{MinSeeders: 3, MinSize: 1 << 30, MaxSize: 10 << 30}
+	for _, tc := range []struct {
+		topic *Topic
+		want  bool
+	}{
+		{&Topic{SeedersCount: 5, SizeBytes: 4692251770}, true},
+		{&Topic{SeedersCount: 2, SizeBytes: 4692251770}, false},
+		{&Topic{SeedersCount: 0, SizeBytes: 4692251770}, false},
+		{&Topic{SeedersCount: 5, SizeBytes: 700 << 20}, false},
+		{&Topic{SeedersCount: 5, SizeBytes: 12 << 30}, false},
+		{&Topic{SeedersCount: 5}, false},
+	} {
+		if got := watch.matches(tc.topic); got != tc.want {
+			t.Errorf("matches(%+v) = %v, want %v", tc.topic, got, tc.want)
+		}
+	}
+	watch = &Watch{MinHeight: 1080}
+	for title, want := range map[string]bool{
+		"Дюна / Dune [2021, WEB-DL 2160p]": true,
+		"Дюна / Dune [2021, BDRip 720p]":   false,
+		"Дюна / Dune [2021, CAMRip]":       false,
+	} {
+		if got := watch.matches(&Topic{Release: parseRelease(title)}); got != want {
+			t.Errorf("matches(%q) = %v, want %v", title, got, want)
+		}
+	}
+}